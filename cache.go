@@ -0,0 +1,203 @@
+package tftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+var errTooLargeToCache = errors.New("File too large to cache")
+
+/*
+Cache keeps the content produced by the WriteHandler in memory so that
+concurrent and later downloads of the same file share a single read of the
+source, e.g. when many devices fetch the same boot image:
+
+	s.Cache = &tftp.Cache{MaxBytes: 64 << 20}
+
+Content is keyed by filename only, so a handler serving different content
+for the same name depending on the client must not be cached. Files that
+do not fit within MaxBytes are served from the handler as usual; the cache
+remembers them until they are invalidated, so later requests go straight
+to the handler instead of reading MaxBytes of the file in vain. Handler
+errors are passed on to the waiting clients but not cached.
+
+A file is loaded for all the requests waiting for it, so the load does not
+end with the transfer it was started for: the handler gets that transfer's
+Request, but with a context without its cancellation.
+*/
+type Cache struct {
+	// MaxBytes caps the total size of the cached content. The least
+	// recently used files are evicted to make room for new ones.
+	MaxBytes int64
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	size    int64
+}
+
+type cacheEntry struct {
+	// ready is closed once data, err and tooLarge are set.
+	ready chan struct{}
+	data  []byte
+	err   error
+	// tooLarge entries stay in the cache, without data, to remember that
+	// the file does not fit.
+	tooLarge bool
+	lastUsed time.Time
+}
+
+// Invalidate drops the cached content of filename, which is read from the
+// handler again on the next request, or that it is too large to cache.
+// Transfers already being served from the old content are not affected.
+func (c *Cache) Invalidate(filename string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(filename)
+}
+
+// Purge drops all cached content.
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+	c.size = 0
+}
+
+// get returns the content of filename, calling load to produce it unless
+// it is cached or already being loaded for another transfer. ok is false
+// when the content does not fit in the cache. If this call found that out
+// by loading it, rest is the remainder of the load following data, for
+// the caller to serve instead of loading the file once more.
+func (c *Cache) get(filename string, load func(w *io.PipeWriter)) (data []byte, rest io.ReadCloser, ok bool, e error) {
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]*cacheEntry)
+	}
+	entry, found := c.entries[filename]
+	if found {
+		entry.lastUsed = time.Now()
+		c.mu.Unlock()
+		<-entry.ready
+	} else {
+		entry = &cacheEntry{ready: make(chan struct{}), lastUsed: time.Now()}
+		c.entries[filename] = entry
+		c.mu.Unlock()
+		var prefix []byte
+		if prefix, rest = c.fill(filename, entry, load); rest != nil {
+			return prefix, rest, false, nil
+		}
+	}
+	if entry.tooLarge {
+		return nil, nil, false, nil
+	}
+	return entry.data, nil, true, entry.err
+}
+
+// fill loads the content of entry and stores it if it fits. If it does
+// not, it returns the data read so far and the rest of the load.
+func (c *Cache) fill(filename string, entry *cacheEntry, load func(w *io.PipeWriter)) (prefix []byte, rest io.ReadCloser) {
+	reader, writer := io.Pipe()
+	go load(writer)
+	data, e := io.ReadAll(io.LimitReader(reader, c.MaxBytes+1))
+	tooLarge := e == nil && int64(len(data)) > c.MaxBytes
+	if !tooLarge {
+		reader.Close()
+	}
+	c.mu.Lock()
+	if tooLarge {
+		entry.tooLarge = true
+	} else {
+		entry.data, entry.err = data, e
+	}
+	if c.entries[filename] == entry {
+		if e != nil {
+			delete(c.entries, filename)
+		} else if !entry.tooLarge {
+			c.size += int64(len(data))
+			c.evict(filename)
+		}
+	}
+	c.mu.Unlock()
+	close(entry.ready)
+	if tooLarge {
+		return data, reader
+	}
+	return nil, nil
+}
+
+// evict drops the least recently used loaded entries other than keep until
+// the cache fits within MaxBytes.
+func (c *Cache) evict(keep string) {
+	for c.size > c.MaxBytes {
+		var oldest string
+		var oldestEntry *cacheEntry
+		for name, entry := range c.entries {
+			if name == keep || entry.data == nil {
+				continue
+			}
+			if oldestEntry == nil || entry.lastUsed.Before(oldestEntry.lastUsed) {
+				oldest, oldestEntry = name, entry
+			}
+		}
+		if oldestEntry == nil {
+			return
+		}
+		c.remove(oldest)
+	}
+}
+
+func (c *Cache) remove(filename string) {
+	if entry, ok := c.entries[filename]; ok {
+		c.size -= int64(len(entry.data))
+		delete(c.entries, filename)
+	}
+}
+
+// cachedHandler wraps h so that the content it produces is served through
+// s.Cache.
+func (s *Server) cachedHandler(h func(req *Request, w *io.PipeWriter), l *transferLog) func(req *Request, w *io.PipeWriter) {
+	return func(req *Request, w *io.PipeWriter) {
+		data, rest, ok, e := s.Cache.get(req.Filename, func(loadWriter *io.PipeWriter) {
+			load := req.WithContext(detachedContext{req.Context()})
+			s.callWriteHandler(h, load, loadWriter, l)
+		})
+		if rest != nil {
+			// Too large to cache: serve the load itself.
+			if _, e = w.Write(data); e == nil {
+				_, e = io.Copy(w, rest)
+			}
+			rest.Close()
+			w.CloseWithError(e)
+			return
+		}
+		if !ok {
+			h(req, w)
+			return
+		}
+		if e != nil {
+			w.CloseWithError(e)
+			return
+		}
+		if _, e = w.Write(data); e != nil {
+			return
+		}
+		w.Close()
+	}
+}
+
+// detachedContext carries the values of its parent but not its deadline
+// or cancellation, for a load outliving the transfer it was started for.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+
+func (detachedContext) Done() <-chan struct{} { return nil }
+
+func (detachedContext) Err() error { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
@@ -0,0 +1,114 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveCached runs h for req and returns what it wrote.
+func serveCached(h func(req *Request, w *io.PipeWriter), req *Request) ([]byte, error) {
+	r, w := io.Pipe()
+	go h(req, w)
+	return io.ReadAll(r)
+}
+
+func TestCacheServesFromMemory(t *testing.T) {
+	var calls int32
+	s := &Server{Cache: &Cache{MaxBytes: 100}}
+	h := s.cachedHandler(func(req *Request, w *io.PipeWriter) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte("content"))
+		w.Close()
+	}, nil)
+	for i := 0; i < 3; i++ {
+		data, e := serveCached(h, &Request{Filename: "file"})
+		if e != nil || string(data) != "content" {
+			t.Fatalf("Request %d: %q, %v", i, data, e)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Handler called %d times, want 1", calls)
+	}
+	s.Cache.Invalidate("file")
+	serveCached(h, &Request{Filename: "file"})
+	if calls != 2 {
+		t.Errorf("Handler called %d times after Invalidate, want 2", calls)
+	}
+}
+
+func TestCacheTooLarge(t *testing.T) {
+	var calls int32
+	content := bytes.Repeat([]byte("x"), 1000)
+	s := &Server{Cache: &Cache{MaxBytes: 100}}
+	h := s.cachedHandler(func(req *Request, w *io.PipeWriter) {
+		atomic.AddInt32(&calls, 1)
+		w.Write(content)
+		w.Close()
+	}, nil)
+	for i := 1; i <= 3; i++ {
+		data, e := serveCached(h, &Request{Filename: "big"})
+		if e != nil || !bytes.Equal(data, content) {
+			t.Fatalf("Request %d: %d bytes, %v", i, len(data), e)
+		}
+		if calls != int32(i) {
+			t.Errorf("Request %d: handler called %d times, want %d", i, calls, i)
+		}
+	}
+	if s.Cache.size != 0 {
+		t.Errorf("Cache holds %d bytes", s.Cache.size)
+	}
+}
+
+func TestCacheLoadOutlivesRequest(t *testing.T) {
+	release := make(chan struct{})
+	s := &Server{Cache: &Cache{MaxBytes: 100}}
+	h := s.cachedHandler(func(req *Request, w *io.PipeWriter) {
+		select {
+		case <-release:
+			w.Write([]byte("content"))
+			w.Close()
+		case <-req.Context().Done():
+			w.CloseWithError(req.Context().Err())
+		}
+	}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, e := serveCached(h, (&Request{Filename: "file"}).WithContext(ctx))
+		first <- e
+	}()
+	// Wait for the first request to start the load.
+	for {
+		s.Cache.mu.Lock()
+		started := s.Cache.entries["file"] != nil
+		s.Cache.mu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	second := make(chan []byte, 1)
+	go func() {
+		data, _ := serveCached(h, &Request{Filename: "file"})
+		second <- data
+	}()
+	// Let the second request wait for the load, then give a load tied to
+	// the cancelled request time to fail.
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	if data := <-second; string(data) != "content" {
+		t.Errorf("Waiting request got %q", data)
+	}
+	<-first
+	s.Cache.mu.Lock()
+	defer s.Cache.mu.Unlock()
+	if entry := s.Cache.entries["file"]; entry == nil || string(entry.data) != "content" {
+		t.Error("Cancelling the first request failed the load")
+	}
+}
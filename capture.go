@@ -0,0 +1,183 @@
+package tftp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// pcapLinkTypeRaw is the pcap link type of packets starting with an IPv4 or
+// IPv6 header, without a link layer.
+const pcapLinkTypeRaw = 101
+
+// pcapWriter writes datagrams to a pcap capture, wrapped in synthesized IP
+// and UDP headers so tools like Wireshark decode them as TFTP. Writing
+// stops at the first error, so a failing capture never affects the
+// transfer.
+type pcapWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+	e  error
+}
+
+func newPcapWriter(w io.Writer) *pcapWriter {
+	p := &pcapWriter{w: w}
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2) // Version 2.4
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 0xffff) // Snapshot length
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkTypeRaw)
+	_, p.e = w.Write(header)
+	return p
+}
+
+// packet records payload sent from src to dst at t.
+func (p *pcapWriter) packet(t time.Time, src, dst *net.UDPAddr, payload []byte) {
+	packet := ipPacket(src, dst, payload)
+	record := make([]byte, 16, 16+len(packet))
+	binary.LittleEndian.PutUint32(record[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	record = append(record, packet...)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.e == nil {
+		_, p.e = p.w.Write(record)
+	}
+}
+
+// ipPacket wraps payload in UDP and IP headers from src to dst. The family
+// follows dst or src, whichever is not a wildcard, and the address of the
+// other end is converted to it.
+func ipPacket(src, dst *net.UDPAddr, payload []byte) []byte {
+	srcIP, dstIP := src.IP, dst.IP
+	v4 := srcIP.To4() != nil && !srcIP.IsUnspecified() || dstIP.To4() != nil && !dstIP.IsUnspecified()
+	udp := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	udp = append(udp, payload...)
+	if v4 {
+		header := make([]byte, 20)
+		header[0] = 0x45
+		binary.BigEndian.PutUint16(header[2:], uint16(20+len(udp)))
+		header[8] = 64 // TTL
+		header[9] = 17 // UDP
+		copy(header[12:], ipv4Of(srcIP))
+		copy(header[16:], ipv4Of(dstIP))
+		binary.BigEndian.PutUint16(header[10:], ^checksum(0, header))
+		// The UDP checksum is optional over IPv4 and left zero.
+		return append(header, udp...)
+	}
+	header := make([]byte, 40)
+	header[0] = 0x60
+	binary.BigEndian.PutUint16(header[4:], uint16(len(udp)))
+	header[6] = 17 // UDP
+	header[7] = 64 // Hop limit
+	copy(header[8:], ipv6Of(srcIP))
+	copy(header[24:], ipv6Of(dstIP))
+	// The UDP checksum is mandatory over IPv6 and covers a pseudo-header
+	// of the addresses, the length and the protocol.
+	sum := checksum(0, header[8:40])
+	sum = checksum(sum, []byte{0, 0, header[4], header[5], 0, 0, 0, 17})
+	sum = ^checksum(sum, udp)
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], sum)
+	return append(header, udp...)
+}
+
+func ipv4Of(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return net.IPv4zero.To4()
+}
+
+func ipv6Of(ip net.IP) net.IP {
+	if ip.To4() != nil {
+		return net.IPv6unspecified
+	}
+	return ip.To16()
+}
+
+// checksum adds b to the ones' complement sum sum as used by IP and UDP.
+func checksum(sum uint16, b []byte) uint16 {
+	s := uint32(sum)
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return uint16(s)
+}
+
+// captureConn wraps the socket of a transfer and records the datagrams read
+// and written.
+type captureConn struct {
+	packetConn
+	local *net.UDPAddr
+	pcap  *pcapWriter
+}
+
+func (c *captureConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	n, addr, e := c.packetConn.ReadFromUDP(b)
+	if e == nil {
+		c.pcap.packet(time.Now(), addr, c.local, b[:n])
+	}
+	return n, addr, e
+}
+
+func (c *captureConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	n, e := c.packetConn.WriteToUDP(b, addr)
+	if e == nil {
+		c.pcap.packet(time.Now(), c.local, addr, b)
+	}
+	return n, e
+}
+
+// capture returns conn, the socket of transfer t bound to local, wrapped to
+// be recorded if CaptureFunc asks for it. The capture starts with request,
+// which arrived at the listening socket listenAddr, so tools following the
+// TFTP conversation from the request pick up the transfer port.
+func (s *Server) capture(t *transfer, conn packetConn, local, listenAddr *net.UDPAddr, request []byte) packetConn {
+	if s.CaptureFunc == nil {
+		return conn
+	}
+	w := s.CaptureFunc(t.TransferInfo)
+	if w == nil {
+		return conn
+	}
+	if c, ok := w.(io.Closer); ok {
+		t.capture = c
+	}
+	pcap := newPcapWriter(w)
+	pcap.packet(t.Started, t.RemoteAddr, listenAddr, request)
+	return &captureConn{conn, local, pcap}
+}
+
+// CaptureDir returns a Server.CaptureFunc writing the capture of every
+// transfer to its own file in dir, named after the start time and ID of
+// the transfer. Transfers whose file cannot be created are not captured.
+func CaptureDir(dir string) func(info TransferInfo) io.Writer {
+	return func(info TransferInfo) io.Writer {
+		name := fmt.Sprintf("%s-%d.pcap", info.Started.Format("20060102-150405"), info.ID)
+		f, e := os.Create(filepath.Join(dir, name))
+		if e != nil {
+			return nil
+		}
+		return f
+	}
+}
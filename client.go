@@ -1,11 +1,14 @@
 package tftp
 
 import (
-	"fmt"
+	"bufio"
+	"compress/gzip"
 	"io"
-	"log"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 /*
@@ -24,7 +27,7 @@ Uploading file to server example
 	}
 	r := bufio.NewReader(file)
 	log := log.New(os.Stderr, "", log.Ldate | log.Ltime)
-	c := tftp.Client{addr, log}
+	c := tftp.Client{RemoteAddr: addr, Log: log}
 	c.Put(filename, mode, func(writer *io.PipeWriter) {
 		n, writeError := r.WriteTo(writer)
 		if writeError != nil {
@@ -47,7 +50,7 @@ Downloading file from server example
 	}
 	w := bufio.NewWriter(file)
 	log := log.New(os.Stderr, "", log.Ldate | log.Ltime)
-	c := tftp.Client{addr, log}
+	c := tftp.Client{RemoteAddr: addr, Log: log}
 	c.Get(filename, mode, func(reader *io.PipeReader) {
 		n, readError := w.ReadFrom(reader)
 		if readError != nil {
@@ -58,14 +61,75 @@ Downloading file from server example
 		w.Flush()
 		file.Close()
 	})
+
+Download and Upload do the same in octet mode for a file copied to an
+io.Writer or from an io.Reader
+
+	file, e := os.Create("/var/tmp/debian.img")
+	if e != nil {
+		...
+	}
+	defer file.Close()
+	c := tftp.Client{RemoteAddr: addr}
+	n, e := c.Download(filename, file)
+	if e != nil {
+		fmt.Fprintf(os.Stderr, "Can't get %s: %v\n", filename, e);
+	}
 */
 type Client struct {
 	RemoteAddr *net.UDPAddr
-	Log        *log.Logger
+	Log        Logger
+	// LogLevel is the least severe level written to Log, see
+	// Server.LogLevel.
+	LogLevel LogLevel
+
+	// BlockWrapTo is the block number following block 65535, see
+	// Server.BlockWrapTo.
+	BlockWrapTo uint16
+
+	// WindowSize, if above one, is requested with the windowsize option
+	// (RFC 7440), up to MAX_WINDOW_SIZE. The server may accept a smaller
+	// window, or ignore the option, in which case the transfer is
+	// lockstep.
+	WindowSize int
+
+	// BlockSize, if set, is requested with the blksize option (RFC 2348),
+	// clamped to MIN_BLOCK_SIZE..MAX_BLOCK_SIZE; SafeBlockSize gives the
+	// largest that is not fragmented. The server may accept a smaller
+	// size, or ignore the option, in which case blocks are BLOCK_SIZE.
+	BlockSize int
+
+	// Timeout, if positive, is the interval after which the client
+	// retransmits, rounded to whole seconds from 1 to 255. It is requested
+	// with the timeout option (RFC 2349) so the server uses it as well.
+	Timeout time.Duration
+
+	// TransferSize requests the tsize option (RFC 2349). Get asks for the
+	// size of the file, which OnTransferSize receives if the server tells
+	// it. Upload announces the size of a reader with a Len method, such as
+	// a *bytes.Reader, or of an io.Seeker, so the server can refuse a file
+	// too large up front; Put does not know the size and leaves it out.
+	TransferSize bool
+	// OnTransferSize, if set, is called with the size of a download the
+	// server reported, before any data arrives.
+	OnTransferSize func(size int64)
+
+	// Compress requests the x-compress=gzip vendor option on downloads,
+	// see Server.AllowCompression. If the server accepts it, the data
+	// arrives gzipped and is decompressed before the handler reads it, so
+	// the handler sees the file either way.
+	Compress bool
 }
 
-// Method for uploading file to server
+// Method for uploading file to server. It returns once the server
+// acknowledged the last block and the handler returned, with the error the
+// transfer failed with, if any.
 func (c Client) Put(filename string, mode string, handler func(w *io.PipeWriter)) error {
+	return c.put(filename, mode, -1, handler)
+}
+
+// put is Put announcing size with tsize, unless it is negative.
+func (c Client) put(filename string, mode string, size int64, handler func(w *io.PipeWriter)) error {
 	addr, e := net.ResolveUDPAddr("udp", ":0")
 	if e != nil {
 		return e
@@ -74,20 +138,33 @@ func (c Client) Put(filename string, mode string, handler func(w *io.PipeWriter)
 	if e != nil {
 		return e
 	}
+	defer conn.Close()
 	reader, writer := io.Pipe()
-	s := &sender{c.RemoteAddr, conn, reader, filename, mode, c.Log}
+	s := &sender{
+		remoteAddr: c.RemoteAddr,
+		conn:       conn,
+		reader:     reader,
+		filename:   filename,
+		mode:       mode,
+		log:        c.transferLog(OP_WRQ, filename),
+		wrapTo:     c.BlockWrapTo,
+		requested:  c.options(size),
+		timeout:    c.timeout(),
+	}
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		handler(writer)
 		wg.Done()
 	}()
-	s.Run(false)
+	e = s.Run(false)
 	wg.Wait()
-	return nil
+	return e
 }
 
-// Method for downloading file from server
+// Method for downloading file from server. It returns once the last block
+// was received and the handler returned, with the error the transfer
+// failed with, if any.
 func (c Client) Get(filename string, mode string, handler func(r *io.PipeReader)) error {
 	addr, e := net.ResolveUDPAddr("udp", ":0")
 	if e != nil {
@@ -97,15 +174,183 @@ func (c Client) Get(filename string, mode string, handler func(r *io.PipeReader)
 	if e != nil {
 		return e
 	}
+	defer conn.Close()
 	reader, writer := io.Pipe()
-	r := &receiver{c.RemoteAddr, conn, writer, filename, mode, c.Log}
+	requested := c.options(0)
+	// The receiver writes to the handler's pipe, or with compression to a
+	// pipe of its own, which is copied over, decompressed if the server
+	// accepted that.
+	received := writer
+	var compressed atomic.Bool
+	var decompressed chan error
+	if c.Compress {
+		if requested == nil {
+			requested = make(map[string]string)
+		}
+		requested[optionCompress] = compressGzip
+		var compressedReader *io.PipeReader
+		compressedReader, received = io.Pipe()
+		decompressed = make(chan error, 1)
+		go func() {
+			decompressed <- decompress(writer, compressedReader, &compressed)
+		}()
+	}
+	r := &receiver{
+		remoteAddr:     c.RemoteAddr,
+		conn:           conn,
+		writer:         received,
+		filename:       filename,
+		mode:           mode,
+		log:            c.transferLog(OP_RRQ, filename),
+		wrapTo:         c.BlockWrapTo,
+		requested:      requested,
+		timeout:        c.timeout(),
+		onTransferSize: c.OnTransferSize,
+		onCompress:     func() { compressed.Store(true) },
+	}
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		handler(reader)
 		wg.Done()
 	}()
-	r.Run(false)
+	e = r.Run(false)
+	if decompressed != nil {
+		if decompressError := <-decompressed; e == nil {
+			e = decompressError
+		}
+	}
 	wg.Wait()
-	return fmt.Errorf("Send timeout")
+	return e
+}
+
+// Download reads filename from the server in octet mode and writes it to
+// w, returning the number of bytes written. An error writing to w aborts
+// the transfer with an ERROR packet to the server.
+func (c Client) Download(filename string, w io.Writer) (int64, error) {
+	var n int64
+	var copyError error
+	e := c.Get(filename, "octet", func(r *io.PipeReader) {
+		n, copyError = io.Copy(w, r)
+		r.CloseWithError(copyError)
+	})
+	if e != nil {
+		return n, e
+	}
+	return n, copyError
+}
+
+// Upload writes the data read from r to filename on the server in octet
+// mode, returning the number of bytes read. An error reading from r aborts
+// the transfer with an ERROR packet to the server.
+func (c Client) Upload(filename string, r io.Reader) (int64, error) {
+	var n int64
+	e := c.put(filename, "octet", readerSize(r), func(w *io.PipeWriter) {
+		var copyError error
+		n, copyError = io.Copy(w, r)
+		w.CloseWithError(copyError)
+	})
+	return n, e
+}
+
+// decompress copies the data received from r to w, gunzipped if compressed
+// is set once data arrives, which the OACK precedes. It returns the error
+// the copy ended with, which both pipes are closed with, so that neither
+// the handler nor the receiver is left waiting.
+func decompress(w *io.PipeWriter, r *io.PipeReader, compressed *atomic.Bool) error {
+	buffered := bufio.NewReader(r)
+	var data io.Reader = buffered
+	_, e := buffered.Peek(1)
+	if e == nil && compressed.Load() {
+		var z *gzip.Reader
+		if z, e = gzip.NewReader(buffered); e == nil {
+			data = z
+		}
+	}
+	if e == nil || e == io.EOF {
+		_, e = io.Copy(w, data)
+	}
+	r.CloseWithError(e)
+	w.CloseWithError(e)
+	return e
+}
+
+// readerSize returns the number of bytes left in r, or -1 if unknown.
+func readerSize(r io.Reader) int64 {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len())
+	case io.Seeker:
+		current, e := r.Seek(0, io.SeekCurrent)
+		if e != nil {
+			return -1
+		}
+		end, e := r.Seek(0, io.SeekEnd)
+		if e != nil {
+			return -1
+		}
+		if _, e = r.Seek(current, io.SeekStart); e != nil {
+			return -1
+		}
+		return end - current
+	}
+	return -1
+}
+
+// options returns the options requested, nil for none. size is the tsize
+// requested with TransferSize, left out if negative.
+func (c Client) options(size int64) map[string]string {
+	var options map[string]string
+	request := func(name string, value int) {
+		if options == nil {
+			options = make(map[string]string)
+		}
+		options[name] = strconv.Itoa(value)
+	}
+	if size := c.BlockSize; size != 0 && size != BLOCK_SIZE {
+		if size < MIN_BLOCK_SIZE {
+			size = MIN_BLOCK_SIZE
+		} else if size > MAX_BLOCK_SIZE {
+			size = MAX_BLOCK_SIZE
+		}
+		request(optionBlockSize, size)
+	}
+	if d := c.timeout(); d > 0 {
+		request(optionTimeout, int(d/time.Second))
+	}
+	if size := c.WindowSize; size > 1 {
+		if size > MAX_WINDOW_SIZE {
+			size = MAX_WINDOW_SIZE
+		}
+		request(optionWindowSize, size)
+	}
+	if c.TransferSize && size >= 0 {
+		if options == nil {
+			options = make(map[string]string)
+		}
+		options[optionTransferSize] = strconv.FormatInt(size, 10)
+	}
+	return options
+}
+
+// timeout returns the retransmission interval of Timeout in whole
+// seconds, zero for the default.
+func (c Client) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return 0
+	}
+	d := c.Timeout.Round(time.Second)
+	if d < time.Second {
+		d = time.Second
+	} else if d > MAX_TIMEOUT {
+		d = MAX_TIMEOUT
+	}
+	return d
+}
+
+func (c Client) transferLog(op uint16, filename string) *transferLog {
+	return newTransferLog(c.Log, c.LogLevel,
+		Field{"peer", c.RemoteAddr},
+		Field{"filename", filename},
+		Field{"op", opName(op)})
 }
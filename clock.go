@@ -0,0 +1,126 @@
+package tftp
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// clock is the source of time of the transfer loops: retransmission and
+// idle timeouts, throughput windows, pacing, dallying and handler
+// timeouts all read it instead of the time package, so they can run on a
+// fakeClock. Production code uses realClock.
+type clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) clockTimer
+}
+
+// clockTimer is the part of *time.Timer the transfer loops use.
+type clockTimer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// realClock is the clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) clockTimer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.t.C }
+
+func (t realTimer) Stop() bool { return t.t.Stop() }
+
+// orRealClock returns c, or realClock if c is nil.
+func orRealClock(c clock) clock {
+	if c == nil {
+		return realClock{}
+	}
+	return c
+}
+
+// fakeClock is a clock that only moves when told to, for driving the
+// timeouts of sender and receiver deterministically together with memConn
+// sockets reading it. Timers fire from Advance, in the order of their
+// deadlines.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) clockTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{c: c, ch: make(chan time.Time, 1), when: c.now.Add(d)}
+	if d <= 0 {
+		t.ch <- c.now
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, firing the timers due by then.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	sort.Slice(c.timers, func(i, j int) bool {
+		return c.timers[i].when.Before(c.timers[j].when)
+	})
+	var pending []*fakeTimer
+	for _, t := range c.timers {
+		if t.when.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.ch <- c.now
+	}
+	c.timers = pending
+}
+
+// Timers returns the number of timers waiting to fire, so a test can
+// advance the clock once the code under test is blocked on one.
+func (c *fakeClock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+type fakeTimer struct {
+	c    *fakeClock
+	ch   chan time.Time
+	when time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.ch }
+
+func (t *fakeTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	for i, pending := range t.c.timers {
+		if pending == t {
+			t.c.timers = append(t.c.timers[:i], t.c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package tftp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(0, 0)
+	c := newFakeClock(start)
+	late := c.NewTimer(2 * time.Second)
+	early := c.NewTimer(time.Second)
+	stopped := c.NewTimer(time.Second)
+	if !stopped.Stop() {
+		t.Error("Stop of a pending timer returned false")
+	}
+	if n := c.Timers(); n != 2 {
+		t.Errorf("%d timers pending, want 2", n)
+	}
+	c.Advance(1500 * time.Millisecond)
+	select {
+	case now := <-early.C():
+		if now != start.Add(1500*time.Millisecond) {
+			t.Errorf("Fired at %v", now)
+		}
+	default:
+		t.Error("Timer due did not fire")
+	}
+	select {
+	case <-late.C():
+		t.Error("Timer fired early")
+	case <-stopped.C():
+		t.Error("Stopped timer fired")
+	default:
+	}
+	c.Advance(time.Second)
+	select {
+	case <-late.C():
+	default:
+		t.Error("Timer due did not fire")
+	}
+	if late.Stop() || c.Timers() != 0 {
+		t.Error("Fired timer still pending")
+	}
+	select {
+	case <-c.NewTimer(0).C():
+	default:
+		t.Error("Timer of no duration did not fire at once")
+	}
+}
@@ -0,0 +1,243 @@
+package tftp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// packetConn is the part of *net.UDPConn the transfer loops use. Keeping
+// sender and receiver on this interface separates the protocol logic from
+// the network; production code passes the *net.UDPConn itself.
+type packetConn interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	SetReadDeadline(t time.Time) error
+}
+
+// memPacket is a datagram passing through a memConn.
+type memPacket struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+// memConn is an in-memory packetConn for driving sender and receiver
+// deterministically. Datagrams queued with deliver are read in order, every
+// write is recorded, and onWrite, if set, may react to a write by
+// delivering the peer's response. Deadlines are read off clock, the real
+// one if nil, so a fakeClock shared with the transfer times reads out too.
+type memConn struct {
+	localAddr *net.UDPAddr
+	incoming  chan memPacket
+	wake      chan struct{}
+	onWrite   func(c *memConn, data []byte, addr *net.UDPAddr)
+	clock     clock
+
+	mu       sync.Mutex
+	sent     []memPacket
+	deadline time.Time
+}
+
+func newMemConn(localAddr *net.UDPAddr) *memConn {
+	return &memConn{
+		localAddr: localAddr,
+		incoming:  make(chan memPacket, 64),
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// deliver queues a datagram from addr for reading.
+func (c *memConn) deliver(data []byte, addr *net.UDPAddr) {
+	b := make([]byte, len(data))
+	copy(b, data)
+	c.incoming <- memPacket{b, addr}
+}
+
+// written returns the datagrams written so far.
+func (c *memConn) written() []memPacket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]memPacket(nil), c.sent...)
+}
+
+func (c *memConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		c.mu.Lock()
+		deadline := c.deadline
+		c.mu.Unlock()
+		var timer clockTimer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			clock := orRealClock(c.clock)
+			d := deadline.Sub(clock.Now())
+			if d <= 0 {
+				return 0, nil, memTimeout{}
+			}
+			timer = clock.NewTimer(d)
+			timeout = timer.C()
+		}
+		select {
+		case p := <-c.incoming:
+			stopTimer(timer)
+			return copy(b, p.data), p.addr, nil
+		case <-timeout:
+			return 0, nil, memTimeout{}
+		case <-c.wake:
+			stopTimer(timer)
+		}
+	}
+}
+
+func (c *memConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	data := make([]byte, len(b))
+	copy(data, b)
+	c.mu.Lock()
+	c.sent = append(c.sent, memPacket{data, addr})
+	c.mu.Unlock()
+	if c.onWrite != nil {
+		c.onWrite(c, data, addr)
+	}
+	return len(b), nil
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// dropConn wraps a packetConn and silently discards the writes drop
+// selects, to simulate packet loss on either a memConn or a real socket.
+// Reads are passed through.
+type dropConn struct {
+	packetConn
+	drop func(data []byte, addr *net.UDPAddr) bool
+}
+
+func (c *dropConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if c.drop(b, addr) {
+		return len(b), nil
+	}
+	return c.packetConn.WriteToUDP(b, addr)
+}
+
+// dropPacket returns a dropConn filter discarding the first count packets
+// with opcode op and block number block, e.g. the ACK of block 2. The block
+// number is ignored for packets without one.
+func dropPacket(op, block uint16, count int) func(data []byte, addr *net.UDPAddr) bool {
+	var mu sync.Mutex
+	return func(data []byte, addr *net.UDPAddr) bool {
+		p, e := Parse(data)
+		if e != nil || Opcode(p) != op {
+			return false
+		}
+		switch p := p.(type) {
+		case *DATA:
+			if p.BlockNumber != block {
+				return false
+			}
+		case *ACK:
+			if p.BlockNumber != block {
+				return false
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if count == 0 {
+			return false
+		}
+		count--
+		return true
+	}
+}
+
+// earlyConn wraps the socket of an upload so that packets the client sent
+// to the listening socket before it learned the transfer ID, i.e. DATA
+// block 1 sent right behind the WRQ, reach the receiver. Datagrams passed
+// to deliver are read before those of the socket.
+type earlyConn struct {
+	packetConn
+	early chan memPacket
+
+	mu       sync.Mutex
+	deadline time.Time
+	// woken is set while the socket deadline is the one deliver forced
+	// rather than the reader's.
+	woken bool
+}
+
+func newEarlyConn(conn packetConn) *earlyConn {
+	return &earlyConn{packetConn: conn, early: make(chan memPacket, 1)}
+}
+
+// deliver queues a datagram from addr for reading and wakes a read blocked
+// on the socket. It is dropped if one is queued already.
+func (c *earlyConn) deliver(data []byte, addr *net.UDPAddr) {
+	b := make([]byte, len(data))
+	copy(b, data)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case c.early <- memPacket{b, addr}:
+	default:
+		return
+	}
+	c.woken = true
+	c.packetConn.SetReadDeadline(time.Now())
+}
+
+func (c *earlyConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		select {
+		case p := <-c.early:
+			// The datagram may be read before deliver wakes the socket,
+			// which must not time out the next read.
+			c.rearm()
+			return copy(b, p.data), p.addr, nil
+		default:
+		}
+		n, addr, e := c.packetConn.ReadFromUDP(b)
+		if networkError, ok := e.(net.Error); ok && networkError.Timeout() && c.rearm() {
+			continue
+		}
+		return n, addr, e
+	}
+}
+
+// rearm restores the deadline of the reader if deliver forced another,
+// and reports whether it did.
+func (c *earlyConn) rearm() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.woken {
+		return false
+	}
+	c.woken = false
+	c.packetConn.SetReadDeadline(c.deadline)
+	return true
+}
+
+func (c *earlyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.packetConn.SetReadDeadline(t)
+}
+
+func stopTimer(timer clockTimer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+// memTimeout is the net.Error returned by memConn when the deadline passes.
+type memTimeout struct{}
+
+func (memTimeout) Error() string   { return "i/o timeout" }
+func (memTimeout) Timeout() bool   { return true }
+func (memTimeout) Temporary() bool { return true }
@@ -0,0 +1,685 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	testLocalAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+	testPeerAddr  = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50001}
+	testStrayAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50002}
+)
+
+// ackData is a memConn onWrite acknowledging every DATA block, as a
+// downloading peer does.
+func ackData(c *memConn, data []byte, addr *net.UDPAddr) {
+	if p, e := Parse(data); e == nil {
+		if d, ok := p.(*DATA); ok {
+			c.deliver((&ACK{BlockNumber: d.BlockNumber}).Pack(), addr)
+		}
+	}
+}
+
+// sendBlocks returns a memConn onWrite answering the ACK of each block of
+// content with the next one, as an uploading peer does.
+func sendBlocks(content []byte, blockSize int) func(c *memConn, data []byte, addr *net.UDPAddr) {
+	return func(c *memConn, data []byte, addr *net.UDPAddr) {
+		p, e := Parse(data)
+		ack, ok := p.(*ACK)
+		if e != nil || !ok || int(ack.BlockNumber)*blockSize > len(content) {
+			return
+		}
+		start := int(ack.BlockNumber) * blockSize
+		end := start + blockSize
+		if end > len(content) {
+			end = len(content)
+		}
+		c.deliver((&DATA{BlockNumber: ack.BlockNumber + 1, Data: content[start:end]}).Pack(), addr)
+	}
+}
+
+// newTestSender returns a sender serving content to testPeerAddr over conn.
+func newTestSender(conn packetConn, clock clock, content []byte) *sender {
+	r, w := io.Pipe()
+	go func() {
+		w.Write(content)
+		w.Close()
+	}()
+	return &sender{remoteAddr: testPeerAddr, conn: conn, reader: r, filename: "file", mode: "octet", clock: clock}
+}
+
+// newTestReceiver returns a receiver taking a file from testPeerAddr over
+// conn, and the channel the file arrives on.
+func newTestReceiver(conn packetConn, clock clock) (*receiver, <-chan []byte) {
+	r, w := io.Pipe()
+	received := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(r)
+		received <- data
+	}()
+	return &receiver{remoteAddr: testPeerAddr, conn: conn, writer: w, filename: "file", mode: "octet", clock: clock}, received
+}
+
+// advanceToNext moves c to the deadline of its earliest timer, if any.
+func (c *fakeClock) advanceToNext() {
+	c.mu.Lock()
+	var next time.Time
+	for _, t := range c.timers {
+		if next.IsZero() || t.when.Before(next) {
+			next = t.when
+		}
+	}
+	now := c.now
+	c.mu.Unlock()
+	if !next.IsZero() {
+		c.Advance(next.Sub(now))
+	}
+}
+
+// runTransfer runs a transfer loop to its end. While it is blocked on a
+// timer of clock with nothing queued on conn, which the peer scripted by
+// onWrite answers synchronously, clock is advanced to that timer.
+func runTransfer(t *testing.T, clock *fakeClock, conn *memConn, run func() error) error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- run() }()
+	limit := time.Now().Add(10 * time.Second)
+	for {
+		select {
+		case e := <-done:
+			return e
+		case <-time.After(time.Millisecond):
+		}
+		if time.Now().After(limit) {
+			t.Fatal("Transfer did not end")
+		}
+		if clock != nil && len(conn.incoming) == 0 {
+			clock.advanceToNext()
+		}
+	}
+}
+
+// dataBlocks returns the numbers of the DATA packets written to conn.
+func dataBlocks(conn *memConn) []uint16 {
+	var blocks []uint16
+	for _, w := range conn.written() {
+		if p, e := Parse(w.data); e == nil {
+			if d, ok := p.(*DATA); ok {
+				blocks = append(blocks, d.BlockNumber)
+			}
+		}
+	}
+	return blocks
+}
+
+// errorsTo returns the codes of the ERROR packets written to addr.
+func errorsTo(conn *memConn, addr *net.UDPAddr) []uint16 {
+	var codes []uint16
+	for _, w := range conn.written() {
+		if p, e := Parse(w.data); e == nil && w.addr.String() == addr.String() {
+			if p, ok := p.(*ERROR); ok {
+				codes = append(codes, p.ErrorCode)
+			}
+		}
+	}
+	return codes
+}
+
+func equalBlocks(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSenderOverMemConn(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	conn.clock, conn.onWrite = clock, ackData
+	s := newTestSender(conn, clock, bytes.Repeat([]byte("x"), 1500))
+	if e := runTransfer(t, clock, conn, func() error { return s.Run(true) }); e != nil {
+		t.Fatal(e)
+	}
+	if blocks := dataBlocks(conn); !equalBlocks(blocks, []uint16{1, 2, 3}) {
+		t.Errorf("Sent blocks %v", blocks)
+	}
+	if s.bytes != 1500 {
+		t.Errorf("Sent %d bytes", s.bytes)
+	}
+}
+
+func TestReceiverOverMemConn(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 103)
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	conn.clock, conn.onWrite = clock, sendBlocks(content, BLOCK_SIZE)
+	r, received := newTestReceiver(conn, clock)
+	if e := runTransfer(t, clock, conn, func() error { return r.Run(true) }); e != nil {
+		t.Fatal(e)
+	}
+	if data := <-received; !bytes.Equal(data, content) {
+		t.Errorf("Received %d bytes, want %d", len(data), len(content))
+	}
+}
+
+func TestSenderRetransmitsOnTimeout(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	conn.clock = clock
+	ignored := false
+	conn.onWrite = func(c *memConn, data []byte, addr *net.UDPAddr) {
+		if p, _ := Parse(data); !ignored && Opcode(p) == OP_DATA {
+			ignored = true
+			return
+		}
+		ackData(c, data, addr)
+	}
+	s := newTestSender(conn, clock, []byte("short"))
+	start := clock.Now()
+	if e := runTransfer(t, clock, conn, func() error { return s.Run(true) }); e != nil {
+		t.Fatal(e)
+	}
+	if blocks := dataBlocks(conn); !equalBlocks(blocks, []uint16{1, 1}) {
+		t.Errorf("Sent blocks %v", blocks)
+	}
+	if waited := clock.Now().Sub(start); waited != 3*time.Second {
+		t.Errorf("Retransmitted after %v", waited)
+	}
+}
+
+func TestSenderRejectsUnknownTID(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	conn.clock = clock
+	conn.onWrite = func(c *memConn, data []byte, addr *net.UDPAddr) {
+		if p, _ := Parse(data); Opcode(p) == OP_DATA {
+			// A stray ACK of the block, arriving ahead of the real one.
+			c.deliver((&ACK{BlockNumber: p.(*DATA).BlockNumber}).Pack(), testStrayAddr)
+		}
+		ackData(c, data, addr)
+	}
+	s := newTestSender(conn, clock, bytes.Repeat([]byte("x"), 600))
+	if e := runTransfer(t, clock, conn, func() error { return s.Run(true) }); e != nil {
+		t.Fatal(e)
+	}
+	if codes := errorsTo(conn, testStrayAddr); !equalBlocks(codes, []uint16{ERR_UNKNOWN_TID, ERR_UNKNOWN_TID}) {
+		t.Errorf("ERROR codes to the stray peer %v", codes)
+	}
+	if codes := errorsTo(conn, testPeerAddr); len(codes) != 0 {
+		t.Errorf("ERROR codes to the peer %v", codes)
+	}
+	if blocks := dataBlocks(conn); !equalBlocks(blocks, []uint16{1, 2}) {
+		t.Errorf("Sent blocks %v", blocks)
+	}
+}
+
+func TestReceiverRejectsUnknownTID(t *testing.T) {
+	content := []byte("content")
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	conn.clock = clock
+	peer := sendBlocks(content, BLOCK_SIZE)
+	conn.onWrite = func(c *memConn, data []byte, addr *net.UDPAddr) {
+		if addr.String() == testPeerAddr.String() {
+			c.deliver((&DATA{BlockNumber: 1, Data: []byte("injected")}).Pack(), testStrayAddr)
+		}
+		peer(c, data, addr)
+	}
+	r, received := newTestReceiver(conn, clock)
+	if e := runTransfer(t, clock, conn, func() error { return r.Run(true) }); e != nil {
+		t.Fatal(e)
+	}
+	if data := <-received; !bytes.Equal(data, content) {
+		t.Errorf("Received %q", data)
+	}
+	if codes := errorsTo(conn, testStrayAddr); len(codes) == 0 || codes[0] != ERR_UNKNOWN_TID {
+		t.Errorf("ERROR codes to the stray peer %v", codes)
+	}
+}
+
+func TestSenderAdoptsPeerPort(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	conn.clock = clock
+	conn.onWrite = func(c *memConn, data []byte, addr *net.UDPAddr) {
+		if p, _ := Parse(data); Opcode(p) == OP_DATA {
+			// A NAT rewrites the peer's port from the ACK of block 2 on.
+			from := addr
+			if p.(*DATA).BlockNumber >= 2 {
+				from = testStrayAddr
+			}
+			c.deliver((&ACK{BlockNumber: p.(*DATA).BlockNumber}).Pack(), from)
+		}
+	}
+	s := newTestSender(conn, clock, bytes.Repeat([]byte("x"), 2*BLOCK_SIZE+10))
+	s.adoptPort = true
+	if e := runTransfer(t, clock, conn, func() error { return s.Run(true) }); e != nil {
+		t.Fatal(e)
+	}
+	if codes := errorsTo(conn, testStrayAddr); len(codes) != 0 {
+		t.Errorf("ERROR codes to the new port %v", codes)
+	}
+	if blocks := dataBlocks(conn); !equalBlocks(blocks, []uint16{1, 2, 3}) {
+		t.Errorf("Sent blocks %v", blocks)
+	}
+	if last := conn.written()[len(conn.written())-1]; last.addr.String() != testStrayAddr.String() {
+		t.Errorf("Block 3 sent to %v", last.addr)
+	}
+}
+
+func TestReceiverAdoptsPeerPort(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), BLOCK_SIZE+10)
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	conn.clock = clock
+	conn.onWrite = func(c *memConn, data []byte, addr *net.UDPAddr) {
+		// Block 2 arrives from the port a NAT rewrote the peer's to.
+		if p, _ := Parse(data); Equal(p, &ACK{BlockNumber: 1}) {
+			c.deliver((&DATA{BlockNumber: 2, Data: content[BLOCK_SIZE:]}).Pack(), testStrayAddr)
+			return
+		}
+		sendBlocks(content, BLOCK_SIZE)(c, data, addr)
+	}
+	r, received := newTestReceiver(conn, clock)
+	r.adoptPort = true
+	if e := runTransfer(t, clock, conn, func() error { return r.Run(true) }); e != nil {
+		t.Fatal(e)
+	}
+	if data := <-received; !bytes.Equal(data, content) {
+		t.Errorf("Received %d bytes", len(data))
+	}
+	if codes := errorsTo(conn, testStrayAddr); len(codes) != 0 {
+		t.Errorf("ERROR codes to the new port %v", codes)
+	}
+	written := conn.written()
+	last := written[len(written)-1]
+	if p, _ := Parse(last.data); !Equal(p, &ACK{BlockNumber: 2}) || last.addr.String() != testStrayAddr.String() {
+		t.Errorf("Last reply %#v to %v", p, last.addr)
+	}
+}
+
+func TestSenderIgnoresDuplicateACK(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	conn.clock = clock
+	conn.onWrite = func(c *memConn, data []byte, addr *net.UDPAddr) {
+		ackData(c, data, addr)
+		// Every ACK arrives twice, which must not double the DATA sent
+		// (the Sorcerer's Apprentice syndrome).
+		ackData(c, data, addr)
+	}
+	s := newTestSender(conn, clock, bytes.Repeat([]byte("x"), 4*BLOCK_SIZE+10))
+	if e := runTransfer(t, clock, conn, func() error { return s.Run(true) }); e != nil {
+		t.Fatal(e)
+	}
+	if blocks := dataBlocks(conn); !equalBlocks(blocks, []uint16{1, 2, 3, 4, 5}) {
+		t.Errorf("Sent blocks %v", blocks)
+	}
+}
+
+// peerConn is the peer's end of a memConn: what it writes is delivered to
+// the memConn from testPeerAddr, so a dropConn around it loses replies.
+type peerConn struct {
+	packetConn
+	c *memConn
+}
+
+func TestSenderIgnoresUnexpectedPackets(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	conn.clock = clock
+	conn.onWrite = func(c *memConn, data []byte, addr *net.UDPAddr) {
+		// Ahead of every ACK the peer sends a DATA, a request and a
+		// malformed packet.
+		c.deliver((&DATA{BlockNumber: 1, Data: []byte("stray")}).Pack(), addr)
+		c.deliver((&RRQ{Filename: "file", Mode: "octet"}).Pack(), addr)
+		c.deliver([]byte{0, 42, 1}, addr)
+		ackData(c, data, addr)
+	}
+	s := newTestSender(conn, clock, bytes.Repeat([]byte("x"), 2*BLOCK_SIZE+10))
+	s.retransmits = new(atomic.Int64)
+	if e := runTransfer(t, clock, conn, func() error { return s.Run(true) }); e != nil {
+		t.Fatal(e)
+	}
+	if blocks := dataBlocks(conn); !equalBlocks(blocks, []uint16{1, 2, 3}) {
+		t.Errorf("Sent blocks %v", blocks)
+	}
+	if n := s.retransmits.Load(); n != 0 {
+		t.Errorf("%d retransmissions", n)
+	}
+	if codes := errorsTo(conn, testPeerAddr); len(codes) != 0 {
+		t.Errorf("ERROR codes to the peer %v", codes)
+	}
+}
+func (p peerConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	p.c.deliver(b, testPeerAddr)
+	return len(b), nil
+}
+
+// lossyAcks returns a memConn onWrite acknowledging every DATA block
+// through reply, a dropConn around a peerConn of conn.
+func lossyAcks(conn *memConn, drop func(data []byte, addr *net.UDPAddr) bool) func(c *memConn, data []byte, addr *net.UDPAddr) {
+	reply := &dropConn{packetConn: peerConn{c: conn}, drop: drop}
+	return func(c *memConn, data []byte, addr *net.UDPAddr) {
+		if p, e := Parse(data); e == nil {
+			if d, ok := p.(*DATA); ok {
+				reply.WriteToUDP((&ACK{BlockNumber: d.BlockNumber}).Pack(), addr)
+			}
+		}
+	}
+}
+
+func TestSenderDroppedDATA(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	conn.clock, conn.onWrite = clock, ackData
+	s := newTestSender(&dropConn{packetConn: conn, drop: dropPacket(OP_DATA, 2, 1)}, clock, bytes.Repeat([]byte("x"), 1500))
+	s.retransmits = new(atomic.Int64)
+	start := clock.Now()
+	if e := runTransfer(t, clock, conn, func() error { return s.Run(true) }); e != nil {
+		t.Fatal(e)
+	}
+	// The lost first copy of block 2 never reached the peer.
+	if blocks := dataBlocks(conn); !equalBlocks(blocks, []uint16{1, 2, 3}) {
+		t.Errorf("Delivered blocks %v", blocks)
+	}
+	if n := s.retransmits.Load(); n != 1 {
+		t.Errorf("%d retransmits", n)
+	}
+	if waited := clock.Now().Sub(start); waited != 3*time.Second {
+		t.Errorf("Retransmitted after %v", waited)
+	}
+}
+
+func TestSenderDroppedACK(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	conn.clock = clock
+	conn.onWrite = lossyAcks(conn, dropPacket(OP_ACK, 2, 1))
+	s := newTestSender(conn, clock, bytes.Repeat([]byte("x"), 1500))
+	if e := runTransfer(t, clock, conn, func() error { return s.Run(true) }); e != nil {
+		t.Fatal(e)
+	}
+	if blocks := dataBlocks(conn); !equalBlocks(blocks, []uint16{1, 2, 2, 3}) {
+		t.Errorf("Sent blocks %v", blocks)
+	}
+}
+
+func TestReceiverDroppedACK(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 1500)
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	conn.clock, conn.onWrite = clock, sendBlocks(content, BLOCK_SIZE)
+	r, received := newTestReceiver(&dropConn{packetConn: conn, drop: dropPacket(OP_ACK, 2, 1)}, clock)
+	start := clock.Now()
+	if e := runTransfer(t, clock, conn, func() error { return r.Run(true) }); e != nil {
+		t.Fatal(e)
+	}
+	if data := <-received; !bytes.Equal(data, content) {
+		t.Errorf("Received %d bytes", len(data))
+	}
+	if waited := clock.Now().Sub(start); waited != 5*time.Second {
+		t.Errorf("ACK #2 resent after %v", waited)
+	}
+}
+
+func TestSenderDroppedFinalACKDuringDally(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	conn.clock = clock
+	acks := lossyAcks(conn, dropPacket(OP_ACK, 2, 1))
+	conn.onWrite = func(c *memConn, data []byte, addr *net.UDPAddr) {
+		acks(c, data, addr)
+		if p, _ := Parse(data); Opcode(p) == OP_DATA && p.(*DATA).BlockNumber == 2 {
+			// A late duplicate of ACK #1, arriving while the sender dallies.
+			c.deliver((&ACK{BlockNumber: 1}).Pack(), testPeerAddr)
+		}
+	}
+	s := newTestSender(conn, clock, bytes.Repeat([]byte("x"), 600))
+	s.dallyTimeout, s.dallyResend = 2*time.Second, true
+	start := clock.Now()
+	if e := runTransfer(t, clock, conn, func() error { return s.Run(true) }); e != nil {
+		t.Fatal(e)
+	}
+	// Block 2 goes out, its ACK is lost, it is retransmitted on timeout and
+	// acknowledged, then sent once more for the duplicate ACK #1.
+	if blocks := dataBlocks(conn); !equalBlocks(blocks, []uint16{1, 2, 2, 2}) {
+		t.Errorf("Sent blocks %v", blocks)
+	}
+	if waited := clock.Now().Sub(start); waited != 5*time.Second {
+		t.Errorf("Transfer took %v, want the timeout and the dally", waited)
+	}
+}
+
+func TestSenderDuplicateFinalACKsDuringDally(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	conn.clock = clock
+	conn.onWrite = func(c *memConn, data []byte, addr *net.UDPAddr) {
+		ackData(c, data, addr)
+		if p, _ := Parse(data); Opcode(p) == OP_DATA && p.(*DATA).BlockNumber == 2 {
+			// The client repeats its final ACK while the sender dallies.
+			for i := 0; i < 3; i++ {
+				c.deliver((&ACK{BlockNumber: 2}).Pack(), testPeerAddr)
+			}
+		}
+	}
+	s := newTestSender(conn, clock, bytes.Repeat([]byte("x"), 600))
+	s.dallyTimeout, s.dallyResend = 2*time.Second, true
+	var total atomic.Int64
+	s.total = &total
+	start := clock.Now()
+	if e := runTransfer(t, clock, conn, func() error { return s.Run(true) }); e != nil {
+		t.Fatal(e)
+	}
+	// The duplicates neither draw DATA nor count the final block again.
+	if blocks := dataBlocks(conn); !equalBlocks(blocks, []uint16{1, 2}) {
+		t.Errorf("Sent blocks %v", blocks)
+	}
+	if n := total.Load(); n != 600 {
+		t.Errorf("Counted %d bytes", n)
+	}
+	if waited := clock.Now().Sub(start); waited != 2*time.Second {
+		t.Errorf("Transfer took %v, want the dally", waited)
+	}
+}
+
+// seekLog is a ReadSeeker recording the offsets it is read at.
+type seekLog struct {
+	*bytes.Reader
+	offsets []int64
+}
+
+func (r *seekLog) Seek(offset int64, whence int) (int64, error) {
+	n, e := r.Reader.Seek(offset, whence)
+	if whence == io.SeekStart {
+		r.offsets = append(r.offsets, n)
+	}
+	return n, e
+}
+
+// newContentSender returns a sender serving content, which claims size,
+// to testPeerAddr over conn.
+func newContentSender(conn packetConn, clock clock, content io.ReadSeeker, size int64) *sender {
+	r, _ := io.Pipe()
+	return &sender{remoteAddr: testPeerAddr, conn: conn, reader: r, filename: "file", mode: "octet", clock: clock,
+		openContent: func() (io.ReadSeeker, int64, error) {
+			return content, size, nil
+		}}
+}
+
+func TestSenderContentRetransmit(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	conn.clock = clock
+	conn.onWrite = lossyAcks(conn, dropPacket(OP_ACK, 2, 1))
+	content := make([]byte, 1500)
+	for i := range content {
+		content[i] = byte(i / BLOCK_SIZE)
+	}
+	r := &seekLog{Reader: bytes.NewReader(content)}
+	s := newContentSender(conn, clock, r, int64(len(content)))
+	if e := runTransfer(t, clock, conn, func() error { return s.Run(true) }); e != nil {
+		t.Fatal(e)
+	}
+	// The ACK of block 2 is lost, so the block goes out again, read from
+	// the content once more.
+	if blocks := dataBlocks(conn); !equalBlocks(blocks, []uint16{1, 2, 2, 3}) {
+		t.Errorf("Sent blocks %v", blocks)
+	}
+	if want := []int64{0, 512, 512, 1024}; !reflect.DeepEqual(r.offsets, want) {
+		t.Errorf("Read at %v, want %v", r.offsets, want)
+	}
+	for _, w := range conn.written() {
+		p, _ := Parse(w.data)
+		if d, ok := p.(*DATA); ok && !bytes.Equal(d.Data, content[int(d.BlockNumber-1)*BLOCK_SIZE:][:len(d.Data)]) {
+			t.Errorf("Block %d does not match the content", d.BlockNumber)
+		}
+	}
+}
+
+func TestSenderContentSizeMismatch(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		length int
+		blocks []uint16
+	}{
+		{"short", 600, []uint16{1}},
+		{"long", 1200, []uint16{1}},
+	} {
+		clock := newFakeClock(time.Unix(0, 0))
+		conn := newMemConn(testLocalAddr)
+		conn.clock, conn.onWrite = clock, ackData
+		s := newContentSender(conn, clock, bytes.NewReader(make([]byte, c.length)), 1000)
+		var contentError *handlerError
+		if e := runTransfer(t, clock, conn, func() error { return s.Run(true) }); !errors.As(e, &contentError) {
+			t.Errorf("%s: error %v", c.name, e)
+		}
+		if blocks := dataBlocks(conn); !equalBlocks(blocks, c.blocks) {
+			t.Errorf("%s: sent blocks %v", c.name, blocks)
+		}
+		if codes := errorsTo(conn, testPeerAddr); !equalBlocks(codes, []uint16{ERR_NOT_FOUND}) {
+			t.Errorf("%s: sent ERROR codes %v", c.name, codes)
+		}
+	}
+}
+
+// sendWindows returns a memConn onWrite answering the ACK of each block of
+// content with the window of blocks after it, as an uploading peer with a
+// windowsize does. The blocks drop reports lost never arrive.
+func sendWindows(content []byte, window int, drop func(n uint16) bool) func(c *memConn, data []byte, addr *net.UDPAddr) {
+	return func(c *memConn, data []byte, addr *net.UDPAddr) {
+		p, e := Parse(data)
+		ack, ok := p.(*ACK)
+		if e != nil || !ok {
+			return
+		}
+		for n := int(ack.BlockNumber) + 1; n <= int(ack.BlockNumber)+window && (n-1)*BLOCK_SIZE <= len(content); n++ {
+			end := n * BLOCK_SIZE
+			if end > len(content) {
+				end = len(content)
+			}
+			if !drop(uint16(n)) {
+				c.deliver((&DATA{BlockNumber: uint16(n), Data: content[(n-1)*BLOCK_SIZE : end]}).Pack(), addr)
+			}
+		}
+	}
+}
+
+// acksTo returns the numbers of the ACK packets written to conn.
+func acksTo(conn *memConn) []uint16 {
+	var blocks []uint16
+	for _, w := range conn.written() {
+		if p, e := Parse(w.data); e == nil {
+			if a, ok := p.(*ACK); ok {
+				blocks = append(blocks, a.BlockNumber)
+			}
+		}
+	}
+	return blocks
+}
+
+func TestReceiverWindow(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 500)
+	for _, c := range []struct {
+		name string
+		drop uint16
+		acks []uint16
+	}{
+		{"no loss", 0, []uint16{0, 4, 8, 10}},
+		// Block 3 is lost once: block 4 shows the gap, ACK #2 makes the
+		// peer resend from block 3 at once, without waiting for a timeout.
+		{"gap", 3, []uint16{0, 2, 6, 10}},
+	} {
+		clock := newFakeClock(time.Unix(0, 0))
+		conn := newMemConn(testLocalAddr)
+		dropped := false
+		conn.clock = clock
+		conn.onWrite = sendWindows(content, 4, func(n uint16) bool {
+			if n == c.drop && !dropped {
+				dropped = true
+				return true
+			}
+			return false
+		})
+		r, received := newTestReceiver(conn, clock)
+		r.windowSize = 4
+		start := clock.Now()
+		if e := runTransfer(t, clock, conn, func() error { return r.Run(true) }); e != nil {
+			t.Fatalf("%s: %v", c.name, e)
+		}
+		if data := <-received; !bytes.Equal(data, content) {
+			t.Errorf("%s: received %d bytes, want %d", c.name, len(data), len(content))
+		}
+		if acks := acksTo(conn); !equalBlocks(acks[:min(len(acks), len(c.acks))], c.acks) {
+			t.Errorf("%s: sent ACKs %v, want %v first", c.name, acks, c.acks)
+		}
+		if waited := clock.Now().Sub(start); waited != 0 {
+			t.Errorf("%s: waited %v for a timeout", c.name, waited)
+		}
+	}
+}
+
+func TestEarlyConnConcurrentDeliver(t *testing.T) {
+	socket, e := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer socket.Close()
+	conn := newEarlyConn(socket)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	const packets = 10000
+	go func() {
+		for i := 0; i < packets; i++ {
+			for len(conn.early) > 0 {
+				runtime.Gosched()
+			}
+			conn.deliver([]byte{byte(i)}, testPeerAddr)
+		}
+	}()
+	// Each datagram may be read before or after deliver wakes the socket;
+	// neither may make a later read time out.
+	b := make([]byte, 1)
+	for i := 0; i < packets; i++ {
+		n, addr, e := conn.ReadFromUDP(b)
+		if e != nil {
+			t.Fatalf("Read %d: %v", i, e)
+		}
+		if n != 1 || b[0] != byte(i) || addr != testPeerAddr {
+			t.Fatalf("Read %d: %v from %v", i, b[:n], addr)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package tftp
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Logger is what the server and client write their log to. *log.Logger
+// satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// LogLevel is the severity of a log line. Lines below the configured
+// level are discarded.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota // Every packet sent and received
+	LogInfo                  // Requests and transfer summaries
+	LogError                 // Failed requests and transfers
+)
+
+// Field is a key/value pair identifying the transfer a log line belongs
+// to: its ID, peer, filename and opcode.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// FieldLogger may be implemented by a Logger that wants transfer fields
+// passed separately from the message, e.g. to emit them as structured
+// key/value pairs. Other loggers get the fields prepended to the message.
+type FieldLogger interface {
+	Logger
+	Logf(fields []Field, format string, v ...interface{})
+}
+
+// transferLog writes the log lines of one request or transfer, attaching
+// its fields to each. A transferLog without a logger discards everything.
+type transferLog struct {
+	logger Logger
+	level  LogLevel
+	fields []Field
+}
+
+func newTransferLog(logger Logger, level LogLevel, fields ...Field) *transferLog {
+	return &transferLog{logger, level, fields}
+}
+
+// with returns a transferLog carrying additional fields.
+func (l *transferLog) with(fields ...Field) *transferLog {
+	all := make([]Field, 0, len(l.fields)+len(fields))
+	all = append(append(all, l.fields...), fields...)
+	return &transferLog{l.logger, l.level, all}
+}
+
+func (l *transferLog) Debugf(format string, v ...interface{}) {
+	l.logf(LogDebug, format, v...)
+}
+
+func (l *transferLog) Infof(format string, v ...interface{}) {
+	l.logf(LogInfo, format, v...)
+}
+
+func (l *transferLog) Errorf(format string, v ...interface{}) {
+	l.logf(LogError, format, v...)
+}
+
+func (l *transferLog) logf(level LogLevel, format string, v ...interface{}) {
+	if l == nil || l.logger == nil || level < l.level {
+		return
+	}
+	if fl, ok := l.logger.(FieldLogger); ok {
+		fl.Logf(l.fields, format, v...)
+		return
+	}
+	if len(l.fields) == 0 {
+		l.logger.Printf(format, v...)
+		return
+	}
+	pairs := make([]string, len(l.fields))
+	for i, f := range l.fields {
+		pairs[i] = fmt.Sprintf("%s=%v", f.Key, f.Value)
+	}
+	l.logger.Printf("[%s] %s", strings.Join(pairs, " "), fmt.Sprintf(format, v...))
+}
+
+// opName returns the name used for op in log fields.
+func opName(op uint16) string {
+	switch op {
+	case OP_RRQ:
+		return "RRQ"
+	case OP_WRQ:
+		return "WRQ"
+	case OP_DATA:
+		return "DATA"
+	case OP_ACK:
+		return "ACK"
+	case OP_ERROR:
+		return "ERROR"
+	case OP_OACK:
+		return "OACK"
+	}
+	return fmt.Sprintf("OP%d", op)
+}
+
+// logSent logs a packet sent to start or answer a request.
+func logSent(l *transferLog, p Packet) {
+	switch p := p.(type) {
+	case *RRQ:
+		l.Debugf("sent RRQ (filename=%s, mode=%s)", p.Filename, p.Mode)
+	case *WRQ:
+		l.Debugf("sent WRQ (filename=%s, mode=%s)", p.Filename, p.Mode)
+	case *OACK:
+		l.Debugf("sent OACK %v", p.Options)
+	default:
+		l.Debugf("sent %s", opName(Opcode(p)))
+	}
+}
+
+// writeAccessLog writes the AccessLog line of a finished transfer. The
+// outcome is hyphenated so that every field is a single word.
+func (s *Server) writeAccessLog(r TransferResult) {
+	line := fmt.Sprintf("%s %s %s %s %s %d %s\n",
+		time.Now().UTC().Format(time.RFC3339), r.RemoteAddr.IP, r.Direction,
+		strconv.Quote(r.Filename), r.Mode, r.Bytes,
+		strings.ReplaceAll(r.Outcome.String(), " ", "-"))
+	s.accessLogMu.Lock()
+	defer s.accessLogMu.Unlock()
+	io.WriteString(s.AccessLog, line)
+}
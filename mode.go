@@ -0,0 +1,66 @@
+package tftp
+
+// DEFAULT_MODE is the transfer mode used for requests with an empty or
+// unknown mode when Server.DefaultMode is empty.
+const DEFAULT_MODE = "octet"
+
+// knownMode reports whether mode, in lower case, is one of the transfer
+// modes of RFC 1350.
+func knownMode(mode string) bool {
+	switch mode {
+	case "netascii", "octet", "mail":
+		return true
+	}
+	return false
+}
+
+// requestMode returns the transfer mode of a request asking for mode.
+// Modes are matched case-insensitively and returned in lower case. An
+// empty or unknown mode falls back to DefaultMode, except that StrictMode
+// rejects unknown non-empty modes, reported by ok being false. A mode
+// outside AllowedModes is always rejected, including a fallback.
+func (s *Server) requestMode(mode string) (m string, ok bool) {
+	m, ascii := lowerASCII(mode)
+	if !ascii || !knownMode(m) {
+		if mode != "" && s.StrictMode {
+			return "", false
+		}
+		m = DEFAULT_MODE
+		if s.DefaultMode != "" {
+			m = s.DefaultMode
+		}
+	}
+	if !s.modeAllowed(m) {
+		return "", false
+	}
+	return m, true
+}
+
+// modeAllowed reports whether AllowedModes permits mode.
+func (s *Server) modeAllowed(mode string) bool {
+	if len(s.AllowedModes) == 0 {
+		return true
+	}
+	for _, allowed := range s.AllowedModes {
+		if allowed == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// lowerASCII returns mode in lower case and whether it is made of printable
+// ASCII only. The case of other characters is left alone: Unicode folding
+// would turn strings such as "NETASCİİ" into a valid mode.
+func lowerASCII(mode string) (string, bool) {
+	b := []byte(mode)
+	for i, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return mode, false
+		}
+		if 'A' <= c && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b), true
+}
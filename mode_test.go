@@ -0,0 +1,39 @@
+package tftp
+
+import (
+	"testing"
+)
+
+func TestRequestMode(t *testing.T) {
+	octetOnly := []string{"octet"}
+	for _, c := range []struct {
+		mode    string
+		strict  bool
+		allowed []string
+		want    string
+		ok      bool
+	}{
+		{"octet", false, nil, "octet", true},
+		{"NetASCII", false, nil, "netascii", true},
+		{"OCTET", false, nil, "octet", true},
+		{"Mail", false, nil, "mail", true},
+		{"", false, nil, "octet", true},
+		{"binary", false, nil, "octet", true},
+		{"oct\x00et", false, nil, "octet", true},
+		{"NETASCİİ", false, nil, "octet", true},
+		{"NetASCII", true, nil, "netascii", true},
+		{"", true, nil, "octet", true},
+		{"binary", true, nil, "", false},
+		{"NETASCİİ", true, nil, "", false},
+		{"OCTET", false, octetOnly, "octet", true},
+		{"NetASCII", false, octetOnly, "", false},
+		{"binary", false, octetOnly, "octet", true},
+		{"binary", true, octetOnly, "", false},
+		{"", false, []string{"netascii"}, "", false},
+	} {
+		s := &Server{StrictMode: c.strict, AllowedModes: c.allowed}
+		if m, ok := s.requestMode(c.mode); m != c.want || ok != c.ok {
+			t.Errorf("Mode %q (strict %v, allowed %v): %q, %v, want %q, %v", c.mode, c.strict, c.allowed, m, ok, c.want, c.ok)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// DEFAULT_MAX_WINDOW_SIZE is the largest windowsize accepted when
+// Server.MaxWindowSize is zero.
+const DEFAULT_MAX_WINDOW_SIZE = 16
+
+// MAX_WINDOW_SIZE is the largest windowsize RFC 7440 allows.
+const MAX_WINDOW_SIZE = 65535
+
+// MAX_TIMEOUT is the largest timeout option RFC 2349 allows, which counts
+// in whole seconds from one.
+const MAX_TIMEOUT = 255 * time.Second
+
+// errOptionsRequired refuses a request without options under
+// RequireOptions.
+var errOptionsRequired = errors.New("Options required")
+
+const (
+	optionBlockSize  = "blksize"
+	optionTimeout    = "timeout"
+	optionWindowSize = "windowsize"
+	// optionTransferSize is tsize (RFC 2349), the size of the file.
+	optionTransferSize = "tsize"
+	// optionStartBlock is a vendor option naming the first block of a
+	// resumed download.
+	optionStartBlock = "x-startblock"
+	// optionCompress is a vendor option gzipping downloads; compressGzip is
+	// its only value.
+	optionCompress = "x-compress"
+	compressGzip   = "gzip"
+)
+
+// transferOptions are the settings of a transfer that options negotiate.
+// The zero value is a plain RFC 1350 transfer.
+type transferOptions struct {
+	// blockSize is the size of a full DATA block, BLOCK_SIZE if zero.
+	blockSize int
+	// timeout is the retransmission interval, the default if zero.
+	timeout time.Duration
+	// windowSize is the number of blocks sent per ACK, lockstep if below 2.
+	windowSize int
+	// startBlock is the first block sent, 1 if zero.
+	startBlock uint16
+	// transferSize tells that tsize was requested, with size. A download
+	// answers it with the size of the file once it is opened, an upload
+	// echoes it.
+	transferSize bool
+	size         int64
+	// compress gzips the data of a download.
+	compress bool
+}
+
+// optionConfig is the part of the server configuration deciding which
+// options are accepted and how.
+type optionConfig struct {
+	disabled bool
+	// maxBlockSize caps the blksize accepted; zero refuses it.
+	maxBlockSize int
+	// maxTimeout caps the timeout accepted; zero refuses it.
+	maxTimeout time.Duration
+	// maxWindowSize caps the windowsize accepted; zero refuses it.
+	maxWindowSize int
+	// startBlock accepts the start block option.
+	startBlock bool
+	// transferSize answers tsize.
+	transferSize bool
+	// compress accepts the compression option.
+	compress bool
+}
+
+// transferOptionConfig returns the option configuration of the transfer
+// requested by req with options requested, which OptionsFunc may opt out
+// of negotiation.
+func (s *Server) transferOptionConfig(req *Request, requested map[string]string) optionConfig {
+	c := s.optionConfig()
+	if !c.disabled && len(requested) > 0 && s.OptionsFunc != nil && !s.OptionsFunc(req) {
+		c.disabled = true
+	}
+	return c
+}
+
+// negotiateRequest decides the options of req, an *RRQ or *WRQ, as its
+// transfer is set up. source tells how a download is served. The error
+// reports a request refused for falling short of RequireOptions or
+// RequireBlockSize, or errFileTooLarge for an upload whose tsize exceeds
+// MaxFileSize.
+func (s *Server) negotiateRequest(req *Request, source downloadSource) (accepted map[string]string, t transferOptions, e error) {
+	var requested map[string]string
+	switch p := req.Packet.(type) {
+	case *RRQ:
+		requested = p.Options
+	case *WRQ:
+		requested = p.Options
+	default:
+		return nil, t, nil
+	}
+	c := s.transferOptionConfig(req, requested)
+	_, upload := req.Packet.(*WRQ)
+	if upload {
+		c.startBlock, c.transferSize = false, true
+	} else if source == sourceContent {
+		c.transferSize, c.compress = true, s.AllowCompression
+	} else if source == sourcePipe {
+		c.compress = s.AllowCompression
+	} else if source == sourceBlocks {
+		c.maxBlockSize, c.startBlock = 0, false
+	}
+	accepted, t = negotiate(requested, c)
+	if upload && t.transferSize {
+		if s.MaxFileSize > 0 && t.size > s.MaxFileSize {
+			return nil, t, errFileTooLarge
+		}
+		if accepted == nil {
+			accepted = make(map[string]string)
+		}
+		accepted[optionTransferSize] = strconv.FormatInt(t.size, 10)
+	}
+	if c.disabled {
+		// Transfers OptionsFunc serves without options are exempt.
+		return accepted, t, nil
+	}
+	if s.RequireOptions && accepted == nil {
+		return nil, t, errOptionsRequired
+	}
+	size := t.blockSize
+	if size == 0 {
+		size = BLOCK_SIZE
+	}
+	if size < s.RequireBlockSize {
+		return nil, t, fmt.Errorf("Block size of at least %d required", s.RequireBlockSize)
+	}
+	return accepted, t, nil
+}
+
+// optionConfig returns the option configuration of the server.
+func (s *Server) optionConfig() optionConfig {
+	c := optionConfig{
+		disabled:      s.DisableOptions,
+		maxBlockSize:  s.MaxBlockSize,
+		maxTimeout:    s.MaxTimeoutOption,
+		maxWindowSize: s.MaxWindowSize,
+		startBlock:    s.AllowStartBlock,
+	}
+	if c.maxBlockSize == 0 {
+		c.maxBlockSize = MAX_BLOCK_SIZE
+	} else if c.maxBlockSize < 0 {
+		c.maxBlockSize = 0
+	}
+	if c.maxTimeout == 0 {
+		c.maxTimeout = MAX_TIMEOUT
+	} else if c.maxTimeout < 0 {
+		c.maxTimeout = 0
+	}
+	if c.maxWindowSize == 0 {
+		c.maxWindowSize = DEFAULT_MAX_WINDOW_SIZE
+	} else if c.maxWindowSize < 0 {
+		c.maxWindowSize = 0
+	}
+	return c
+}
+
+// negotiate decides which of the requested options the server accepts,
+// returning them with the values sent back in the OACK, and the transfer
+// settings they make. Unknown options, options with invalid values and
+// options the configuration refuses are left out, so the client carries
+// on without them as RFC 2347 provides. Values beyond what the server
+// allows are lowered to its limit. The timeout option is the exception:
+// RFC 2349 lets the server only accept the value requested or ignore the
+// option. accepted is nil if no option was accepted, in which case no
+// OACK is sent and the transfer is plain RFC 1350.
+func negotiate(requested map[string]string, c optionConfig) (accepted map[string]string, t transferOptions) {
+	if c.disabled {
+		return nil, t
+	}
+	accept := func(name string, value int) {
+		if accepted == nil {
+			accepted = make(map[string]string)
+		}
+		accepted[name] = strconv.Itoa(value)
+	}
+	if value, ok := requested[optionBlockSize]; ok && c.maxBlockSize > 0 {
+		if n, e := strconv.Atoi(value); e == nil && n >= MIN_BLOCK_SIZE {
+			if n > c.maxBlockSize {
+				n = c.maxBlockSize
+			}
+			accept(optionBlockSize, n)
+			t.blockSize = n
+		}
+	}
+	if value, ok := requested[optionTimeout]; ok && c.maxTimeout > 0 {
+		if n, e := strconv.Atoi(value); e == nil && n >= 1 && time.Duration(n)*time.Second <= c.maxTimeout {
+			accept(optionTimeout, n)
+			t.timeout = time.Duration(n) * time.Second
+		}
+	}
+	if value, ok := requested[optionWindowSize]; ok && c.maxWindowSize > 0 {
+		if n, e := strconv.Atoi(value); e == nil && n >= 1 && n <= MAX_WINDOW_SIZE {
+			if n > c.maxWindowSize {
+				n = c.maxWindowSize
+			}
+			accept(optionWindowSize, n)
+			t.windowSize = n
+		}
+	}
+	if value, ok := requested[optionStartBlock]; ok && c.startBlock {
+		if n, e := strconv.Atoi(value); e == nil && n >= 1 && n <= 65535 {
+			accept(optionStartBlock, n)
+			t.startBlock = uint16(n)
+		}
+	}
+	if requested[optionCompress] == compressGzip && c.compress && t.startBlock == 0 {
+		// Blocks of a compressed stream do not map onto the file, so a
+		// resumed download is sent as is.
+		if accepted == nil {
+			accepted = make(map[string]string)
+		}
+		accepted[optionCompress] = compressGzip
+		t.compress = true
+	}
+	if value, ok := requested[optionTransferSize]; ok && c.transferSize {
+		// The size is only known once the file is opened; the OACK
+		// carrying it is completed then.
+		if n, e := strconv.ParseInt(value, 10, 64); e == nil && n >= 0 {
+			t.transferSize, t.size = true, n
+		}
+	}
+	return accepted, t
+}
+
+// acceptOACK checks the options the server accepted in an OACK against
+// those the client requested, and returns the transfer settings they
+// make. The server may only accept options requested, blksize and
+// windowsize only with a value no larger and timeout and the start block
+// only with the value requested, as tsize unless 0 asked for the size of a
+// download; anything else fails the negotiation.
+func acceptOACK(requested, accepted map[string]string) (transferOptions, error) {
+	var t transferOptions
+	for name, value := range accepted {
+		asked, ok := requested[name]
+		if !ok {
+			return t, fmt.Errorf("Option not requested: %s", name)
+		}
+		switch name {
+		case optionBlockSize:
+			n, e := strconv.Atoi(value)
+			max, _ := strconv.Atoi(asked)
+			if e != nil || n < MIN_BLOCK_SIZE || n > max {
+				return t, fmt.Errorf("Invalid blksize: %q", value)
+			}
+			t.blockSize = n
+		case optionTimeout:
+			if value != asked {
+				return t, fmt.Errorf("Invalid timeout: %q", value)
+			}
+			n, _ := strconv.Atoi(value)
+			t.timeout = time.Duration(n) * time.Second
+		case optionWindowSize:
+			n, e := strconv.Atoi(value)
+			max, _ := strconv.Atoi(asked)
+			if e != nil || n < 1 || n > max {
+				return t, fmt.Errorf("Invalid windowsize: %q", value)
+			}
+			t.windowSize = n
+		case optionStartBlock:
+			n, e := strconv.Atoi(value)
+			if e != nil || value != asked || n < 1 || n > 65535 {
+				return t, fmt.Errorf("Invalid %s: %q", optionStartBlock, value)
+			}
+			t.startBlock = uint16(n)
+		case optionTransferSize:
+			n, e := strconv.ParseInt(value, 10, 64)
+			if e != nil || n < 0 || asked != "0" && value != asked {
+				return t, fmt.Errorf("Invalid tsize: %q", value)
+			}
+			t.transferSize, t.size = true, n
+		case optionCompress:
+			if value != asked || value != compressGzip {
+				return t, fmt.Errorf("Invalid %s: %q", optionCompress, value)
+			}
+			t.compress = true
+		}
+	}
+	return t, nil
+}
+
+// requestedBlockSize returns the blksize of the options requested, or
+// BLOCK_SIZE without a valid one: the largest block an OACK may settle on.
+func requestedBlockSize(requested map[string]string) int {
+	if n, e := strconv.Atoi(requested[optionBlockSize]); e == nil && n >= MIN_BLOCK_SIZE {
+		return n
+	}
+	return BLOCK_SIZE
+}
+
+// SupportedOptions returns the names of the options (RFC 2347) the server
+// negotiates in its current configuration, sorted. Options turned off, e.g.
+// windowsize by a negative MaxWindowSize, are left out, and so is every
+// option with DisableOptions. tsize is always answered for uploads, and for
+// downloads served by ContentFunc.
+func (s *Server) SupportedOptions() []string {
+	c := s.optionConfig()
+	if c.disabled {
+		return nil
+	}
+	var names []string
+	if c.maxBlockSize > 0 {
+		names = append(names, optionBlockSize)
+	}
+	if c.maxTimeout > 0 {
+		names = append(names, optionTimeout)
+	}
+	if c.maxWindowSize > 0 {
+		names = append(names, optionWindowSize)
+	}
+	if c.startBlock {
+		names = append(names, optionStartBlock)
+	}
+	if s.AllowCompression {
+		names = append(names, optionCompress)
+	}
+	names = append(names, optionTransferSize)
+	sort.Strings(names)
+	return names
+}
+
+// DescribeNegotiation returns the OACK the server would answer req with,
+// or nil if it would start a plain transfer. req.Packet is the *RRQ or
+// *WRQ; OptionsFunc is asked as for a live request. Nothing is sent and no
+// handler is called, so test harnesses can check option negotiation on its
+// own. The error reports a request the server would refuse over its
+// options: falling short of RequireOptions or RequireBlockSize, or an
+// upload whose tsize exceeds MaxFileSize. Other grounds for refusal, such
+// as the mode or the filename, are not checked. An upload's tsize is
+// echoed; a download's is left out, as only opening the file tells it.
+func (s *Server) DescribeNegotiation(req *Request) (*OACK, error) {
+	accepted, _, e := s.negotiateRequest(req, s.downloadSource(req.Filename))
+	if e != nil || accepted == nil {
+		return nil, e
+	}
+	return &OACK{Options: accepted}, nil
+}
@@ -0,0 +1,468 @@
+package tftp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestOptionsFunc(t *testing.T) {
+	s := &Server{
+		WriteHandler: serveBytes([]byte("content")),
+		OptionsFunc: func(req *Request) bool {
+			return req.Filename != "plain"
+		},
+	}
+	addr := startTestServer(t, s)
+	options := map[string]string{optionBlockSize: "1024"}
+	c := newRawClient(t, addr)
+	c.send(&RRQ{Filename: "plain", Mode: "octet", Options: options}, nil)
+	_, from := c.receiveData(1)
+	c.send(&ACK{BlockNumber: 1}, from)
+	c = newRawClient(t, addr)
+	c.send(&RRQ{Filename: "negotiated", Mode: "octet", Options: options}, nil)
+	if p, _ := c.receive(); !Equal(p, &OACK{Options: options}) {
+		t.Errorf("Got %#v, want OACK %v", p, options)
+	}
+}
+
+func TestNegotiateStartBlock(t *testing.T) {
+	for _, c := range []struct {
+		value   string
+		allowed bool
+		want    uint16
+	}{
+		{"3", true, 3},
+		{"65535", true, 65535},
+		{"0", true, 0},
+		{"65536", true, 0},
+		{"x", true, 0},
+		{"3", false, 0},
+	} {
+		accepted, options := negotiate(map[string]string{optionStartBlock: c.value}, optionConfig{startBlock: c.allowed})
+		if options.startBlock != c.want || (accepted != nil) != (c.want != 0) {
+			t.Errorf("%s (allowed %v): accepted %v, start block %d", c.value, c.allowed, accepted, options.startBlock)
+		}
+	}
+	requested := map[string]string{optionStartBlock: "3"}
+	if options, e := acceptOACK(requested, requested); e != nil || options.startBlock != 3 {
+		t.Errorf("OACK of the start block requested: %d, %v", options.startBlock, e)
+	}
+	if _, e := acceptOACK(requested, map[string]string{optionStartBlock: "2"}); e == nil {
+		t.Error("OACK of another start block accepted")
+	}
+}
+
+func TestResumeDownload(t *testing.T) {
+	content := make([]byte, 3*BLOCK_SIZE+10)
+	for i := range content {
+		content[i] = byte(i / BLOCK_SIZE)
+	}
+	s := &Server{WriteHandler: serveBytes(content), AllowStartBlock: true}
+	addr := startTestServer(t, s)
+	c := newRawClient(t, addr)
+	options := map[string]string{optionStartBlock: "3"}
+	c.send(&RRQ{Filename: "file", Mode: "octet", Options: options}, nil)
+	p, from := c.receive()
+	if !Equal(p, &OACK{Options: options}) {
+		t.Fatalf("Got %#v, want OACK %v", p, options)
+	}
+	c.send(&ACK{BlockNumber: 0}, from)
+	for n := uint16(3); n <= 4; n++ {
+		d, _ := c.receiveData(n)
+		want := content[int(n-1)*BLOCK_SIZE:]
+		if len(want) > BLOCK_SIZE {
+			want = want[:BLOCK_SIZE]
+		}
+		if !bytes.Equal(d.Data, want) {
+			t.Errorf("DATA #%d of %d bytes, want %d", n, len(d.Data), len(want))
+		}
+		c.send(&ACK{BlockNumber: n}, from)
+	}
+	// A file ending before the start block cannot be resumed.
+	c = newRawClient(t, addr)
+	c.send(&RRQ{Filename: "file", Mode: "octet", Options: map[string]string{optionStartBlock: "6"}}, nil)
+	_, from = c.receive()
+	c.send(&ACK{BlockNumber: 0}, from)
+	c.receiveError(ERR_UNDEFINED)
+}
+
+func TestStartBlockRefused(t *testing.T) {
+	s := &Server{WriteHandler: serveBytes([]byte("content"))}
+	addr := startTestServer(t, s)
+	c := newRawClient(t, addr)
+	c.send(&RRQ{Filename: "file", Mode: "octet", Options: map[string]string{optionStartBlock: "3"}}, nil)
+	_, from := c.receiveData(1)
+	c.send(&ACK{BlockNumber: 1}, from)
+}
+
+func TestSupportedOptions(t *testing.T) {
+	for _, c := range []struct {
+		s    *Server
+		want []string
+	}{
+		{&Server{}, []string{"blksize", "timeout", "tsize", "windowsize"}},
+		{&Server{AllowStartBlock: true}, []string{"blksize", "timeout", "tsize", "windowsize", "x-startblock"}},
+		{&Server{MaxWindowSize: -1, MaxTimeoutOption: -1}, []string{"blksize", "tsize"}},
+		{&Server{MaxBlockSize: -1}, []string{"timeout", "tsize", "windowsize"}},
+		{&Server{DisableOptions: true, AllowStartBlock: true}, nil},
+	} {
+		if names := c.s.SupportedOptions(); !reflect.DeepEqual(names, c.want) {
+			t.Errorf("Supported options %v, want %v", names, c.want)
+		}
+	}
+}
+
+func TestDescribeNegotiation(t *testing.T) {
+	s := &Server{
+		WriteHandler:    serveBytes(nil),
+		MaxBlockSize:    1024,
+		AllowStartBlock: true,
+		RequireOptions:  true,
+		MaxFileSize:     1000,
+		OptionsFunc: func(req *Request) bool {
+			return req.Filename != "plain"
+		},
+	}
+	options := map[string]string{optionBlockSize: "1428", optionStartBlock: "2", "unknown": "1"}
+	for _, c := range []struct {
+		req  Packet
+		want *OACK
+		err  error
+	}{
+		{&RRQ{Filename: "file", Mode: "octet", Options: options},
+			&OACK{Options: map[string]string{optionBlockSize: "1024", optionStartBlock: "2"}}, nil},
+		{&WRQ{Filename: "file", Mode: "octet", Options: options},
+			&OACK{Options: map[string]string{optionBlockSize: "1024"}}, nil},
+		{&WRQ{Filename: "file", Mode: "octet", Options: map[string]string{optionTransferSize: "1000"}},
+			&OACK{Options: map[string]string{optionTransferSize: "1000"}}, nil},
+		{&WRQ{Filename: "file", Mode: "octet", Options: map[string]string{optionTransferSize: "1001"}}, nil, errFileTooLarge},
+		{&RRQ{Filename: "plain", Mode: "octet", Options: options}, nil, nil},
+		{&RRQ{Filename: "file", Mode: "octet"}, nil, errOptionsRequired},
+	} {
+		req := &Request{Packet: c.req}
+		switch p := c.req.(type) {
+		case *RRQ:
+			req.Filename, req.Mode = p.Filename, p.Mode
+		case *WRQ:
+			req.Filename, req.Mode = p.Filename, p.Mode
+		}
+		oack, e := s.DescribeNegotiation(req)
+		if e != c.err || oack == nil && c.want != nil || oack != nil && !Equal(oack, c.want) {
+			t.Errorf("%#v: got %#v, %v, want %#v, %v", c.req, oack, e, c.want, c.err)
+		}
+	}
+}
+
+func TestNegotiateClamping(t *testing.T) {
+	defaults := (&Server{}).optionConfig()
+	mtu := (&Server{MaxBlockSize: SafeBlockSize(1500), MaxWindowSize: 4, MaxTimeoutOption: 10 * time.Second}).optionConfig()
+	for _, c := range []struct {
+		name, value string
+		config      optionConfig
+		want        string // the value accepted, "" if refused
+	}{
+		{optionBlockSize, "1", defaults, ""},
+		{optionBlockSize, "0", defaults, ""},
+		{optionBlockSize, "-512", defaults, ""},
+		{optionBlockSize, "x", defaults, ""},
+		{optionBlockSize, "8", defaults, "8"},
+		{optionBlockSize, "1428", defaults, "1428"},
+		{optionBlockSize, "100000", defaults, "65464"},
+		{optionBlockSize, "8192", mtu, "1448"},
+		{optionBlockSize, "1024", optionConfig{}, ""},
+		{optionWindowSize, "0", defaults, ""},
+		{optionWindowSize, "1", defaults, "1"},
+		{optionWindowSize, "100", defaults, "16"},
+		{optionWindowSize, "100", mtu, "4"},
+		{optionWindowSize, "65536", defaults, ""},
+		{optionTimeout, "0", defaults, ""},
+		{optionTimeout, "1", defaults, "1"},
+		{optionTimeout, "255", defaults, "255"},
+		{optionTimeout, "256", defaults, ""},
+		{optionTimeout, "30", mtu, ""},
+		{optionTimeout, "10", mtu, "10"},
+	} {
+		accepted, _ := negotiate(map[string]string{c.name: c.value}, c.config)
+		if got := accepted[c.name]; got != c.want || c.want == "" && accepted != nil {
+			t.Errorf("%s=%s: accepted %v, want %q", c.name, c.value, accepted, c.want)
+		}
+	}
+	requested := map[string]string{optionBlockSize: "1024", optionWindowSize: "8", optionTimeout: "2"}
+	disabled := defaults
+	disabled.disabled = true
+	if accepted, options := negotiate(requested, disabled); accepted != nil || options != (transferOptions{}) {
+		t.Errorf("Negotiation disabled: accepted %v, options %+v", accepted, options)
+	}
+	want := transferOptions{blockSize: 1024, windowSize: 8, timeout: 2 * time.Second}
+	if _, options := negotiate(requested, defaults); options != want {
+		t.Errorf("Transfer options %+v, want %+v", options, want)
+	}
+}
+
+func TestRequireOptions(t *testing.T) {
+	called := make(chan string, 4)
+	s := &Server{
+		WriteHandler: func(filename string, w *io.PipeWriter) {
+			called <- filename
+			w.Write([]byte("content"))
+			w.Close()
+		},
+		RequireOptions:   true,
+		RequireBlockSize: 1024,
+	}
+	addr := startTestServer(t, s)
+	for _, options := range []map[string]string{
+		nil,
+		{optionBlockSize: "512"},
+		{optionWindowSize: "4"},
+		{"unknown": "1"},
+	} {
+		c := newRawClient(t, addr)
+		c.send(&RRQ{Filename: "refused", Mode: "octet", Options: options}, nil)
+		c.receiveError(ERR_OPTION_NEGOTIATION)
+	}
+	c := newRawClient(t, addr)
+	options := map[string]string{optionBlockSize: "1428"}
+	c.send(&RRQ{Filename: "compliant", Mode: "octet", Options: options}, nil)
+	if p, _ := c.receive(); !Equal(p, &OACK{Options: options}) {
+		t.Fatalf("Got %#v, want OACK %v", p, options)
+	}
+	var data []byte
+	client := Client{RemoteAddr: addr, BlockSize: 1024}
+	e := client.Get("client", "octet", func(r *io.PipeReader) {
+		data, _ = io.ReadAll(r)
+	})
+	if e != nil || string(data) != "content" {
+		t.Errorf("Compliant client got %q, %v", data, e)
+	}
+	var peerError *PeerError
+	if _, e = download(t, addr, "plain"); !errors.As(e, &peerError) || peerError.Code != ERR_OPTION_NEGOTIATION {
+		t.Errorf("Plain client: %v", e)
+	}
+	if len(called) != 2 || <-called != "compliant" || <-called != "client" {
+		t.Errorf("Handler called %d times", len(called))
+	}
+	if e := s.SelfTest(); e != nil {
+		t.Errorf("SelfTest: %v", e)
+	}
+}
+
+func TestContentTransferSize(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 1500)
+	s := &Server{ContentFunc: func(filename, mode string) (io.ReadSeeker, int64, error) {
+		// The size is found by seeking to the end.
+		return bytes.NewReader(content), -1, nil
+	}}
+	addr := startTestServer(t, s)
+	c := newRawClient(t, addr)
+	c.send(&RRQ{Filename: "file", Mode: "octet", Options: map[string]string{optionTransferSize: "0", optionBlockSize: "1024"}}, nil)
+	p, from := c.receive()
+	options := map[string]string{optionTransferSize: "1500", optionBlockSize: "1024"}
+	if !Equal(p, &OACK{Options: options}) {
+		t.Fatalf("Got %#v, want OACK %v", p, options)
+	}
+	c.send(&ACK{BlockNumber: 0}, from)
+	var data []byte
+	for n := uint16(1); n <= 2; n++ {
+		d, _ := c.receiveData(n)
+		data = append(data, d.Data...)
+		c.send(&ACK{BlockNumber: n}, from)
+	}
+	if !bytes.Equal(data, content) {
+		t.Errorf("Received %d bytes", len(data))
+	}
+	// Without the option, or a handler whose size is unknown, tsize is
+	// not answered.
+	c = newRawClient(t, addr)
+	c.send(&RRQ{Filename: "file", Mode: "octet", Options: map[string]string{optionBlockSize: "1024"}}, nil)
+	if p, _ := c.receive(); !Equal(p, &OACK{Options: map[string]string{optionBlockSize: "1024"}}) {
+		t.Errorf("Got %#v without tsize requested", p)
+	}
+	addr = startTestServer(t, &Server{WriteHandler: serveBytes(content)})
+	c = newRawClient(t, addr)
+	c.send(&RRQ{Filename: "file", Mode: "octet", Options: map[string]string{optionTransferSize: "0"}}, nil)
+	c.receiveData(1)
+}
+
+func TestClientTransferSize(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 1500)
+	received := make(chan []byte, 1)
+	for _, disabled := range []bool{false, true} {
+		s := &Server{
+			ContentFunc: func(filename, mode string) (io.ReadSeeker, int64, error) {
+				return bytes.NewReader(content), int64(len(content)), nil
+			},
+			ReadHandler: func(filename string, r *io.PipeReader) {
+				data, _ := io.ReadAll(r)
+				received <- data
+			},
+			MaxFileSize:    1000,
+			DisableOptions: disabled,
+		}
+		addr := startTestServer(t, s)
+		size := int64(-1)
+		c := Client{RemoteAddr: addr, TransferSize: true, OnTransferSize: func(n int64) { size = n }}
+		var data bytes.Buffer
+		if _, e := c.Download("file", &data); e != nil || !bytes.Equal(data.Bytes(), content) {
+			t.Fatalf("Options disabled %v: downloaded %d bytes, %v", disabled, data.Len(), e)
+		}
+		// A server ignoring options sends the data right away, without
+		// telling the size.
+		if want := map[bool]int64{false: 1500, true: -1}[disabled]; size != want {
+			t.Errorf("Options disabled %v: size %d, want %d", disabled, size, want)
+		}
+		if _, e := c.Upload("small", bytes.NewReader(content[:800])); e != nil {
+			t.Fatalf("Options disabled %v: %v", disabled, e)
+		}
+		if data := <-received; len(data) != 800 {
+			t.Errorf("Options disabled %v: uploaded %d bytes", disabled, len(data))
+		}
+	}
+	// An upload announcing a size beyond MaxFileSize is refused before it
+	// starts; one within it has its size echoed.
+	s := &Server{ReadHandler: func(filename string, r *io.PipeReader) { io.Copy(io.Discard, r) }, MaxFileSize: 1000}
+	addr := startTestServer(t, s)
+	c := Client{RemoteAddr: addr, TransferSize: true}
+	var peerError *PeerError
+	if _, e := c.Upload("large", bytes.NewReader(content)); !errors.As(e, &peerError) || peerError.Code != ERR_DISK_FULL {
+		t.Errorf("Upload beyond MaxFileSize: %v", e)
+	}
+	raw := newRawClient(t, addr)
+	options := map[string]string{optionTransferSize: "800"}
+	raw.send(&WRQ{Filename: "small", Mode: "octet", Options: options}, nil)
+	if p, _ := raw.receive(); !Equal(p, &OACK{Options: options}) {
+		t.Errorf("Got %#v, want OACK %v", p, options)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	content := bytes.Repeat([]byte("option x-compress gzip\n"), 1000)
+	for _, allowed := range []bool{true, false} {
+		s := &Server{
+			ContentFunc: func(filename, mode string) (io.ReadSeeker, int64, error) {
+				return bytes.NewReader(content), int64(len(content)), nil
+			},
+			AllowCompression: allowed,
+		}
+		addr := startTestServer(t, s)
+		size := int64(-1)
+		c := Client{RemoteAddr: addr, Compress: true, TransferSize: true, OnTransferSize: func(n int64) { size = n }}
+		var data bytes.Buffer
+		if _, e := c.Download("file", &data); e != nil || !bytes.Equal(data.Bytes(), content) {
+			t.Fatalf("Compression allowed %v: downloaded %d bytes, %v", allowed, data.Len(), e)
+		}
+		if size != int64(len(content)) {
+			t.Errorf("Compression allowed %v: size %d", allowed, size)
+		}
+	}
+	// On the wire, the data is a gzip stream of the file.
+	s := &Server{WriteHandler: serveBytes(content), AllowCompression: true}
+	addr := startTestServer(t, s)
+	raw := newRawClient(t, addr)
+	options := map[string]string{optionCompress: compressGzip}
+	raw.send(&RRQ{Filename: "file", Mode: "octet", Options: options}, nil)
+	p, from := raw.receive()
+	if !Equal(p, &OACK{Options: options}) {
+		t.Fatalf("Got %#v, want OACK %v", p, options)
+	}
+	raw.send(&ACK{BlockNumber: 0}, from)
+	var stream []byte
+	for n := uint16(1); ; n++ {
+		d, _ := raw.receiveData(n)
+		stream = append(stream, d.Data...)
+		raw.send(&ACK{BlockNumber: n}, from)
+		if len(d.Data) < BLOCK_SIZE {
+			break
+		}
+	}
+	z, e := gzip.NewReader(bytes.NewReader(stream))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if data, e := io.ReadAll(z); e != nil || !bytes.Equal(data, content) {
+		t.Errorf("Decompressed %d bytes, %v", len(data), e)
+	}
+	// A resumed download is sent as is.
+	requested := map[string]string{optionCompress: compressGzip, optionStartBlock: "2"}
+	if accepted, _ := negotiate(requested, optionConfig{compress: true, startBlock: true}); accepted[optionCompress] != "" {
+		t.Errorf("Compressed a resumed download: %v", accepted)
+	}
+}
+
+func TestWindowedDownload(t *testing.T) {
+	content := make([]byte, 10*BLOCK_SIZE+100)
+	for i := range content {
+		content[i] = byte(i / BLOCK_SIZE)
+	}
+	addr := startTestServer(t, &Server{WriteHandler: serveBytes(content)})
+	c := newRawClient(t, addr)
+	options := map[string]string{optionWindowSize: "4"}
+	c.send(&RRQ{Filename: "file", Mode: "octet", Options: options}, nil)
+	p, from := c.receive()
+	if !Equal(p, &OACK{Options: options}) {
+		t.Fatalf("Got %#v, want OACK %v", p, options)
+	}
+	c.send(&ACK{BlockNumber: 0}, from)
+	// Each window of four blocks arrives before the client acknowledges
+	// its last block.
+	var data []byte
+	for n := uint16(1); n <= 11; n++ {
+		d, _ := c.receiveData(n)
+		data = append(data, d.Data...)
+		if n%4 == 0 || n == 11 {
+			c.send(&ACK{BlockNumber: n}, from)
+		}
+	}
+	if !bytes.Equal(data, content) {
+		t.Errorf("Received %d bytes", len(data))
+	}
+	client := Client{RemoteAddr: addr, WindowSize: 4}
+	var buffer bytes.Buffer
+	if _, e := client.Download("file", &buffer); e != nil || !bytes.Equal(buffer.Bytes(), content) {
+		t.Errorf("Client downloaded %d bytes, %v", buffer.Len(), e)
+	}
+}
+
+func TestBlockSizeTransfers(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 500)
+	received := make(chan []byte, 1)
+	addr := startTestServer(t, &Server{
+		WriteHandler: serveBytes(content),
+		ReadHandler: func(filename string, r *io.PipeReader) {
+			data, _ := io.ReadAll(r)
+			received <- data
+		},
+	})
+	for _, size := range []int{MIN_BLOCK_SIZE, 1024, 1428} {
+		c := newRawClient(t, addr)
+		options := map[string]string{optionBlockSize: strconv.Itoa(size)}
+		c.send(&RRQ{Filename: "file", Mode: "octet", Options: options}, nil)
+		p, from := c.receive()
+		if !Equal(p, &OACK{Options: options}) {
+			t.Fatalf("Got %#v, want OACK %v", p, options)
+		}
+		c.send(&ACK{BlockNumber: 0}, from)
+		if d, _ := c.receiveData(1); len(d.Data) != size {
+			t.Errorf("blksize %d: block of %d bytes", size, len(d.Data))
+		}
+		c.send(&ERROR{ErrorCode: ERR_UNDEFINED, ErrorMessage: "enough"}, from)
+
+		client := Client{RemoteAddr: addr, BlockSize: size}
+		var buffer bytes.Buffer
+		if _, e := client.Download("file", &buffer); e != nil || !bytes.Equal(buffer.Bytes(), content) {
+			t.Errorf("blksize %d: downloaded %d bytes, %v", size, buffer.Len(), e)
+		}
+		if _, e := client.Upload("file", bytes.NewReader(content)); e != nil {
+			t.Errorf("blksize %d: %v", size, e)
+		}
+		if data := <-received; !bytes.Equal(data, content) {
+			t.Errorf("blksize %d: uploaded %d bytes", size, len(data))
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package tftp
+
+import (
+	"io"
+)
+
+// Netascii (RFC 764) is the text encoding of the "netascii" transfer mode.
+// Lines end with CR LF, and a CR that does not end a line is sent as CR NUL.
+// The adapters below convert between it and local text, whose lines end
+// with a single LF. They keep the CR of a CR LF or CR NUL pair split across
+// reads or writes, so data can be converted in chunks of any size.
+
+const netasciiBufferSize = 4096
+
+// NewNetasciiReader returns a reader producing the netascii encoding of the
+// local text read from r.
+func NewNetasciiReader(r io.Reader) io.Reader {
+	return &netasciiReader{r: r}
+}
+
+// NewNetasciiDecodingReader returns a reader producing the local text
+// encoded as netascii in the data read from r. A CR followed by anything
+// but LF or NUL is kept as it is, as is a CR at the end of the data.
+func NewNetasciiDecodingReader(r io.Reader) io.Reader {
+	return &netasciiReader{r: r, decode: true}
+}
+
+type netasciiReader struct {
+	r      io.Reader
+	decode bool
+	// cr is set when decoding data that ended in a CR, whose meaning
+	// depends on the next byte.
+	cr  bool
+	buf []byte
+	// out is the part of the translation in tmp not read yet.
+	tmp []byte
+	out []byte
+	err error
+}
+
+func (r *netasciiReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if r.buf == nil {
+		r.buf = make([]byte, netasciiBufferSize)
+	}
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		n, e := r.r.Read(r.buf)
+		if r.decode {
+			r.tmp, r.cr = decodeNetascii(r.tmp[:0], r.buf[:n], r.cr)
+			if e != nil && r.cr {
+				r.tmp = append(r.tmp, '\r')
+				r.cr = false
+			}
+		} else {
+			r.tmp = encodeNetascii(r.tmp[:0], r.buf[:n])
+		}
+		r.out = r.tmp
+		r.err = e
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// NewNetasciiWriter returns a writer encoding the local text written to it
+// as netascii and writing that to w.
+func NewNetasciiWriter(w io.Writer) io.Writer {
+	return &netasciiWriter{w: w}
+}
+
+type netasciiWriter struct {
+	w   io.Writer
+	out []byte
+}
+
+func (w *netasciiWriter) Write(p []byte) (int, error) {
+	w.out = encodeNetascii(w.out[:0], p)
+	n, e := w.w.Write(w.out)
+	if e == nil {
+		return len(p), nil
+	}
+	// Count the bytes of p whose whole encoding made it to w.
+	written := 0
+	for _, b := range p {
+		size := 1
+		if b == '\n' || b == '\r' {
+			size = 2
+		}
+		if n < size {
+			break
+		}
+		n -= size
+		written++
+	}
+	return written, e
+}
+
+// NewNetasciiDecodingWriter returns a writer decoding the netascii written
+// to it and writing the local text to w. A CR at the end of a write is held
+// back until the next byte shows what it means; Close writes it out if the
+// data ends with it. Close does not close w.
+func NewNetasciiDecodingWriter(w io.Writer) io.WriteCloser {
+	return &netasciiDecodingWriter{w: w}
+}
+
+type netasciiDecodingWriter struct {
+	w   io.Writer
+	cr  bool
+	out []byte
+}
+
+func (w *netasciiDecodingWriter) Write(p []byte) (int, error) {
+	w.out, w.cr = decodeNetascii(w.out[:0], p, w.cr)
+	if _, e := w.w.Write(w.out); e != nil {
+		return 0, e
+	}
+	return len(p), nil
+}
+
+func (w *netasciiDecodingWriter) Close() error {
+	if !w.cr {
+		return nil
+	}
+	w.cr = false
+	_, e := w.w.Write([]byte{'\r'})
+	return e
+}
+
+// encodeNetascii appends the netascii encoding of src to dst.
+func encodeNetascii(dst, src []byte) []byte {
+	for _, b := range src {
+		switch b {
+		case '\n':
+			dst = append(dst, '\r', '\n')
+		case '\r':
+			dst = append(dst, '\r', 0)
+		default:
+			dst = append(dst, b)
+		}
+	}
+	return dst
+}
+
+// decodeNetascii appends the local text of the netascii src to dst. cr
+// tells whether the data before src ended in a CR; the result tells
+// whether src does, in which case that CR is not appended yet.
+func decodeNetascii(dst, src []byte, cr bool) ([]byte, bool) {
+	for _, b := range src {
+		if cr {
+			cr = false
+			switch b {
+			case '\n':
+				dst = append(dst, '\n')
+				continue
+			case 0:
+				dst = append(dst, '\r')
+				continue
+			}
+			dst = append(dst, '\r')
+		}
+		if b == '\r' {
+			cr = true
+			continue
+		}
+		dst = append(dst, b)
+	}
+	return dst, cr
+}
@@ -0,0 +1,119 @@
+package tftp
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// netasciiCases pair local text with its netascii encoding.
+var netasciiCases = []struct {
+	local, wire string
+}{
+	{"", ""},
+	{"plain", "plain"},
+	{"a\nb\n", "a\r\nb\r\n"},
+	{"a\rb", "a\r\x00b"},
+	{"\r\n", "\r\x00\r\n"},
+	{"\n\n", "\r\n\r\n"},
+	{"ends in CR\r", "ends in CR\r\x00"},
+	{"\r\r\n\x00", "\r\x00\r\x00\r\n\x00"},
+}
+
+func TestNetasciiReaders(t *testing.T) {
+	for _, c := range netasciiCases {
+		// One byte per read splits every CR from what follows it.
+		wire, e := io.ReadAll(NewNetasciiReader(iotest.OneByteReader(strings.NewReader(c.local))))
+		if e != nil || string(wire) != c.wire {
+			t.Errorf("Encoded %q as %q, %v, want %q", c.local, wire, e, c.wire)
+		}
+		local, e := io.ReadAll(NewNetasciiDecodingReader(iotest.OneByteReader(strings.NewReader(c.wire))))
+		if e != nil || string(local) != c.local {
+			t.Errorf("Decoded %q as %q, %v, want %q", c.wire, local, e, c.local)
+		}
+	}
+}
+
+func TestNetasciiWriters(t *testing.T) {
+	for _, c := range netasciiCases {
+		// Split the data at every position, between CR and LF or NUL too.
+		for i := 0; i <= len(c.local); i++ {
+			var wire bytes.Buffer
+			w := NewNetasciiWriter(&wire)
+			w.Write([]byte(c.local[:i]))
+			w.Write([]byte(c.local[i:]))
+			if wire.String() != c.wire {
+				t.Errorf("Encoded %q split at %d as %q, want %q", c.local, i, wire.String(), c.wire)
+			}
+		}
+		for i := 0; i <= len(c.wire); i++ {
+			var local bytes.Buffer
+			w := NewNetasciiDecodingWriter(&local)
+			w.Write([]byte(c.wire[:i]))
+			w.Write([]byte(c.wire[i:]))
+			if e := w.Close(); e != nil || local.String() != c.local {
+				t.Errorf("Decoded %q split at %d as %q, %v, want %q", c.wire, i, local.String(), e, c.local)
+			}
+		}
+	}
+}
+
+func TestNetasciiDecodingBareCR(t *testing.T) {
+	// A CR followed by neither LF nor NUL, or ending the data, is kept.
+	for _, wire := range []string{"a\rb", "a\r"} {
+		local, e := io.ReadAll(NewNetasciiDecodingReader(iotest.OneByteReader(strings.NewReader(wire))))
+		if e != nil || string(local) != wire {
+			t.Errorf("Decoded %q as %q, %v", wire, local, e)
+		}
+		var buffer bytes.Buffer
+		w := NewNetasciiDecodingWriter(&buffer)
+		for i := range wire {
+			w.Write([]byte{wire[i]})
+		}
+		if e := w.Close(); e != nil || buffer.String() != wire {
+			t.Errorf("Decoded %q byte by byte as %q, %v", wire, buffer.String(), e)
+		}
+	}
+}
+
+func TestNetasciiRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	text := make([]byte, 10000)
+	for i := range text {
+		text[i] = "ab\r\n\x00"[random.Intn(5)]
+	}
+	// Encode by reader and decode by writer, and the other way round, in
+	// chunks of random size.
+	wire, e := io.ReadAll(NewNetasciiReader(iotest.HalfReader(bytes.NewReader(text))))
+	if e != nil {
+		t.Fatal(e)
+	}
+	var local bytes.Buffer
+	d := NewNetasciiDecodingWriter(&local)
+	for rest := wire; len(rest) > 0; {
+		n := 1 + random.Intn(len(rest))
+		d.Write(rest[:n])
+		rest = rest[n:]
+	}
+	d.Close()
+	if !bytes.Equal(local.Bytes(), text) {
+		t.Error("Reader and decoding writer do not round-trip")
+	}
+	var encoded bytes.Buffer
+	w := NewNetasciiWriter(&encoded)
+	for rest := text; len(rest) > 0; {
+		n := 1 + random.Intn(len(rest))
+		w.Write(rest[:n])
+		rest = rest[n:]
+	}
+	if !bytes.Equal(encoded.Bytes(), wire) {
+		t.Error("Writer and reader encode differently")
+	}
+	decoded, e := io.ReadAll(NewNetasciiDecodingReader(iotest.OneByteReader(bytes.NewReader(encoded.Bytes()))))
+	if e != nil || !bytes.Equal(decoded, text) {
+		t.Errorf("Writer and decoding reader do not round-trip: %v", e)
+	}
+}
@@ -0,0 +1,537 @@
+package tftp
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+)
+
+// Option configures a Server created with NewServer.
+type Option func(s *Server)
+
+// NewServer returns a server bound to bindAddr and configured by opts. It is
+// equivalent to setting the corresponding Server fields, which stay
+// available for compatibility.
+//
+//	s := tftp.NewServer(addr,
+//		tftp.WithWriteHandler(HandleRead),
+//		tftp.WithLogger(log.New(os.Stderr, "TFTP ", log.LstdFlags)))
+func NewServer(bindAddr *net.UDPAddr, opts ...Option) *Server {
+	s := &Server{BindAddr: bindAddr}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// NewDualStackServer returns a server listening on port on both the IPv4
+// and the IPv6 wildcard address, e.g. 69 for a PXE server, configured by
+// opts. The two sockets are served by one server sharing handlers,
+// transfers and limits, and Shutdown closes both. On hosts without IPv6
+// the server only listens on IPv4.
+func NewDualStackServer(port int, opts ...Option) *Server {
+	s := NewServer(&net.UDPAddr{IP: net.IPv4zero, Port: port}, opts...)
+	s.BindAddrs = append(s.BindAddrs, &net.UDPAddr{IP: net.IPv6unspecified, Port: port})
+	s.dualStack = true
+	return s
+}
+
+// WithReadHandler sets the handler receiving uploads.
+func WithReadHandler(h func(filename string, r *io.PipeReader)) Option {
+	return func(s *Server) {
+		s.ReadHandler = h
+	}
+}
+
+// WithWriteHandler sets the handler producing downloads.
+func WithWriteHandler(h func(filename string, w *io.PipeWriter)) Option {
+	return func(s *Server) {
+		s.WriteHandler = h
+	}
+}
+
+// WithContentFunc sets the function supplying the content of downloads.
+func WithContentFunc(f func(filename, mode string) (io.ReadSeeker, int64, error)) Option {
+	return func(s *Server) {
+		s.ContentFunc = f
+	}
+}
+
+// WithUploadFunc sets the function opening the writers uploads are stored
+// in.
+func WithUploadFunc(f func(filename, mode string) (io.Writer, error)) Option {
+	return func(s *Server) {
+		s.UploadFunc = f
+	}
+}
+
+// WithBlockFunc sets the function opening block sources for downloads.
+func WithBlockFunc(f func(filename, mode string) (BlockReader, error)) Option {
+	return func(s *Server) {
+		s.BlockFunc = f
+	}
+}
+
+// WithNotFoundFallback sets the function serving reads of missing files.
+func WithNotFoundFallback(f func(filename string) (io.Reader, error)) Option {
+	return func(s *Server) {
+		s.NotFoundFallback = f
+	}
+}
+
+// WithReadRequestHandler sets the request-aware handler receiving uploads.
+func WithReadRequestHandler(h func(req *Request, r *io.PipeReader)) Option {
+	return func(s *Server) {
+		s.ReadRequestHandler = h
+	}
+}
+
+// WithWriteRequestHandler sets the request-aware handler producing
+// downloads.
+func WithWriteRequestHandler(h func(req *Request, w *io.PipeWriter)) Option {
+	return func(s *Server) {
+		s.WriteRequestHandler = h
+	}
+}
+
+// WithLogger sets the server log.
+func WithLogger(l Logger) Option {
+	return func(s *Server) {
+		s.Log = l
+	}
+}
+
+// WithLogLevel sets the least severe level written to the log.
+func WithLogLevel(level LogLevel) Option {
+	return func(s *Server) {
+		s.LogLevel = level
+	}
+}
+
+// WithBindAddrs adds addresses served alongside the one passed to
+// NewServer.
+func WithBindAddrs(addrs ...*net.UDPAddr) Option {
+	return func(s *Server) {
+		s.BindAddrs = append(s.BindAddrs, addrs...)
+	}
+}
+
+// WithTransmissionConnFunc sets the function opening transmission sockets.
+func WithTransmissionConnFunc(f func(remoteAddr *net.UDPAddr) (*net.UDPConn, error)) Option {
+	return func(s *Server) {
+		s.TransmissionConnFunc = f
+	}
+}
+
+// WithPortRange restricts transmission sockets to ports min through max.
+func WithPortRange(min, max int) Option {
+	return func(s *Server) {
+		s.PortRange = &PortRange{min, max}
+	}
+}
+
+// WithTransmissionPortFunc sets the function choosing transmission ports.
+func WithTransmissionPortFunc(f func(remote *net.UDPAddr) int) Option {
+	return func(s *Server) {
+		s.TransmissionPortFunc = f
+	}
+}
+
+// WithSocketPool keeps up to size transmission sockets for reuse.
+func WithSocketPool(size int) Option {
+	return func(s *Server) {
+		s.SocketPoolSize = size
+	}
+}
+
+// WithAdvertisedAddr sets the address reported for transfers behind NAT.
+func WithAdvertisedAddr(host string) Option {
+	return func(s *Server) {
+		s.AdvertisedAddr = host
+	}
+}
+
+// WithDSCP sets the DSCP marking of the server's sockets.
+func WithDSCP(dscp int) Option {
+	return func(s *Server) {
+		s.DSCP = dscp
+	}
+}
+
+// WithDisableFragmentation sets the don't-fragment bit on the server's
+// sockets.
+func WithDisableFragmentation() Option {
+	return func(s *Server) {
+		s.DisableFragmentation = true
+	}
+}
+
+// WithConfigureConn sets the function configuring the server's sockets.
+func WithConfigureConn(f func(conn *net.UDPConn) error) Option {
+	return func(s *Server) {
+		s.ConfigureConn = f
+	}
+}
+
+// WithRecordInterface records the arrival interface of requests.
+func WithRecordInterface() Option {
+	return func(s *Server) {
+		s.RecordInterface = true
+	}
+}
+
+// WithListing serves the names returned by f when filename is read.
+func WithListing(filename string, f func() ([]string, error)) Option {
+	return func(s *Server) {
+		s.EnableListing = true
+		s.ListFilename = filename
+		s.ListFunc = f
+	}
+}
+
+// WithHealthCheck serves "OK\n" when filename is read.
+func WithHealthCheck(filename string) Option {
+	return func(s *Server) {
+		s.EnableHealthCheck = true
+		s.HealthCheckFilename = filename
+	}
+}
+
+// WithMaxFileSize limits the size of uploads.
+func WithMaxFileSize(n int64) Option {
+	return func(s *Server) {
+		s.MaxFileSize = n
+	}
+}
+
+// WithHandlerWriteTimeout limits how long the ReadHandler may take to read
+// a block.
+func WithHandlerWriteTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.HandlerWriteTimeout = d
+	}
+}
+
+// WithDisableWriteProbe turns off the zero-byte Write probing the
+// ReadHandler before an upload is acknowledged.
+func WithDisableWriteProbe() Option {
+	return func(s *Server) {
+		s.DisableWriteProbe = true
+	}
+}
+
+// WithInterBlockDelay sets the pause between the blocks of a download.
+func WithInterBlockDelay(d time.Duration) Option {
+	return func(s *Server) {
+		s.InterBlockDelay = d
+	}
+}
+
+// WithDally keeps the socket of a finished download open for d, resending
+// the final block on a late ACK of the block before it if resend is set.
+func WithDally(d time.Duration, resend bool) Option {
+	return func(s *Server) {
+		s.DallyTimeout = d
+		s.DallyResend = resend
+	}
+}
+
+// WithMinThroughput aborts transfers slower than bytesPerSecond over a
+// whole window.
+func WithMinThroughput(bytesPerSecond int64, window time.Duration) Option {
+	return func(s *Server) {
+		s.MinThroughput = bytesPerSecond
+		s.MinThroughputWindow = window
+	}
+}
+
+// WithMaxTransfers limits the number of transfers run at once.
+func WithMaxTransfers(n int) Option {
+	return func(s *Server) {
+		s.MaxTransfers = n
+	}
+}
+
+// WithMaxTotalBytes sets the quota on the bytes transferred by the server.
+func WithMaxTotalBytes(n int64) Option {
+	return func(s *Server) {
+		s.MaxTotalBytes = n
+	}
+}
+
+// WithAllowedClients restricts the server to clients within networks.
+func WithAllowedClients(networks ...*net.IPNet) Option {
+	return func(s *Server) {
+		s.AllowedClients = append(s.AllowedClients, networks...)
+	}
+}
+
+// WithRejectClients answers clients outside AllowedClients with an ERROR
+// instead of dropping their packets.
+func WithRejectClients() Option {
+	return func(s *Server) {
+		s.RejectClients = true
+	}
+}
+
+// WithFilePatterns sets the allowed and denied filename patterns.
+func WithFilePatterns(allow, deny []string) Option {
+	return func(s *Server) {
+		s.AllowPatterns = allow
+		s.DenyPatterns = deny
+	}
+}
+
+// WithDefaultMode sets the mode assumed for requests with an empty or
+// unknown mode.
+func WithDefaultMode(mode string) Option {
+	return func(s *Server) {
+		s.DefaultMode = mode
+	}
+}
+
+// WithAllowedModes restricts the transfer modes served to modes.
+func WithAllowedModes(modes ...string) Option {
+	return func(s *Server) {
+		s.AllowedModes = modes
+	}
+}
+
+// WithStrictMode rejects requests with unknown modes.
+func WithStrictMode() Option {
+	return func(s *Server) {
+		s.StrictMode = true
+	}
+}
+
+// WithFileExists sets the check refusing uploads of existing files.
+func WithFileExists(exists func(filename string) bool) Option {
+	return func(s *Server) {
+		s.FileExists = exists
+	}
+}
+
+// WithBlockTransform sets the function applied to every block in transit.
+func WithBlockTransform(f func(block []byte, blockNum uint16, direction Direction) ([]byte, error)) Option {
+	return func(s *Server) {
+		s.BlockTransform = f
+	}
+}
+
+// WithAdoptPeerPort makes transfers follow clients whose port changes.
+func WithAdoptPeerPort() Option {
+	return func(s *Server) {
+		s.AdoptPeerPort = true
+	}
+}
+
+// WithConnectPeer connects transfer sockets to their client, so that ICMP
+// errors end transfers as PeerUnreachable.
+func WithConnectPeer() Option {
+	return func(s *Server) {
+		s.ConnectPeer = true
+	}
+}
+
+// WithBlockWrapTo sets the block number following block 65535.
+func WithBlockWrapTo(n uint16) Option {
+	return func(s *Server) {
+		s.BlockWrapTo = n
+	}
+}
+
+// WithDisableOptions serves every transfer without option negotiation.
+func WithDisableOptions() Option {
+	return func(s *Server) {
+		s.DisableOptions = true
+	}
+}
+
+// WithRequireOptions refuses requests without options, or negotiating a
+// block size below minBlockSize if it is positive.
+func WithRequireOptions(minBlockSize int) Option {
+	return func(s *Server) {
+		s.RequireOptions = true
+		s.RequireBlockSize = minBlockSize
+	}
+}
+
+// WithRejectDowngrade aborts uploads from clients ignoring the negotiated
+// block size.
+func WithRejectDowngrade() Option {
+	return func(s *Server) {
+		s.RejectDowngrade = true
+	}
+}
+
+// WithAllowStartBlock accepts the x-startblock option of resumed downloads.
+func WithAllowStartBlock() Option {
+	return func(s *Server) {
+		s.AllowStartBlock = true
+	}
+}
+
+// WithAllowCompression accepts the x-compress option of gzipped downloads.
+func WithAllowCompression() Option {
+	return func(s *Server) {
+		s.AllowCompression = true
+	}
+}
+
+// WithOptionsFunc sets the function deciding per request whether its
+// options are negotiated.
+func WithOptionsFunc(f func(req *Request) bool) Option {
+	return func(s *Server) {
+		s.OptionsFunc = f
+	}
+}
+
+// WithMaxWindowSize sets the largest windowsize option accepted.
+func WithMaxWindowSize(n int) Option {
+	return func(s *Server) {
+		s.MaxWindowSize = n
+	}
+}
+
+// WithMaxTimeoutOption sets the largest timeout option accepted.
+func WithMaxTimeoutOption(d time.Duration) Option {
+	return func(s *Server) {
+		s.MaxTimeoutOption = d
+	}
+}
+
+// WithMaxBlockSize sets the largest blksize option accepted.
+func WithMaxBlockSize(n int) Option {
+	return func(s *Server) {
+		s.MaxBlockSize = n
+	}
+}
+
+// WithOptionLimits bounds the number and bytes of the options of a request.
+func WithOptionLimits(maxOptions, maxBytes int) Option {
+	return func(s *Server) {
+		s.MaxOptions = maxOptions
+		s.MaxOptionBytes = maxBytes
+	}
+}
+
+// WithDrainTimeout sets how long ServeContext drains transfers.
+func WithDrainTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.DrainTimeout = d
+	}
+}
+
+// WithCache serves downloads through a cache holding up to maxBytes.
+func WithCache(maxBytes int64) Option {
+	return func(s *Server) {
+		s.Cache = &Cache{MaxBytes: maxBytes}
+	}
+}
+
+// WithReadCompleteCallback sets the function called when a download ends.
+func WithReadCompleteCallback(f func(filename string, e error)) Option {
+	return func(s *Server) {
+		s.OnReadComplete = f
+	}
+}
+
+// WithHandlerPanicCallback sets the function called when a handler panics.
+func WithHandlerPanicCallback(f func(req *Request, v interface{})) Option {
+	return func(s *Server) {
+		s.OnHandlerPanic = f
+	}
+}
+
+// WithPollInterval sets how often the serve loop checks for shutdown.
+func WithPollInterval(d time.Duration) Option {
+	return func(s *Server) {
+		s.PollInterval = d
+	}
+}
+
+// WithTransferLog enables the per-transfer summary log line.
+func WithTransferLog() Option {
+	return func(s *Server) {
+		s.LogTransfers = true
+	}
+}
+
+// WithRequestCallback sets the function called for every request.
+func WithRequestCallback(f func(op uint16, filename, mode string, peer *net.UDPAddr)) Option {
+	return func(s *Server) {
+		s.OnRequest = f
+	}
+}
+
+// WithUnknownOpcodeHandler sets the handler for unexpected datagrams.
+func WithUnknownOpcodeHandler(f func(raw []byte, peer *net.UDPAddr)) Option {
+	return func(s *Server) {
+		s.UnknownOpcodeHandler = f
+	}
+}
+
+// WithAccessLog writes a line per transfer to w.
+func WithAccessLog(w io.Writer) Option {
+	return func(s *Server) {
+		s.AccessLog = w
+	}
+}
+
+// WithCaptureFunc sets the function choosing where transfers are captured.
+func WithCaptureFunc(f func(info TransferInfo) io.Writer) Option {
+	return func(s *Server) {
+		s.CaptureFunc = f
+	}
+}
+
+// WithTransferCallback sets the function called when a transfer ends.
+func WithTransferCallback(f func(result TransferResult)) Option {
+	return func(s *Server) {
+		s.OnTransferComplete = f
+	}
+}
+
+// WithErrorMessageFunc sets the function choosing ERROR packet texts.
+func WithErrorMessageFunc(f func(code uint16, e error) string) Option {
+	return func(s *Server) {
+		s.ErrorMessageFunc = f
+	}
+}
+
+// WithBackoffFunc sets the retransmission timeout of each attempt.
+func WithBackoffFunc(f func(attempt int) time.Duration) Option {
+	return func(s *Server) {
+		s.BackoffFunc = f
+	}
+}
+
+// WithIdleTimeout sets how long a transfer may go without progress.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.IdleTimeout = d
+	}
+}
+
+// WithPipeBufferBlocks sets the number of blocks buffered between each
+// transfer and its handler.
+func WithPipeBufferBlocks(n int) Option {
+	return func(s *Server) {
+		s.PipeBufferBlocks = n
+	}
+}
+
+// WithRetransmitJitter sets the fraction retransmission timeouts vary by.
+func WithRetransmitJitter(fraction float64) Option {
+	return func(s *Server) {
+		s.RetransmitJitter = fraction
+	}
+}
+
+// WithContextFunc sets the function deriving the context of each transfer.
+func WithContextFunc(f func(ctx context.Context, req *Request) context.Context) Option {
+	return func(s *Server) {
+		s.ContextFunc = f
+	}
+}
@@ -3,7 +3,9 @@ package tftp
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -18,20 +20,100 @@ const (
 	OP_DATA  = uint16(3) // Data
 	OP_ACK   = uint16(4) // Acknowledgement
 	OP_ERROR = uint16(5) // Error
+	OP_OACK  = uint16(6) // Option acknowledgement (RFC 2347)
 )
 
 const (
-	BLOCK_SIZE        = 512
-	MAX_DATAGRAM_SIZE = 516
+	ERR_UNDEFINED          = uint16(0) // Not defined, see error message
+	ERR_NOT_FOUND          = uint16(1) // File not found
+	ERR_ACCESS_VIOLATION   = uint16(2) // Access violation
+	ERR_DISK_FULL          = uint16(3) // Disk full or allocation exceeded
+	ERR_ILLEGAL_OP         = uint16(4) // Illegal TFTP operation
+	ERR_UNKNOWN_TID        = uint16(5) // Unknown transfer ID
+	ERR_FILE_EXISTS        = uint16(6) // File already exists
+	ERR_NO_SUCH_USER       = uint16(7) // No such user
+	ERR_OPTION_NEGOTIATION = uint16(8) // Option negotiation failed (RFC 2347)
 )
 
+const (
+	BLOCK_SIZE        = 512                // Block size of transfers without the blksize option
+	MAX_DATAGRAM_SIZE = 516                // Largest DATA packet of BLOCK_SIZE transfers
+	MAX_BLOCK_SIZE    = 65464              // Largest block size allowed by RFC 2348
+	MAX_PACKET_SIZE   = MAX_BLOCK_SIZE + 4 // Largest DATA packet, also bounds requests
+)
+
+const (
+	IPV6_HEADER_SIZE = 40 // IPv6 header without extension headers
+	UDP_HEADER_SIZE  = 8
+	DATA_HEADER_SIZE = 4 // Opcode and block number of a DATA packet
+	MIN_BLOCK_SIZE   = 8 // Smallest block size allowed by RFC 2348
+)
+
+const (
+	DEFAULT_MAX_OPTIONS      = 32  // Options accepted in a request or OACK
+	DEFAULT_MAX_OPTION_BYTES = 512 // Bytes of option names and values accepted
+)
+
+// ErrOptionLimit is returned by Parse for a request or OACK carrying more
+// options, or more bytes of them, than OptionLimits allow.
+var ErrOptionLimit = errors.New("Option limit exceeded")
+
+// OptionLimits bounds the options parsed from a request or OACK, so a
+// packet with a huge list of them cannot make the parser spend memory and
+// time on it. Real clients send a handful of short options.
+type OptionLimits struct {
+	// MaxOptions is the number of options, DEFAULT_MAX_OPTIONS if zero.
+	MaxOptions int
+	// MaxBytes is the size of the option names and values with their
+	// terminating NULs, DEFAULT_MAX_OPTION_BYTES if zero. The default
+	// keeps requests within the 512 bytes RFC 2347 allows.
+	MaxBytes int
+}
+
+func (l OptionLimits) maxOptions() int {
+	if l.MaxOptions == 0 {
+		return DEFAULT_MAX_OPTIONS
+	}
+	return l.MaxOptions
+}
+
+func (l OptionLimits) maxBytes() int {
+	if l.MaxBytes == 0 {
+		return DEFAULT_MAX_OPTION_BYTES
+	}
+	return l.MaxBytes
+}
+
+// SafeBlockSize returns the largest block size whose DATA packets fit into
+// a single IP packet on a path with the given MTU, so they are never
+// fragmented. It allows for the IPv6 header, which also keeps IPv4 packets
+// within the MTU. The result is clamped to the block sizes RFC 2348
+// allows; the minimum does not fit MTUs below 60 bytes.
+func SafeBlockSize(mtu int) int {
+	size := mtu - IPV6_HEADER_SIZE - UDP_HEADER_SIZE - DATA_HEADER_SIZE
+	if size < MIN_BLOCK_SIZE {
+		return MIN_BLOCK_SIZE
+	}
+	if size > MAX_BLOCK_SIZE {
+		return MAX_BLOCK_SIZE
+	}
+	return size
+}
+
+// RRQ and WRQ carry the options of the request (RFC 2347), if any, keyed
+// by their names in lower case since option names are case-insensitive.
 type RRQ struct {
 	Filename string
 	Mode     string
+	Options  map[string]string
 }
 
 func (p *RRQ) Unpack(data []byte) (e error) {
-	p.Filename, p.Mode, e = unpackRQ(data)
+	return p.unpack(data, OptionLimits{})
+}
+
+func (p *RRQ) unpack(data []byte, limits OptionLimits) (e error) {
+	p.Filename, p.Mode, p.Options, e = unpackRQ(data, limits)
 	if e != nil {
 		return e
 	}
@@ -39,16 +121,21 @@ func (p *RRQ) Unpack(data []byte) (e error) {
 }
 
 func (p *RRQ) Pack() []byte {
-	return packRQ(p.Filename, p.Mode, OP_RRQ)
+	return packRQ(p.Filename, p.Mode, p.Options, OP_RRQ)
 }
 
 type WRQ struct {
 	Filename string
 	Mode     string
+	Options  map[string]string
 }
 
 func (p *WRQ) Unpack(data []byte) (e error) {
-	p.Filename, p.Mode, e = unpackRQ(data)
+	return p.unpack(data, OptionLimits{})
+}
+
+func (p *WRQ) unpack(data []byte, limits OptionLimits) (e error) {
+	p.Filename, p.Mode, p.Options, e = unpackRQ(data, limits)
 	if e != nil {
 		return e
 	}
@@ -56,34 +143,104 @@ func (p *WRQ) Unpack(data []byte) (e error) {
 }
 
 func (p *WRQ) Pack() []byte {
-	return packRQ(p.Filename, p.Mode, OP_WRQ)
+	return packRQ(p.Filename, p.Mode, p.Options, OP_WRQ)
 }
 
-func unpackRQ(data []byte) (filename string, mode string, e error) {
+func unpackRQ(data []byte, limits OptionLimits) (filename string, mode string, options map[string]string, e error) {
 	buffer := bytes.NewBuffer(data[2:])
 	s, e := buffer.ReadString(0x0)
 	if e != nil {
-		return s, "", e
+		return s, "", nil, e
 	}
 	filename = strings.TrimSpace(strings.Trim(s, "\x00"))
 	s, e = buffer.ReadString(0x0)
 	if e != nil {
-		return filename, s, e
+		return filename, s, nil, e
 	}
-	mode = strings.TrimSpace(s)
-	return filename, mode, nil
+	mode = strings.TrimSpace(strings.Trim(s, "\x00"))
+	options, e = unpackOptions(buffer, limits)
+	return filename, mode, options, e
 }
 
-func packRQ(filename string, mode string, opcode uint16) []byte {
+func packRQ(filename string, mode string, options map[string]string, opcode uint16) []byte {
 	buffer := &bytes.Buffer{}
 	binary.Write(buffer, binary.BigEndian, opcode)
 	buffer.WriteString(filename)
 	buffer.WriteByte(0x0)
 	buffer.WriteString(mode)
 	buffer.WriteByte(0x0)
+	packOptions(buffer, options)
 	return buffer.Bytes()
 }
 
+// unpackOptions reads the name and value pairs following the fixed part
+// of a request or OACK. A name without a value or an empty name ends the
+// list, as some clients pad their requests; of an option given twice, the
+// first is kept. The result is nil if there are no options. Every pair
+// read counts against limits, duplicates included, and exceeding them
+// fails with ErrOptionLimit.
+func unpackOptions(buffer *bytes.Buffer, limits OptionLimits) (map[string]string, error) {
+	var options map[string]string
+	count, size := 0, 0
+	for {
+		name, e := buffer.ReadString(0x0)
+		if e != nil {
+			break
+		}
+		value, e := buffer.ReadString(0x0)
+		if e != nil {
+			break
+		}
+		size += len(name) + len(value)
+		name = strings.ToLower(strings.TrimSpace(strings.Trim(name, "\x00")))
+		if name == "" {
+			break
+		}
+		count++
+		if count > limits.maxOptions() {
+			return nil, fmt.Errorf("%w: more than %d options", ErrOptionLimit, limits.maxOptions())
+		}
+		if size > limits.maxBytes() {
+			return nil, fmt.Errorf("%w: options of more than %d bytes", ErrOptionLimit, limits.maxBytes())
+		}
+		if _, ok := options[name]; ok {
+			continue
+		}
+		if options == nil {
+			options = make(map[string]string)
+		}
+		options[name] = strings.TrimSpace(strings.Trim(value, "\x00"))
+	}
+	return options, nil
+}
+
+// packOptions writes options sorted by name, so packets are reproducible.
+func packOptions(buffer *bytes.Buffer, options map[string]string) {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		buffer.WriteString(name)
+		buffer.WriteByte(0x0)
+		buffer.WriteString(options[name])
+		buffer.WriteByte(0x0)
+	}
+}
+
+func optionsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if v, ok := b[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
 type DATA struct {
 	BlockNumber uint16
 	Data        []byte
@@ -131,16 +288,16 @@ type ERROR struct {
 }
 
 func (p *ERROR) Unpack(data []byte) (e error) {
-	p.ErrorCode = binary.BigEndian.Uint16(data[2:])
-	if len(data) < 4 { // ACK packet must have Opcode (2 bytes) and ErrorCode (2 bytes)
+	if len(data) < 4 { // ERROR packet must have Opcode (2 bytes) and ErrorCode (2 bytes)
 		return fmt.Errorf("invalid ERROR packet (length = %d)", len(data))
 	}
+	p.ErrorCode = binary.BigEndian.Uint16(data[2:])
 	buffer := bytes.NewBuffer(data[4:])
 	s, e := buffer.ReadString(0x0)
 	if e != nil {
 		return e
 	}
-	p.ErrorMessage = strings.TrimSpace(s)
+	p.ErrorMessage = strings.TrimSpace(strings.Trim(s, "\x00"))
 	return nil
 }
 
@@ -153,7 +310,41 @@ func (p *ERROR) Pack() []byte {
 	return buffer.Bytes()
 }
 
-func ParsePacket(data []byte) (*Packet, error) {
+// OACK acknowledges the options of a request the server accepted, with
+// the values it accepted them with (RFC 2347).
+type OACK struct {
+	Options map[string]string
+}
+
+func (p *OACK) Unpack(data []byte) (e error) {
+	return p.unpack(data, OptionLimits{})
+}
+
+func (p *OACK) unpack(data []byte, limits OptionLimits) (e error) {
+	p.Options, e = unpackOptions(bytes.NewBuffer(data[2:]), limits)
+	return e
+}
+
+func (p *OACK) Pack() []byte {
+	buffer := &bytes.Buffer{}
+	binary.Write(buffer, binary.BigEndian, OP_OACK)
+	packOptions(buffer, p.Options)
+	return buffer.Bytes()
+}
+
+// Parse decodes a datagram into one of the packet types of this package
+// (*RRQ, *WRQ, *DATA, *ACK, *ERROR or *OACK). The options of requests and
+// OACKs are bounded by the default OptionLimits.
+func Parse(data []byte) (Packet, error) {
+	return ParseWithLimits(data, OptionLimits{})
+}
+
+// ParseWithLimits is like Parse but bounds the options of requests and
+// OACKs by limits.
+func ParseWithLimits(data []byte, limits OptionLimits) (Packet, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("invalid packet (length = %d)", len(data))
+	}
 	var p Packet
 	opcode := binary.BigEndian.Uint16(data)
 	switch opcode {
@@ -167,9 +358,126 @@ func ParsePacket(data []byte) (*Packet, error) {
 		p = &ACK{}
 	case OP_ERROR:
 		p = &ERROR{}
+	case OP_OACK:
+		p = &OACK{}
 	default:
 		return nil, fmt.Errorf("Unknown packet type: %d", opcode)
 	}
-	pp := Packet(p)
-	return &pp, pp.Unpack(data)
+	switch p := p.(type) {
+	case *RRQ:
+		return p, p.unpack(data, limits)
+	case *WRQ:
+		return p, p.unpack(data, limits)
+	case *OACK:
+		return p, p.unpack(data, limits)
+	}
+	return p, p.Unpack(data)
+}
+
+// ParsePacket is like Parse but returns a pointer to the packet interface.
+// It is kept for compatibility; new code should use Parse.
+func ParsePacket(data []byte) (*Packet, error) {
+	p, e := Parse(data)
+	if p == nil {
+		return nil, e
+	}
+	return &p, e
+}
+
+// Opcode returns the opcode of p, or zero for a type unknown to this package.
+func Opcode(p Packet) uint16 {
+	switch p.(type) {
+	case *RRQ:
+		return OP_RRQ
+	case *WRQ:
+		return OP_WRQ
+	case *DATA:
+		return OP_DATA
+	case *ACK:
+		return OP_ACK
+	case *ERROR:
+		return OP_ERROR
+	case *OACK:
+		return OP_OACK
+	}
+	return 0
+}
+
+// PacketHandlers holds the callbacks Dispatch chooses from. Nil callbacks
+// fall through to Default.
+type PacketHandlers struct {
+	RRQ     func(p *RRQ)
+	WRQ     func(p *WRQ)
+	DATA    func(p *DATA)
+	ACK     func(p *ACK)
+	ERROR   func(p *ERROR)
+	OACK    func(p *OACK)
+	Default func(p Packet)
+}
+
+// Dispatch calls the callback of h matching the type of p, or h.Default if
+// there is none. It is meant for proxies and custom servers that would
+// otherwise type switch on parsed packets themselves.
+func Dispatch(p Packet, h PacketHandlers) {
+	switch p := p.(type) {
+	case *RRQ:
+		if h.RRQ != nil {
+			h.RRQ(p)
+			return
+		}
+	case *WRQ:
+		if h.WRQ != nil {
+			h.WRQ(p)
+			return
+		}
+	case *DATA:
+		if h.DATA != nil {
+			h.DATA(p)
+			return
+		}
+	case *ACK:
+		if h.ACK != nil {
+			h.ACK(p)
+			return
+		}
+	case *ERROR:
+		if h.ERROR != nil {
+			h.ERROR(p)
+			return
+		}
+	case *OACK:
+		if h.OACK != nil {
+			h.OACK(p)
+			return
+		}
+	}
+	if h.Default != nil {
+		h.Default(p)
+	}
+}
+
+// Equal reports whether a and b are packets of the same type with the same
+// contents. It is mainly useful in tests asserting on parsed packets.
+func Equal(a, b Packet) bool {
+	switch a := a.(type) {
+	case *RRQ:
+		b, ok := b.(*RRQ)
+		return ok && a.Filename == b.Filename && a.Mode == b.Mode && optionsEqual(a.Options, b.Options)
+	case *WRQ:
+		b, ok := b.(*WRQ)
+		return ok && a.Filename == b.Filename && a.Mode == b.Mode && optionsEqual(a.Options, b.Options)
+	case *DATA:
+		b, ok := b.(*DATA)
+		return ok && a.BlockNumber == b.BlockNumber && bytes.Equal(a.Data, b.Data)
+	case *ACK:
+		b, ok := b.(*ACK)
+		return ok && *a == *b
+	case *ERROR:
+		b, ok := b.(*ERROR)
+		return ok && *a == *b
+	case *OACK:
+		b, ok := b.(*OACK)
+		return ok && optionsEqual(a.Options, b.Options)
+	}
+	return false
 }
@@ -0,0 +1,96 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// optionList returns a request with n options named o0, o1... whose values
+// are value.
+func optionList(n int, value string) []byte {
+	buffer := bytes.NewBuffer((&RRQ{Filename: "file", Mode: "octet"}).Pack())
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(buffer, "o%d\x00%s\x00", i, value)
+	}
+	return buffer.Bytes()
+}
+
+func TestParseOptionLimits(t *testing.T) {
+	long := string(bytes.Repeat([]byte("x"), 600))
+	for _, c := range []struct {
+		name   string
+		data   []byte
+		limits OptionLimits
+		ok     bool
+	}{
+		{"default count", optionList(DEFAULT_MAX_OPTIONS, "1"), OptionLimits{}, true},
+		{"beyond default count", optionList(DEFAULT_MAX_OPTIONS+1, "1"), OptionLimits{}, false},
+		{"beyond default bytes", optionList(1, long), OptionLimits{}, false},
+		{"raised bytes", optionList(1, long), OptionLimits{MaxBytes: 1024}, true},
+		{"lowered count", optionList(3, "1"), OptionLimits{MaxOptions: 2}, false},
+		{"duplicates count", append(optionList(2, "1"), "o0\x001\x00o0\x001\x00"...), OptionLimits{MaxOptions: 3}, false},
+		{"padding", append(optionList(2, "1"), make([]byte, 1000)...), OptionLimits{MaxOptions: 2}, true},
+	} {
+		p, e := ParseWithLimits(c.data, c.limits)
+		if c.ok && e != nil || !c.ok && !errors.Is(e, ErrOptionLimit) {
+			t.Errorf("%s: %v", c.name, e)
+		}
+		if c.ok && len(p.(*RRQ).Options) == 0 {
+			t.Errorf("%s: no options", c.name)
+		}
+	}
+	oack := append([]byte{0, byte(OP_OACK)}, optionList(DEFAULT_MAX_OPTIONS+1, "1")[2+len("file\x00octet\x00"):]...)
+	if _, e := Parse(oack); !errors.Is(e, ErrOptionLimit) {
+		t.Errorf("OACK beyond the limit: %v", e)
+	}
+}
+
+func TestTooManyOptions(t *testing.T) {
+	called := make(chan struct{}, 1)
+	s := &Server{
+		WriteHandler: func(filename string, w *io.PipeWriter) {
+			called <- struct{}{}
+			w.Close()
+		},
+		MaxOptions: 4,
+	}
+	addr := startTestServer(t, s)
+	c := newRawClient(t, addr)
+	c.conn.WriteToUDP(optionList(5, "1"), addr)
+	c.receiveError(ERR_OPTION_NEGOTIATION)
+	c.conn.WriteToUDP(optionList(4, "1"), addr)
+	c.receiveData(1)
+	select {
+	case <-called:
+	default:
+		t.Error("Handler not called for a request within the limit")
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add(optionList(3, "512"))
+	f.Add(optionList(40, "1"))
+	f.Add((&OACK{Options: map[string]string{"blksize": "1024"}}).Pack())
+	f.Add((&DATA{BlockNumber: 1, Data: []byte("data")}).Pack())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p, e := ParseWithLimits(data, OptionLimits{MaxOptions: 8, MaxBytes: 128})
+		if e != nil {
+			return
+		}
+		var options map[string]string
+		switch p := p.(type) {
+		case *RRQ:
+			options = p.Options
+		case *WRQ:
+			options = p.Options
+		case *OACK:
+			options = p.Options
+		}
+		if len(options) > 8 {
+			t.Errorf("%d options parsed", len(options))
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package tftp
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// DEFAULT_PIPE_BUFFER_BLOCKS is the number of blocks buffered between a
+// transfer and its handler when Server.PipeBufferBlocks is zero.
+const DEFAULT_PIPE_BUFFER_BLOCKS = 4
+
+// readAhead reads the blocks of a download from the handler's pipe in its
+// own goroutine, up to a fixed number of blocks ahead of the sender.
+type readAhead struct {
+	blocks chan aheadBlock
+	free   chan []byte
+	quit   chan struct{}
+	prev   []byte
+	e      error
+}
+
+type aheadBlock struct {
+	data []byte
+	e    error
+}
+
+func newReadAhead(r io.Reader, blockSize, size int) *readAhead {
+	a := &readAhead{
+		blocks: make(chan aheadBlock, size),
+		free:   make(chan []byte, size+1),
+		quit:   make(chan struct{}),
+	}
+	go a.run(r, blockSize)
+	return a
+}
+
+func (a *readAhead) run(r io.Reader, blockSize int) {
+	for {
+		var b []byte
+		select {
+		case b = <-a.free:
+		default:
+			b = make([]byte, blockSize)
+		}
+		n, e := readBlock(r, b)
+		select {
+		case a.blocks <- aheadBlock{b[:n], e}:
+		case <-a.quit:
+			return
+		}
+		if e != nil {
+			return
+		}
+	}
+}
+
+// next returns the next block like readBlock does, recycling the block it
+// returned before.
+func (a *readAhead) next() ([]byte, error) {
+	if a.e != nil {
+		return nil, a.e
+	}
+	if a.prev != nil {
+		select {
+		case a.free <- a.prev[:cap(a.prev)]:
+		default:
+		}
+	}
+	b := <-a.blocks
+	a.prev, a.e = b.data, b.e
+	return b.data, b.e
+}
+
+// stop ends the goroutine once the sender is done with the pipe.
+func (a *readAhead) stop() {
+	close(a.quit)
+}
+
+// writeBehind writes the blocks of an upload to the handler's pipe in its
+// own goroutine, so the receiver can take up to a fixed number of blocks
+// before the handler reads them. A failed write is reported by the next
+// write or flush; the blocks left are discarded.
+type writeBehind struct {
+	blocks chan []byte
+	free   chan []byte
+	done   chan struct{}
+	once   sync.Once
+	mu     sync.Mutex
+	e      error
+}
+
+func newWriteBehind(w *io.PipeWriter, timeout time.Duration, clock clock, size int) *writeBehind {
+	b := &writeBehind{
+		blocks: make(chan []byte, size),
+		free:   make(chan []byte, size+1),
+		done:   make(chan struct{}),
+	}
+	go b.run(w, timeout, clock)
+	return b
+}
+
+func (b *writeBehind) run(w *io.PipeWriter, timeout time.Duration, clock clock) {
+	defer close(b.done)
+	for data := range b.blocks {
+		if b.err() == nil {
+			if e := writePipe(w, data, timeout, clock); e != nil {
+				b.mu.Lock()
+				b.e = e
+				b.mu.Unlock()
+			}
+		}
+		select {
+		case b.free <- data:
+		default:
+		}
+	}
+}
+
+func (b *writeBehind) err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.e
+}
+
+// write queues a copy of data, waiting while the buffer is full.
+func (b *writeBehind) write(data []byte) error {
+	if e := b.err(); e != nil {
+		return e
+	}
+	var block []byte
+	select {
+	case block = <-b.free:
+	default:
+	}
+	b.blocks <- append(block[:0], data...)
+	return nil
+}
+
+// flush waits for the handler to read every block queued.
+func (b *writeBehind) flush() error {
+	b.stop()
+	<-b.done
+	return b.err()
+}
+
+// stop lets the goroutine end once the blocks queued are written.
+func (b *writeBehind) stop() {
+	b.once.Do(func() {
+		close(b.blocks)
+	})
+}
+
+// writePipe writes data to the handler's pipe. A handler that has not taken
+// it within timeout, if positive, e.g. because it is stuck writing to a
+// full disk, gets its pipe closed with errHandlerTimeout instead of
+// stalling the transfer. The timeout runs on clock.
+func writePipe(w *io.PipeWriter, data []byte, timeout time.Duration, clock clock) error {
+	if timeout <= 0 {
+		_, e := w.Write(data)
+		return e
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, e := w.Write(data)
+		done <- e
+	}()
+	timer := clock.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case e := <-done:
+		return e
+	case <-timer.C():
+	}
+	w.CloseWithError(errHandlerTimeout)
+	<-done
+	return errHandlerTimeout
+}
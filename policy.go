@@ -0,0 +1,57 @@
+package tftp
+
+import (
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// filenameAllowed applies DenyPatterns and AllowPatterns to filename. A
+// matching deny pattern always wins; a non-empty allow list admits only the
+// files matching one of its patterns. Malformed patterns never match.
+func (s *Server) filenameAllowed(filename string) bool {
+	if matchAny(s.DenyPatterns, filename) {
+		return false
+	}
+	return len(s.AllowPatterns) == 0 || matchAny(s.AllowPatterns, filename)
+}
+
+// clientAllowed reports whether AllowedClients admits remoteAddr.
+func (s *Server) clientAllowed(remoteAddr *net.UDPAddr) bool {
+	if len(s.AllowedClients) == 0 {
+		return true
+	}
+	for _, network := range s.AllowedClients {
+		if network.Contains(remoteAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, filename string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, filename); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// FileExistsIn returns a Server.FileExists check for uploads stored under
+// dir. The filename is resolved the way LocalPath does it, so the check
+// looks at the same file a handler using LocalPath writes.
+func FileExistsIn(dir string) func(filename string) bool {
+	return func(filename string) bool {
+		_, e := os.Stat(LocalPath(dir, filename))
+		return e == nil
+	}
+}
+
+// LocalPath maps a requested filename to a path under dir. The filename is
+// cleaned as an absolute slash-separated path first, so ".." elements
+// cannot escape dir.
+func LocalPath(dir, filename string) string {
+	return filepath.Join(dir, filepath.FromSlash(path.Clean("/"+filename)))
+}
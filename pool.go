@@ -0,0 +1,103 @@
+package tftp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// poolQuarantine is how long a transmission socket rests in the pool
+// before it is leased again. Packets of the previous transfer still in
+// flight, e.g. retransmissions of a client that missed the last reply,
+// arrive in the meantime and are discarded on lease instead of being
+// mistaken for packets of the next transfer.
+var poolQuarantine = 20 * time.Second
+
+// connPool keeps idle transmission sockets, by network, for reuse by later
+// transfers. Every socket keeps its own local port, so concurrent
+// transfers still have distinct transfer IDs.
+type connPool struct {
+	mu   sync.Mutex
+	idle map[string][]pooledConn
+}
+
+type pooledConn struct {
+	conn     *net.UDPConn
+	returned time.Time
+}
+
+// lease returns an idle socket for network that has passed quarantine, or
+// nil if there is none.
+func (p *connPool) lease(network string) *net.UDPConn {
+	p.mu.Lock()
+	var conn *net.UDPConn
+	conns := p.idle[network]
+	for i, c := range conns {
+		if time.Since(c.returned) >= poolQuarantine {
+			conn = c.conn
+			p.idle[network] = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	p.mu.Unlock()
+	if conn != nil {
+		drainConn(conn)
+	}
+	return conn
+}
+
+// release puts conn back into the pool unless it already holds size idle
+// sockets for network. It reports whether conn was kept.
+func (p *connPool) release(network string, conn *net.UDPConn, size int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle[network]) >= size {
+		return false
+	}
+	if p.idle == nil {
+		p.idle = make(map[string][]pooledConn)
+	}
+	p.idle[network] = append(p.idle[network], pooledConn{conn, time.Now()})
+	return true
+}
+
+// closeAll closes the idle sockets.
+func (p *connPool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conns := range p.idle {
+		for _, c := range conns {
+			c.conn.Close()
+		}
+	}
+	p.idle = nil
+}
+
+// drainConn discards the datagrams queued on conn.
+func drainConn(conn *net.UDPConn) {
+	buffer := make([]byte, MAX_PACKET_SIZE)
+	for {
+		// A deadline already in the past would fail the read before
+		// looking at the queue, so allow it a moment.
+		conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+		if _, _, e := conn.ReadFromUDP(buffer); e != nil {
+			return
+		}
+	}
+}
+
+// pooling reports whether transmission sockets are pooled. Sockets opened
+// by TransmissionConnFunc or for TransmissionPortFunc are chosen per client
+// and never reused.
+func (s *Server) pooling() bool {
+	return s.SocketPoolSize > 0 && s.TransmissionConnFunc == nil && s.TransmissionPortFunc == nil
+}
+
+// closeTransmissionConn returns the socket of a finished transfer with
+// remoteAddr to the pool, or closes it.
+func (s *Server) closeTransmissionConn(conn *net.UDPConn, remoteAddr *net.UDPAddr) {
+	if s.pooling() && s.pool.release(transmissionNetwork(remoteAddr), conn, s.SocketPoolSize) {
+		return
+	}
+	conn.Close()
+}
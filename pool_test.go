@@ -0,0 +1,72 @@
+package tftp
+
+import (
+	"testing"
+	"time"
+)
+
+// pooledDownloads runs n downloads through a server that pools one socket
+// and returns the server ports that served them.
+func pooledDownloads(t *testing.T, n int) []int {
+	done := make(chan struct{}, 1)
+	s := &Server{
+		WriteHandler:       serveBytes([]byte("content")),
+		SocketPoolSize:     1,
+		OnTransferComplete: func(TransferResult) { done <- struct{}{} },
+	}
+	addr := startTestServer(t, s)
+	var ports []int
+	for i := 0; i < n; i++ {
+		c := newRawClient(t, addr)
+		c.send(&RRQ{Filename: "file", Mode: "octet"}, nil)
+		_, from := c.receiveData(1)
+		c.send(&ACK{BlockNumber: 1}, from)
+		ports = append(ports, from.Port)
+		// The socket is back in the pool once the transfer has completed.
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Transfer did not complete")
+		}
+	}
+	return ports
+}
+
+func TestSocketPoolReuse(t *testing.T) {
+	defer func(d time.Duration) { poolQuarantine = d }(poolQuarantine)
+	poolQuarantine = 0
+	ports := pooledDownloads(t, 3)
+	if ports[0] != ports[1] || ports[1] != ports[2] {
+		t.Errorf("Transfers used ports %v, want one pooled socket", ports)
+	}
+}
+
+func TestSocketPoolQuarantine(t *testing.T) {
+	ports := pooledDownloads(t, 2)
+	if ports[0] == ports[1] {
+		t.Errorf("Socket of port %d leased again during quarantine", ports[0])
+	}
+}
+
+func BenchmarkTransmissionSockets(b *testing.B) {
+	defer func(d time.Duration) { poolQuarantine = d }(poolQuarantine)
+	poolQuarantine = 0
+	for _, bench := range []struct {
+		name string
+		pool int
+	}{
+		{"PerTransfer", 0},
+		{"Pooled", 8},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			s := &Server{WriteHandler: serveBytes([]byte("content")), SocketPoolSize: bench.pool}
+			addr := startTestServer(b, s)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, e := download(b, addr, "file"); e != nil {
+					b.Fatal(e)
+				}
+			}
+		})
+	}
+}
@@ -3,105 +3,464 @@ package tftp
 import (
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
 type receiver struct {
 	remoteAddr *net.UDPAddr
-	conn       *net.UDPConn
+	conn       packetConn
 	writer     *io.PipeWriter
 	filename   string
 	mode       string
-	log        *log.Logger
+	log        *transferLog
+	cancel     <-chan struct{}
+	// windowSize is the number of DATA blocks the peer sends before
+	// expecting an ACK (RFC 7440). Zero or one means lockstep transfer.
+	windowSize int
+	summary    bool
+	bytes      int64
+	// blockSize is the size of a full DATA block, BLOCK_SIZE if zero.
+	blockSize int
+	// wrapTo is the block number following 65535.
+	wrapTo uint16
+	// maxBytes, if positive, caps the number of bytes accepted from the
+	// peer regardless of what it announced.
+	maxBytes int64
+	// handshake, if set, is sent by the server in place of ACK #0. It is
+	// only retransmitted while block 1 is awaited, and block 1 is accepted
+	// even if the peer never acknowledged it.
+	handshake Packet
+	// jitter is the fraction by which retransmission timeouts are
+	// randomly varied.
+	jitter float64
+	// errorMessage, if set, chooses the text of the ERROR packets sent.
+	errorMessage func(code uint16, e error) string
+	// backoff, if set, returns the timeout of each transmission attempt.
+	backoff func(attempt int) time.Duration
+	// total, if set, accumulates the bytes received across transfers.
+	total *atomic.Int64
+	// adoptPort makes the transfer follow a peer whose port changes.
+	adoptPort bool
+	// retransmits, if set, counts the packets sent again across transfers.
+	retransmits *atomic.Int64
+	// rate aborts transfers below the minimum throughput.
+	rate rateMonitor
+	// handlerTimeout, if positive, is how long the handler may take to
+	// accept a block from its pipe.
+	handlerTimeout time.Duration
+	// openSink, if set, opens the writer the blocks are written to instead
+	// of the pipe.
+	openSink func() (io.Writer, error)
+	sink     io.Writer
+	// idle bounds the retransmissions of each ACK.
+	idle idleClock
+	// transform, if set, replaces each block before it is written to the
+	// pipe.
+	transform func(block []byte, blockNum uint16, direction Direction) ([]byte, error)
+	// buffer, if positive, is the number of blocks buffered for the
+	// handler in behind.
+	buffer int
+	behind *writeBehind
+	// clock, if set, replaces the real clock.
+	clock clock
+	// timeout, if positive, is the retransmission interval negotiated
+	// with the timeout option, the base of backoff instead of the default.
+	timeout time.Duration
+	// requested are the options of the client's request, which an OACK
+	// answering it is checked against.
+	requested map[string]string
+	// onTransferSize, if set, gets the size of the file an OACK answering
+	// the client's tsize reports.
+	onTransferSize func(size int64)
+	// onCompress, if set, is called when an OACK accepts compression,
+	// before any data is written.
+	onCompress func()
+	// rejectDowngrade aborts a transfer whose first block shows the peer
+	// ignored the negotiated block size. Otherwise the transfer goes on
+	// with blocks of BLOCK_SIZE.
+	rejectDowngrade bool
+
+	// opening is the packet sent while the first block is awaited: the
+	// RRQ on the client, handshake or nil (for ACK #0) on the server.
+	opening  Packet
+	isClient bool
 }
 
 func (r *receiver) Run(isServerMode bool) error {
-	var blockNumber uint16
+	started := time.Now()
+	e := r.run(isServerMode)
+	if c, ok := r.sink.(io.Closer); ok && e != nil {
+		c.Close()
+	}
+	if r.behind != nil {
+		r.behind.stop()
+	}
+	if r.summary {
+		direction := DirectionWrite
+		if !isServerMode {
+			direction = DirectionRead
+		}
+		logSummary(r.log, r.filename, direction, r.bytes, started, e)
+	}
+	return e
+}
+
+func (r *receiver) run(isServerMode bool) error {
+	var blockNumber, prevBlock uint16
 	blockNumber = 1
 	var buffer []byte
-	buffer = make([]byte, MAX_DATAGRAM_SIZE)
-	firstBlock := true
+	if r.blockSize == 0 {
+		r.blockSize = BLOCK_SIZE
+	}
+	r.isClient = !isServerMode
+	// One byte beyond a full DATA packet lets oversized blocks be told
+	// apart from full ones instead of being silently truncated. The client
+	// learns the block size from the OACK, which may lower the blksize
+	// requested but not raise it. The server leaves room for a block of
+	// BLOCK_SIZE from a client that ignored a smaller blksize.
+	size := r.blockSize
+	if n := requestedBlockSize(r.requested); r.isClient && n > size {
+		size = n
+	}
+	if size < BLOCK_SIZE {
+		size = BLOCK_SIZE
+	}
+	buffer = make([]byte, size+5)
+	r.clock = orRealClock(r.clock)
+	r.idle.clock, r.rate.clock = r.clock, r.clock
+	r.idle.advance()
+	if r.isClient {
+		r.opening = &RRQ{Filename: r.filename, Mode: r.mode, Options: r.requested}
+	} else {
+		r.opening = r.handshake
+	}
+	if r.openSink != nil {
+		var e error
+		if r.sink, e = r.openSink(); e != nil {
+			r.log.Errorf("Handler error: %v", e)
+			sendErrorPacket(r.conn, r.log, r.remoteAddr, handlerErrorCode(e), e, r.errorMessage)
+			r.writer.CloseWithError(e)
+			return &handlerError{e}
+		}
+	}
+	if r.sink == nil && r.buffer > 0 {
+		r.behind = newWriteBehind(r.writer, r.handlerTimeout, r.clock, r.buffer)
+	}
+	// sinceAck counts blocks received since the last ACK was sent; only the
+	// last block of each window is acknowledged.
+	sinceAck := 0
 	for {
-		last, e := r.receiveBlock(buffer, blockNumber, firstBlock && !isServerMode)
+		last, acked, e := r.receiveBlock(buffer, blockNumber, prevBlock, sinceAck == 0)
 		if e != nil {
-			if r.log != nil {
-				r.log.Printf("Error receiving block %d: %v", blockNumber, e)
+			r.log.Errorf("Error receiving block %d: %v", blockNumber, e)
+			if e == errAborted {
+				r.abort()
 			}
 			r.writer.CloseWithError(e)
 			return e
 		}
-		firstBlock = false
+		r.opening = nil
 		if last {
 			break
 		}
-		blockNumber++
+		if !r.rate.ok(r.bytes) {
+			r.log.Errorf("Aborting transfer below minimum throughput")
+			sendErrorPacket(r.conn, r.log, r.remoteAddr, ERR_UNDEFINED, errTooSlow, r.errorMessage)
+			r.writer.CloseWithError(errTooSlow)
+			return errTooSlow
+		}
+		if acked {
+			sinceAck = 0
+		}
+		sinceAck++
+		if sinceAck >= r.window() {
+			sinceAck = 0
+		}
+		prevBlock = blockNumber
+		blockNumber = nextBlock(blockNumber, r.wrapTo)
+	}
+	if r.behind != nil {
+		if e := r.behind.flush(); e != nil {
+			r.log.Errorf("Handler error: %v", e)
+			e = r.writeFailed(e)
+			if e == errAborted {
+				r.abort()
+			}
+			r.writer.CloseWithError(e)
+			return e
+		}
+	}
+	if e := r.commit(); e != nil {
+		// The client must not take the upload for stored.
+		r.log.Errorf("Handler error: %v", e)
+		sendErrorPacket(r.conn, r.log, r.remoteAddr, handlerErrorCode(e), e, r.errorMessage)
+		r.writer.CloseWithError(e)
+		return &handlerError{e}
 	}
 	r.writer.Close()
 	r.terminate(buffer, blockNumber, false)
 	return nil
 }
 
-func (r *receiver) receiveBlock(b []byte, n uint16, firstBlockOnClient bool) (last bool, e error) {
-	for i := 0; i < 3; i++ {
-		if firstBlockOnClient {
-			rrqPacket := RRQ{r.filename, r.mode}
-			r.conn.WriteToUDP(rrqPacket.Pack(), r.remoteAddr)
-			r.log.Printf("sent RRQ (filename=%s, mode=%s)", r.filename, r.mode)
-		} else {
-			ackPacket := ACK{n - 1}
-			r.conn.WriteToUDP(ackPacket.Pack(), r.remoteAddr)
-			r.log.Printf("sent ACK #%d", n-1)
-		}
-		setDeadlineError := r.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+// commit makes the data written to the sink durable before the final ACK
+// reports success: the sink is flushed and synced if it supports that,
+// then closed if it is an io.Closer.
+func (r *receiver) commit() error {
+	if r.sink == nil {
+		return nil
+	}
+	if f, ok := r.sink.(interface{ Flush() error }); ok {
+		if e := f.Flush(); e != nil {
+			return e
+		}
+	}
+	if f, ok := r.sink.(interface{ Sync() error }); ok {
+		if e := f.Sync(); e != nil {
+			return e
+		}
+	}
+	if c, ok := r.sink.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// receiveBlock waits for DATA block n. When ack is set the ACK of the
+// previous block prev (or the opening packet, for the first block) is
+// sent before waiting; it is always resent on timeout. Within a window, a
+// block arriving ahead of n means block n was lost, so prev is ACKed once
+// to make the peer restart the window from n. acked reports whether an ACK
+// of prev was sent, which restarts the window count.
+func (r *receiver) receiveBlock(b []byte, n, prev uint16, ack bool) (last bool, acked bool, e error) {
+attempts:
+	for i := 0; r.idle.retry(i); i++ {
+		if ack || i > 0 {
+			r.sendAck(prev)
+			acked = true
+		}
+		if i > 0 {
+			r.retransmitted()
+		}
+		setDeadlineError := setReadDeadline(r.conn, r.clock, r.cancel, r.idle.wait(jittered(r.retransmitInterval(i), r.jitter)))
 		if setDeadlineError != nil {
-			return false, fmt.Errorf("Could not set UDP timeout: %v", setDeadlineError)
+			return false, acked, setDeadlineError
 		}
+		gapAcked := false
 		for {
 			c, remoteAddr, readError := r.conn.ReadFromUDP(b)
 			if networkError, ok := readError.(net.Error); ok && networkError.Timeout() {
+				if aborted(r.cancel) {
+					return false, acked, errAborted
+				}
 				break
-			} else if e != nil {
-				return false, fmt.Errorf("Error reading UDP packet: %v", e)
+			} else if readError != nil {
+				return false, acked, readFailed(readError)
 			}
-			packet, e := ParsePacket(b[:c])
+			// The client learns the server's transfer ID from the first
+			// block; from then on the peer is known.
+			if !r.isClient || r.opening == nil {
+				var ok bool
+				if r.remoteAddr, ok = acceptPeer(r.conn, r.log, r.remoteAddr, remoteAddr, r.adoptPort, r.errorMessage); !ok {
+					continue
+				}
+			}
+			packet, e := Parse(b[:c])
 			if e != nil {
 				continue
 			}
-			switch p := Packet(*packet).(type) {
+			switch p := packet.(type) {
 			case *DATA:
-				r.log.Printf("got DATA #%d (%d bytes)", p.BlockNumber, len(p.Data))
+				r.log.Debugf("got DATA #%d (%d bytes)", p.BlockNumber, len(p.Data))
+				if n == p.BlockNumber && r.downgraded(n, len(p.Data)) {
+					r.log.Infof("DATA #1 has %d bytes with blksize %d negotiated: the peer ignored the OACK", len(p.Data), r.blockSize)
+					if r.rejectDowngrade {
+						sendErrorPacket(r.conn, r.log, remoteAddr, ERR_OPTION_NEGOTIATION, errDowngrade, r.errorMessage)
+						return false, acked, errDowngrade
+					}
+					// The OACK is still unacknowledged, so the peer fell
+					// back to RFC 1350: go on with its block size rather
+					// than take the full block for the last.
+					if r.opening != nil {
+						r.blockSize, r.windowSize = BLOCK_SIZE, 1
+					}
+				}
+				// A block shorter than blockSize always ends the transfer,
+				// so only blocks larger than it can be malformed.
+				if len(p.Data) > r.blockSize {
+					sendErrorPacket(r.conn, r.log, remoteAddr, ERR_ILLEGAL_OP, errBlockTooLarge, r.errorMessage)
+					return false, acked, errBlockTooLarge
+				}
 				if n == p.BlockNumber {
-					if firstBlockOnClient {
+					if r.isClient && r.opening != nil {
 						r.remoteAddr = remoteAddr
 					}
-					_, e := r.writer.Write(p.Data)
-					if e == nil {
-						return len(p.Data) < BLOCK_SIZE, nil
-					} else {
-						errorPacket := ERROR{1, e.Error()}
-						r.conn.WriteToUDP(errorPacket.Pack(), r.remoteAddr)
-						return false, fmt.Errorf("Handler error: %v", e)
+					if r.maxBytes > 0 && r.bytes+int64(len(p.Data)) > r.maxBytes {
+						sendErrorPacket(r.conn, r.log, r.remoteAddr, ERR_DISK_FULL, errFileTooLarge, r.errorMessage)
+						return false, acked, errFileTooLarge
 					}
+					// An empty final block, as for an empty file, has nothing
+					// to hand to the handler.
+					data := p.Data
+					if r.transform != nil {
+						var e error
+						if data, e = r.transformBlock(data, n); e != nil {
+							sendErrorPacket(r.conn, r.log, r.remoteAddr, ERR_UNDEFINED, e, r.errorMessage)
+							return false, acked, e
+						}
+					}
+					var e error
+					if len(data) > 0 {
+						e = r.write(data)
+					}
+					if e != nil {
+						return false, acked, r.writeFailed(e)
+					}
+					r.count(len(p.Data))
+					r.idle.advance()
+					return len(p.Data) < r.blockSize, acked, nil
+				}
+				if !gapAcked && r.opening == nil && r.inWindow(p.BlockNumber, n) {
+					r.sendAck(prev)
+					acked = true
+					gapAcked = true
+				}
+			case *OACK:
+				// The server accepted options of the client's request.
+				// It waits for ACK #0 before sending block 1.
+				if !r.isClient || r.opening == nil {
+					continue
+				}
+				r.log.Debugf("got OACK %v", p.Options)
+				r.remoteAddr = remoteAddr
+				options, e := acceptOACK(r.requested, p.Options)
+				if e != nil {
+					sendErrorPacket(r.conn, r.log, r.remoteAddr, ERR_OPTION_NEGOTIATION, e, r.errorMessage)
+					return false, acked, e
 				}
+				r.windowSize = options.windowSize
+				if options.blockSize > 0 {
+					r.blockSize = options.blockSize
+				}
+				if options.timeout > 0 {
+					r.timeout = options.timeout
+				}
+				if options.transferSize && r.onTransferSize != nil {
+					r.onTransferSize(options.size)
+				}
+				if options.compress && r.onCompress != nil {
+					r.onCompress()
+				}
+				r.opening = nil
+				r.idle.advance()
+				ack, i = true, -1
+				continue attempts
 			case *ERROR:
-				return false, fmt.Errorf("Transmission error %d: %s", p.ErrorCode, p.ErrorMessage)
+				return false, acked, &PeerError{p.ErrorCode, p.ErrorMessage}
 			}
 		}
 	}
-	return false, fmt.Errorf("Receive timeout")
+	return false, acked, errReceiveTimeout
+}
+
+// downgraded reports whether block n of size bytes, the first of the
+// transfer, is a full block of BLOCK_SIZE although another block size was
+// negotiated: the peer carries on as if its options had been ignored.
+func (r *receiver) downgraded(n uint16, size int) bool {
+	return n == 1 && r.bytes == 0 && size == BLOCK_SIZE && r.blockSize != BLOCK_SIZE
+}
+
+// retransmitInterval returns how long attempt i waits for a block.
+func (r *receiver) retransmitInterval(i int) time.Duration {
+	base := 5 * time.Second
+	if r.timeout > 0 {
+		base = r.timeout
+	}
+	return retransmitTimeout(r.backoff, i, base, r.timeout > 0)
+}
+
+// transformBlock applies transform to block n. The end of the transfer
+// is told from the size of the block received, so the result may have any
+// size.
+func (r *receiver) transformBlock(block []byte, n uint16) ([]byte, error) {
+	direction := DirectionWrite
+	if r.isClient {
+		direction = DirectionRead
+	}
+	block, e := r.transform(block, n, direction)
+	if e != nil {
+		return nil, fmt.Errorf("%w: %v", errBlockTransform, e)
+	}
+	return block, nil
+}
+
+// write hands data to the handler, through behind if the pipe is
+// buffered. A sink is written directly, without the handler timeout.
+func (r *receiver) write(data []byte) error {
+	if r.sink != nil {
+		_, e := r.sink.Write(data)
+		return e
+	}
+	if r.behind != nil {
+		return r.behind.write(data)
+	}
+	return writePipe(r.writer, data, r.handlerTimeout, r.clock)
+}
+
+// writeFailed reports the error e writing to the handler to the peer,
+// unless the transfer was aborted, and returns the error the transfer
+// fails with.
+func (r *receiver) writeFailed(e error) error {
+	if aborted(r.cancel) {
+		return errAborted
+	}
+	if e == errHandlerTimeout {
+		sendErrorPacket(r.conn, r.log, r.remoteAddr, ERR_DISK_FULL, e, r.errorMessage)
+		return e
+	}
+	sendErrorPacket(r.conn, r.log, r.remoteAddr, handlerErrorCode(e), e, r.errorMessage)
+	return &handlerError{e}
+}
+
+// sendAck acknowledges block n, or sends the opening packet while the
+// first block is awaited.
+func (r *receiver) sendAck(n uint16) {
+	if r.opening != nil {
+		r.conn.WriteToUDP(r.opening.Pack(), r.remoteAddr)
+		logSent(r.log, r.opening)
+	} else {
+		ackPacket := ACK{n}
+		r.conn.WriteToUDP(ackPacket.Pack(), r.remoteAddr)
+		r.log.Debugf("sent ACK #%d", n)
+	}
+}
+
+// window returns the number of blocks the peer sends per ACK, which an
+// OACK may change once the transfer started.
+func (r *receiver) window() int {
+	if r.windowSize < 1 {
+		return 1
+	}
+	return r.windowSize
+}
+
+// inWindow reports whether block is ahead of the expected block n but still
+// part of the window the peer is sending.
+func (r *receiver) inWindow(block, n uint16) bool {
+	d := block - n
+	return d != 0 && int(d) < r.windowSize
 }
 
 func (r *receiver) terminate(b []byte, n uint16, dallying bool) (e error) {
 	for i := 0; i < 3; i++ {
 		ackPacket := ACK{n}
 		_, e := r.conn.WriteToUDP(ackPacket.Pack(), r.remoteAddr)
-		r.log.Printf("sent ACK #%d", n)
+		r.log.Debugf("sent ACK #%d", n)
 		if !dallying {
 			return e
 		}
-		setDeadlineError := r.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		setDeadlineError := r.conn.SetReadDeadline(r.clock.Now().Add(r.retransmitInterval(0)))
 		if setDeadlineError != nil {
 			return fmt.Errorf("Could not set UDP timeout: %v", setDeadlineError)
 		}
@@ -110,23 +469,43 @@ func (r *receiver) terminate(b []byte, n uint16, dallying bool) (e error) {
 			c, _, readError := r.conn.ReadFromUDP(b)
 			if networkError, ok := readError.(net.Error); ok && networkError.Timeout() {
 				return nil
-			} else if e != nil {
-				return fmt.Errorf("Error reading UDP packet: %v", e)
+			} else if readError != nil {
+				return readFailed(readError)
 			}
-			packet, e := ParsePacket(b[:c])
+			packet, e := Parse(b[:c])
 			if e != nil {
 				continue
 			}
-			switch p := Packet(*packet).(type) {
+			switch p := packet.(type) {
 			case *DATA:
-				r.log.Printf("got DATA #%d (%d bytes)", p.BlockNumber, len(p.Data))
+				r.log.Debugf("got DATA #%d (%d bytes)", p.BlockNumber, len(p.Data))
 				if n == p.BlockNumber {
 					break l1
 				}
 			case *ERROR:
-				fmt.Errorf("Transmission error %d: %s", p.ErrorCode, p.ErrorMessage)
+				return &PeerError{p.ErrorCode, p.ErrorMessage}
 			}
 		}
 	}
 	return fmt.Errorf("Termination error")
 }
+
+// count records n more bytes received.
+func (r *receiver) count(n int) {
+	r.bytes += int64(n)
+	if r.total != nil {
+		r.total.Add(int64(n))
+	}
+}
+
+// retransmitted records a packet sent again.
+func (r *receiver) retransmitted() {
+	if r.retransmits != nil {
+		r.retransmits.Add(1)
+	}
+}
+
+// abort tells the client that the server gave up on the transfer.
+func (r *receiver) abort() {
+	sendErrorPacket(r.conn, r.log, r.remoteAddr, ERR_UNDEFINED, errAborted, r.errorMessage)
+}
@@ -0,0 +1,241 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReceiverIdleTimeout(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	var acks []time.Duration
+	conn.clock = clock
+	conn.onWrite = func(c *memConn, data []byte, addr *net.UDPAddr) {
+		if p, _ := Parse(data); Opcode(p) == OP_ACK {
+			acks = append(acks, clock.Now().Sub(time.Unix(0, 0)))
+		}
+	}
+	r, _ := newTestReceiver(conn, clock)
+	r.idle.timeout = 12 * time.Second
+	if e := runTransfer(t, clock, conn, func() error { return r.Run(true) }); e != errReceiveTimeout {
+		t.Fatalf("Error %v, want %v", e, errReceiveTimeout)
+	}
+	if want := []time.Duration{0, 5 * time.Second, 10 * time.Second}; !equalDurations(acks, want) {
+		t.Errorf("ACK #0 sent at %v, want %v", acks, want)
+	}
+	if elapsed := clock.Now().Sub(time.Unix(0, 0)); elapsed != 12*time.Second {
+		t.Errorf("Gave up after %v", elapsed)
+	}
+}
+
+func TestReceiverHandlerTimeout(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	conn.clock, conn.onWrite = clock, sendBlocks([]byte("content"), BLOCK_SIZE)
+	// The handler never reads its pipe.
+	_, w := io.Pipe()
+	r := &receiver{remoteAddr: testPeerAddr, conn: conn, writer: w, clock: clock, handlerTimeout: 30 * time.Second}
+	if e := runTransfer(t, clock, conn, func() error { return r.Run(true) }); e != errHandlerTimeout {
+		t.Fatalf("Error %v, want %v", e, errHandlerTimeout)
+	}
+	if elapsed := clock.Now().Sub(time.Unix(0, 0)); elapsed != 30*time.Second {
+		t.Errorf("Gave up after %v", elapsed)
+	}
+	if codes := errorsTo(conn, testPeerAddr); !equalBlocks(codes, []uint16{ERR_DISK_FULL}) {
+		t.Errorf("ERROR codes %v", codes)
+	}
+}
+
+func TestReceiverOversizedBlock(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	conn.clock = clock
+	conn.onWrite = func(c *memConn, data []byte, addr *net.UDPAddr) {
+		if p, _ := Parse(data); Equal(p, &ACK{BlockNumber: 0}) {
+			c.deliver((&DATA{BlockNumber: 1, Data: make([]byte, BLOCK_SIZE+1)}).Pack(), addr)
+		}
+	}
+	r, received := newTestReceiver(conn, clock)
+	if e := runTransfer(t, clock, conn, func() error { return r.Run(true) }); e != errBlockTooLarge {
+		t.Fatalf("Error %v, want %v", e, errBlockTooLarge)
+	}
+	if codes := errorsTo(conn, testPeerAddr); !equalBlocks(codes, []uint16{ERR_ILLEGAL_OP}) {
+		t.Errorf("ERROR codes %v", codes)
+	}
+	if data := <-received; len(data) != 0 {
+		t.Errorf("Handler got %d bytes", len(data))
+	}
+}
+
+func TestReceiverShortBlockEnds(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	conn.clock = clock
+	conn.onWrite = func(c *memConn, data []byte, addr *net.UDPAddr) {
+		if p, _ := Parse(data); Equal(p, &ACK{BlockNumber: 0}) {
+			// A short block followed by a full one: the short one is the
+			// last, whatever comes after it.
+			c.deliver((&DATA{BlockNumber: 1, Data: []byte("short")}).Pack(), addr)
+			c.deliver((&DATA{BlockNumber: 2, Data: make([]byte, BLOCK_SIZE)}).Pack(), addr)
+		}
+	}
+	r, received := newTestReceiver(conn, clock)
+	if e := runTransfer(t, clock, conn, func() error { return r.Run(true) }); e != nil {
+		t.Fatal(e)
+	}
+	if data := <-received; string(data) != "short" {
+		t.Errorf("Handler got %q", data)
+	}
+	if last := conn.written()[len(conn.written())-1]; !bytes.Equal(last.data, (&ACK{BlockNumber: 1}).Pack()) {
+		t.Errorf("Last packet %v, want ACK #1", last.data)
+	}
+}
+
+// committingSink records the calls the receiver makes to it, and the
+// ACKs sent, in events.
+type committingSink struct {
+	events  *[]string
+	syncErr error
+}
+
+func (s committingSink) Write(b []byte) (int, error) {
+	*s.events = append(*s.events, "write")
+	return len(b), nil
+}
+
+func (s committingSink) Flush() error {
+	*s.events = append(*s.events, "flush")
+	return nil
+}
+
+func (s committingSink) Sync() error {
+	*s.events = append(*s.events, "sync")
+	return s.syncErr
+}
+
+func (s committingSink) Close() error {
+	*s.events = append(*s.events, "close")
+	return nil
+}
+
+// runSinkUpload uploads a two-block file into sink and returns the conn of
+// the receiver and its error.
+func runSinkUpload(t *testing.T, sink committingSink) (*memConn, error) {
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	conn.clock = clock
+	peer := sendBlocks(bytes.Repeat([]byte("x"), BLOCK_SIZE+10), BLOCK_SIZE)
+	conn.onWrite = func(c *memConn, data []byte, addr *net.UDPAddr) {
+		if p, _ := Parse(data); Opcode(p) == OP_ACK {
+			*sink.events = append(*sink.events, fmt.Sprintf("ACK #%d", p.(*ACK).BlockNumber))
+		}
+		peer(c, data, addr)
+	}
+	r, _ := newTestReceiver(conn, clock)
+	r.openSink = func() (io.Writer, error) { return sink, nil }
+	return conn, runTransfer(t, clock, conn, func() error { return r.Run(true) })
+}
+
+func TestReceiverCommitsBeforeFinalACK(t *testing.T) {
+	var events []string
+	if _, e := runSinkUpload(t, committingSink{events: &events}); e != nil {
+		t.Fatal(e)
+	}
+	want := []string{"ACK #0", "write", "ACK #1", "write", "flush", "sync", "close", "ACK #2"}
+	if strings.Join(events, ", ") != strings.Join(want, ", ") {
+		t.Errorf("Events %v, want %v", events, want)
+	}
+}
+
+func TestReceiverSyncFails(t *testing.T) {
+	var events []string
+	syncErr := errors.New("disk failed")
+	conn, e := runSinkUpload(t, committingSink{events: &events, syncErr: syncErr})
+	if !errors.Is(e, syncErr) {
+		t.Fatalf("Error %v, want %v", e, syncErr)
+	}
+	for _, event := range events {
+		if event == "ACK #2" {
+			t.Error("Final ACK sent despite the failed sync")
+		}
+	}
+	if codes := errorsTo(conn, testPeerAddr); len(codes) != 1 {
+		t.Errorf("ERROR codes to the peer %v", codes)
+	}
+}
+
+// linesLog is a Logger collecting the lines written to it.
+type linesLog struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *linesLog) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *linesLog) contains(s string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range l.lines {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReceiverDowngrade(t *testing.T) {
+	content := append(bytes.Repeat([]byte("0123456789abcdef"), BLOCK_SIZE/8), "end"...)
+	for _, reject := range []bool{false, true} {
+		clock := newFakeClock(time.Unix(0, 0))
+		conn := newMemConn(testLocalAddr)
+		conn.clock = clock
+		upload := sendBlocks(content, BLOCK_SIZE)
+		conn.onWrite = func(c *memConn, data []byte, addr *net.UDPAddr) {
+			// The client takes the OACK for an ACK #0 of a plain transfer.
+			if p, _ := Parse(data); Opcode(p) == OP_OACK {
+				c.deliver((&DATA{BlockNumber: 1, Data: content[:BLOCK_SIZE]}).Pack(), addr)
+			}
+			upload(c, data, addr)
+		}
+		r, received := newTestReceiver(conn, clock)
+		l := &linesLog{}
+		r.log = newTransferLog(l, LogInfo)
+		r.handshake = &OACK{Options: map[string]string{optionBlockSize: "1024", optionWindowSize: "4"}}
+		r.blockSize, r.windowSize, r.rejectDowngrade = 1024, 4, reject
+		e := runTransfer(t, clock, conn, func() error { return r.Run(true) })
+		if !l.contains("ignored the OACK") {
+			t.Errorf("Reject %v: downgrade not logged: %q", reject, l.lines)
+		}
+		data := <-received
+		if !reject {
+			// The transfer goes on with blocks of BLOCK_SIZE, each ACKed.
+			if e != nil || !bytes.Equal(data, content) {
+				t.Errorf("Received %d bytes, %v, want %d", len(data), e, len(content))
+			}
+			if acks := acksTo(conn); !equalBlocks(acks, []uint16{1, 2, 3}) {
+				t.Errorf("ACKs %v", acks)
+			}
+			continue
+		}
+		if e != errDowngrade {
+			t.Errorf("Error %v, want %v", e, errDowngrade)
+		}
+		if codes := errorsTo(conn, testPeerAddr); !equalBlocks(codes, []uint16{ERR_OPTION_NEGOTIATION}) {
+			t.Errorf("ERROR codes %v", codes)
+		}
+		if len(data) != 0 {
+			t.Errorf("Handler got %d bytes", len(data))
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package tftp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"runtime/debug"
+)
+
+/*
+Request describes a read or write request. It is passed to
+ReadRequestHandler and WriteRequestHandler, which can use it to serve
+content depending on the client, e.g. a bootloader matching the client
+architecture recorded by the DHCP server:
+
+	s.WriteRequestHandler = func(req *tftp.Request, w *io.PipeWriter) {
+		name := req.Filename
+		if name == "bootloader" && leases.Arch(req.RemoteAddr.IP) == "x86_64-efi" {
+			name = "efi/bootx64.efi"
+		}
+		serveFile(name, w)
+	}
+*/
+type Request struct {
+	Filename   string
+	Mode       string
+	RemoteAddr *net.UDPAddr
+	// LocalAddr is the address of the socket the request arrived on.
+	LocalAddr *net.UDPAddr
+	// InterfaceIndex is the index of the network interface the request
+	// arrived on if Server.RecordInterface is set, 0 otherwise.
+	InterfaceIndex int
+	// Packet is the parsed *RRQ or *WRQ.
+	Packet Packet
+	// Raw holds the request datagram as received.
+	Raw []byte
+
+	ctx context.Context
+}
+
+func newRequest(conn *net.UDPConn, buffer []byte, remoteAddr *net.UDPAddr, ifIndex int, p Packet, filename, mode string) *Request {
+	raw := make([]byte, len(buffer))
+	copy(raw, buffer)
+	localAddr, _ := conn.LocalAddr().(*net.UDPAddr)
+	return &Request{
+		Filename:       filename,
+		Mode:           mode,
+		RemoteAddr:     remoteAddr,
+		LocalAddr:      localAddr,
+		InterfaceIndex: ifIndex,
+		Packet:         p,
+		Raw:            raw,
+	}
+}
+
+// Context returns the context of the transfer, which is cancelled when the
+// transfer ends and carries the values Server.ContextFunc attached.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx,
+// for middleware wrapping a handler to pass values on. ctx must not be nil.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+// transferContext gives req, which starts a transfer, a context that the
+// returned function cancels.
+func (s *Server) transferContext(req *Request) context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+	req.ctx = ctx
+	if s.ContextFunc != nil {
+		req.ctx = s.ContextFunc(ctx, req)
+	}
+	return cancel
+}
+
+// readHandler returns the handler receiving uploads, or nil if uploads are
+// not supported.
+func (s *Server) readHandler() func(req *Request, r *io.PipeReader) {
+	if s.ReadRequestHandler != nil {
+		return s.ReadRequestHandler
+	}
+	if h := s.ReadHandler; h != nil {
+		return func(req *Request, r *io.PipeReader) {
+			h(req.Filename, r)
+		}
+	}
+	return nil
+}
+
+// writeHandler returns the handler producing downloads through a pipe, or
+// nil if there is none.
+func (s *Server) writeHandler() func(req *Request, w *io.PipeWriter) {
+	if s.WriteRequestHandler != nil {
+		return s.WriteRequestHandler
+	}
+	if h := s.WriteHandler; h != nil {
+		return func(req *Request, w *io.PipeWriter) {
+			h(req.Filename, w)
+		}
+	}
+	return nil
+}
+
+// BlockReader is a download source producing the file block by block, e.g.
+// for generated or paginated content that is not worth producing up front.
+// See Server.BlockFunc.
+type BlockReader interface {
+	// ReadBlock returns the data of block n, numbered from 1 as on the
+	// wire, and whether it is the last block. Every block but the last
+	// must be exactly BLOCK_SIZE bytes, as the blksize option is not
+	// negotiated for these downloads; the last may be shorter, down to
+	// empty. Blocks are read in order, once each. Block numbers wrap
+	// after 65535 like on the wire, so sources of larger files have to
+	// count the blocks themselves.
+	ReadBlock(n uint16) (data []byte, last bool, e error)
+}
+
+// handlerPanic is the error the pipe of a panicking handler is closed with.
+type handlerPanic struct {
+	value interface{}
+}
+
+func (e *handlerPanic) Error() string {
+	return fmt.Sprintf("Handler panic: %v", e.value)
+}
+
+func (s *Server) callReadHandler(h func(req *Request, r *io.PipeReader), req *Request, r *io.PipeReader, l *transferLog) {
+	defer func() {
+		if v := recover(); v != nil {
+			s.handlerPanicked(req, v, l)
+			r.CloseWithError(&handlerPanic{v})
+		}
+	}()
+	h(req, r)
+}
+
+func (s *Server) callWriteHandler(h func(req *Request, w *io.PipeWriter), req *Request, w *io.PipeWriter, l *transferLog) {
+	defer func() {
+		if v := recover(); v != nil {
+			s.handlerPanicked(req, v, l)
+			w.CloseWithError(&handlerPanic{v})
+		}
+	}()
+	h(req, w)
+}
+
+func (s *Server) handlerPanicked(req *Request, v interface{}, l *transferLog) {
+	l.Errorf("Handler panic: %v\n%s", v, debug.Stack())
+	if s.OnHandlerPanic != nil {
+		s.OnHandlerPanic(req, v)
+	}
+}
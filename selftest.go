@@ -0,0 +1,155 @@
+package tftp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// selfTestPrefix starts the names of the pseudo-files SelfTest transfers.
+const selfTestPrefix = "__selftest__"
+
+// selfTestSize is the size of the SelfTest payload: a few full blocks and
+// a short last one.
+const selfTestSize = 3*BLOCK_SIZE + 100
+
+// selfTest is the pseudo-file of a SelfTest call. Uploads to it are kept in
+// memory and downloads return what was uploaded, so no handler or storage
+// of the server is touched.
+type selfTest struct {
+	mu   sync.Mutex
+	data bytes.Buffer
+}
+
+func (t *selfTest) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.data.Write(p)
+}
+
+func (t *selfTest) bytes() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]byte(nil), t.data.Bytes()...)
+}
+
+func (t *selfTest) upload(filename, mode string) (io.Writer, error) {
+	return t, nil
+}
+
+func (t *selfTest) download(req *Request, w *io.PipeWriter) {
+	w.Write(t.bytes())
+	w.Close()
+}
+
+// SelfTest checks that the running server works end to end: it uploads a
+// small random payload to one of its listening sockets with the built-in
+// client, downloads it again and compares the result. The transfers use a
+// pseudo-file of their own instead of the handlers, but otherwise take the
+// same path as any other, including policies such as AllowedClients and
+// AllowPatterns, hooks such as OnRequest and the statistics.
+func (s *Server) SelfTest() error {
+	addr := s.selfTestAddr()
+	if addr == nil {
+		return fmt.Errorf("Server is not listening")
+	}
+	payload := make([]byte, selfTestSize)
+	if _, e := rand.Read(payload); e != nil {
+		return e
+	}
+	filename := selfTestPrefix + hex.EncodeToString(payload[:8])
+	t := &selfTest{}
+	s.mu.Lock()
+	if s.selfTests == nil {
+		s.selfTests = make(map[string]*selfTest)
+	}
+	s.selfTests[filename] = t
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.selfTests, filename)
+		s.mu.Unlock()
+	}()
+
+	c := Client{RemoteAddr: addr}
+	if s.RequireOptions || s.RequireBlockSize > 0 {
+		// Meet the negotiation floor, as any client has to.
+		c.BlockSize = 2 * BLOCK_SIZE
+		if s.RequireBlockSize > c.BlockSize {
+			c.BlockSize = s.RequireBlockSize
+		}
+	}
+	var writeError error
+	e := c.Put(filename, "octet", func(w *io.PipeWriter) {
+		_, writeError = w.Write(payload)
+		w.Close()
+	})
+	if e != nil {
+		return fmt.Errorf("Self-test upload failed: %w", e)
+	}
+	if writeError != nil {
+		return fmt.Errorf("Self-test upload failed: %w", writeError)
+	}
+	if uploaded := t.bytes(); !bytes.Equal(uploaded, payload) {
+		return fmt.Errorf("Self-test upload failed: %d of %d bytes received intact", commonPrefix(uploaded, payload), len(payload))
+	}
+	var downloaded []byte
+	var readError error
+	e = c.Get(filename, "octet", func(r *io.PipeReader) {
+		downloaded, readError = io.ReadAll(r)
+	})
+	if e != nil {
+		return fmt.Errorf("Self-test download failed: %w", e)
+	}
+	if readError != nil {
+		return fmt.Errorf("Self-test download failed: %w", readError)
+	}
+	if !bytes.Equal(downloaded, payload) {
+		return fmt.Errorf("Self-test download failed: %d of %d bytes received intact", commonPrefix(downloaded, payload), len(payload))
+	}
+	return nil
+}
+
+// selfTestFile returns the pseudo-file of a SelfTest in progress named
+// filename, or nil.
+func (s *Server) selfTestFile(filename string) *selfTest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.selfTests[filename]
+}
+
+// selfTestAddr returns the address SelfTest sends its requests to: that of
+// a listening socket, preferring IPv4, with a wildcard address replaced by
+// the loopback address.
+func (s *Server) selfTestAddr() *net.UDPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var addr *net.UDPAddr
+	for conn := range s.listeners {
+		a := localAddr(conn)
+		if addr == nil || a.IP.To4() != nil && addr.IP.To4() == nil {
+			addr = a
+		}
+	}
+	if addr == nil || !addr.IP.IsUnspecified() {
+		return addr
+	}
+	loopback := net.IPv6loopback
+	if addr.IP.To4() != nil {
+		loopback = net.IPv4(127, 0, 0, 1)
+	}
+	return &net.UDPAddr{IP: loopback, Port: addr.Port}
+}
+
+// commonPrefix returns the number of leading bytes a and b share.
+func commonPrefix(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
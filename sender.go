@@ -1,142 +1,796 @@
 package tftp
 
 import (
+	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
 type sender struct {
 	remoteAddr *net.UDPAddr
-	conn       *net.UDPConn
+	conn       packetConn
 	reader     *io.PipeReader
 	filename   string
 	mode       string
-	log        *log.Logger
+	log        *transferLog
+	cancel     <-chan struct{}
+	summary    bool
+	bytes      int64
+	// blockSize is the size of a full DATA block, BLOCK_SIZE if zero.
+	blockSize int
+	// wrapTo is the block number following 65535.
+	wrapTo uint16
+	// handshake, if set, is sent by the server and must be acknowledged
+	// with ACK #0 before the data phase. It goes out before the handler is
+	// read, so a handler slow to produce data only stalls the data phase.
+	handshake Packet
+	// jitter is the fraction by which retransmission timeouts are
+	// randomly varied.
+	jitter float64
+	// errorMessage, if set, chooses the text of the ERROR packets sent.
+	errorMessage func(code uint16, e error) string
+	// backoff, if set, returns the timeout of each transmission attempt.
+	backoff func(attempt int) time.Duration
+	// total, if set, accumulates the bytes sent across transfers.
+	total *atomic.Int64
+	// adoptPort makes the transfer follow a peer whose port changes.
+	adoptPort bool
+	// retransmits, if set, counts the packets sent again across transfers.
+	retransmits *atomic.Int64
+	// rate aborts transfers below the minimum throughput.
+	rate rateMonitor
+	// idle bounds the retransmissions of each packet.
+	idle idleClock
+	// openSource, if set, opens the BlockReader the blocks are read from
+	// instead of the pipe.
+	openSource func() (BlockReader, error)
+	source     BlockReader
+	// sourceDone is set once the source returned a full last block, which
+	// is followed by an empty one.
+	sourceDone bool
+	// openContent, if set, opens the content served instead of the pipe,
+	// with its size or -1 if unknown. Without transform, its blocks are
+	// read as they are sent, by seeking to them, so those in flight are
+	// not kept.
+	openContent func() (io.ReadSeeker, int64, error)
+	content     io.ReadSeeker
+	// contentSize is the size of content, and offset that of the blocks
+	// before the next one.
+	contentSize, offset int64
+	// transferSize answers the tsize option with contentSize.
+	transferSize bool
+	// compress sends the file gzipped, read from compressed, which a
+	// goroutine fills from the content or pipe until compressDone.
+	compress     bool
+	compressed   *io.PipeReader
+	compressDone chan struct{}
+	// transform, if set, replaces each block before it is sent.
+	transform func(block []byte, blockNum uint16, direction Direction) ([]byte, error)
+	// delay is the pause between an acknowledged block and the next.
+	delay time.Duration
+	// fallback, if set, opens the reader served instead of the pipe when
+	// the handler reports a missing file before any data.
+	fallback       func() (io.Reader, error)
+	fallbackReader io.Reader
+	// buffer, if positive, is the number of blocks read ahead from the
+	// handler in ahead.
+	buffer int
+	ahead  *readAhead
+	// dallyTimeout, if positive, is how long the socket is kept open after
+	// the final ACK. dallyResend makes an ACK of the block before the last
+	// one seen meanwhile resend the last block.
+	dallyTimeout time.Duration
+	dallyResend  bool
+	// clock, if set, replaces the real clock.
+	clock clock
+	// windowSize is the number of DATA blocks sent before waiting for an
+	// ACK (RFC 7440). Zero or one means lockstep transfer.
+	windowSize int
+	// timeout, if positive, is the retransmission interval negotiated
+	// with the timeout option, the base of backoff instead of the default.
+	timeout time.Duration
+	// requested are the options of the client's request, which an OACK
+	// answering it is checked against.
+	requested map[string]string
+	// startBlock, if above 1, is the first block sent; the blocks before
+	// it are read from the pipe and dropped.
+	startBlock uint16
 }
 
-func (s *sender) Run(isServerMode bool) {
+func (s *sender) Run(isServerMode bool) error {
+	started := time.Now()
+	e := s.run(isServerMode)
+	if s.compressed != nil {
+		// The compressing goroutine must be done with the content before
+		// it is closed.
+		s.compressed.Close()
+		s.reader.Close()
+		<-s.compressDone
+	}
+	if c, ok := s.source.(io.Closer); ok {
+		c.Close()
+	}
+	if c, ok := s.content.(io.Closer); ok {
+		c.Close()
+	}
+	if c, ok := s.fallbackReader.(io.Closer); ok {
+		c.Close()
+	}
+	if s.ahead != nil {
+		s.ahead.stop()
+	}
+	if s.summary {
+		direction := DirectionRead
+		if !isServerMode {
+			direction = DirectionWrite
+		}
+		logSummary(s.log, s.filename, direction, s.bytes, started, e)
+	}
+	return e
+}
+
+func (s *sender) run(isServerMode bool) error {
 	var buffer, tmp []byte
-	buffer = make([]byte, BLOCK_SIZE)
+	if s.blockSize == 0 {
+		s.blockSize = BLOCK_SIZE
+	}
+	// Only DATA packets carry blocks; the replies read into tmp are
+	// small whatever the block size.
 	tmp = make([]byte, MAX_DATAGRAM_SIZE)
+	s.clock = orRealClock(s.clock)
+	s.idle.clock, s.rate.clock = s.clock, s.clock
+	if s.openSource == nil && s.openContent == nil && !s.compress && s.buffer > 0 {
+		s.ahead = newReadAhead(s.reader, s.blockSize, s.buffer)
+	}
+	s.idle.advance()
+	var e error
+	if s.openContent != nil {
+		// The size of the content completes the OACK, so it is opened
+		// before the handshake.
+		if e = s.openContentSource(); e != nil {
+			s.log.Errorf("Handler error: %v", e)
+			sendErrorPacket(s.conn, s.log, s.remoteAddr, handlerErrorCode(e), e, s.errorMessage)
+			return &handlerError{e}
+		}
+	}
 	if !isServerMode {
-		e := s.sendRequest(tmp)
-		if e != nil {
-			s.log.Printf("Error starting transmission: %v", e)
+		e = s.sendRequest(tmp, &WRQ{Filename: s.filename, Mode: s.mode, Options: s.requested}, true)
+	} else if s.handshake != nil {
+		e = s.sendRequest(tmp, s.handshake, false)
+	}
+	if e != nil {
+		s.log.Errorf("Error starting transmission: %v", e)
+		if e == errAborted {
+			s.abort()
+		}
+		s.reader.CloseWithError(e)
+		return e
+	}
+	// The block size is settled once an OACK was acknowledged.
+	buffer = make([]byte, s.blockSize)
+	if s.compress {
+		s.startCompression()
+	}
+	if s.openSource != nil {
+		if s.source, e = s.openSource(); e != nil {
+			s.log.Errorf("Handler error: %v", e)
+			sendErrorPacket(s.conn, s.log, s.remoteAddr, handlerErrorCode(e), e, s.errorMessage)
+			return &handlerError{e}
+		}
+	}
+	next := uint16(1)
+	if s.startBlock > 1 {
+		if e = s.skip(buffer); e == errStartBeyondEnd {
+			s.log.Errorf("Cannot resume at block %d: %v", s.startBlock, e)
+			sendErrorPacket(s.conn, s.log, s.remoteAddr, ERR_UNDEFINED, e, s.errorMessage)
 			s.reader.CloseWithError(e)
-			return
+			return e
+		} else if e != nil {
+			if aborted(s.cancel) {
+				s.abort()
+				return errAborted
+			}
+			s.log.Errorf("Handler error: %v", e)
+			sendErrorPacket(s.conn, s.log, s.remoteAddr, handlerErrorCode(e), e, s.errorMessage)
+			return &handlerError{e}
 		}
+		next = s.startBlock
 	}
-	var blockNumber uint16
-	blockNumber = 1
-	lastBlockSize := -1
+	window := s.windowSize
+	if window < 1 {
+		window = 1
+	}
+	// pending holds the blocks sent but not acknowledged yet, numbered as
+	// in numbers. They are copies, as a window spans several reads, whose
+	// buffers are recycled through free; blocks of content read as they
+	// are sent only need their length and share buffer.
+	var pending, free [][]byte
+	var numbers []uint16
+	prevNumber := next - 1
+	eof := false
 	for {
-		c, readError := s.reader.Read(buffer)
-		if readError != nil {
-			if readError == io.EOF { // && c == 0 ?
-				// we could have c != 0 here
-				if c != 0 {
-					panic("error!")
+		for !eof && len(pending) < window {
+			block, readError := s.nextBlock(buffer, next)
+			if s.transform != nil && (readError == nil || readError == io.EOF) {
+				if block, e = s.transformBlock(block, next, readError == io.EOF, isServerMode); e != nil {
+					s.log.Errorf("Error transforming block %d: %v", next, e)
+					sendErrorPacket(s.conn, s.log, s.remoteAddr, ERR_UNDEFINED, e, s.errorMessage)
+					s.reader.CloseWithError(e)
+					return e
 				}
-				if lastBlockSize == BLOCK_SIZE || lastBlockSize == -1 {
-					sendError := s.sendBlock(buffer, 0, blockNumber, tmp)
-					if sendError != nil && s.log != nil {
-						s.log.Printf("Error sending last block: %v", sendError)
-					}
+			}
+			if readError != nil && readError != io.EOF {
+				if aborted(s.cancel) {
+					s.abort()
+					return errAborted
 				}
+				s.log.Errorf("Handler error: %v", readError)
+				sendErrorPacket(s.conn, s.log, s.remoteAddr, handlerErrorCode(readError), readError, s.errorMessage)
+				return &handlerError{readError}
+			}
+			if s.seeking() {
+				pending = append(pending, block)
 			} else {
-				if s.log != nil {
-					s.log.Printf("Handler error: %v", readError)
+				var b []byte
+				if n := len(free); n > 0 {
+					b, free = free[n-1], free[:n-1]
 				}
-				errorPacket := ERROR{1, readError.Error()}
-				s.conn.WriteToUDP(errorPacket.Pack(), s.remoteAddr)
-				s.log.Printf("sent ERROR (code=%d): %s", 1, readError.Error())
+				pending = append(pending, append(b[:0], block...))
+			}
+			numbers = append(numbers, next)
+			eof = readError == io.EOF
+			next = nextBlock(next, s.wrapTo)
+		}
+		acked, sendError := s.sendWindow(pending, numbers, tmp)
+		var contentError *handlerError
+		if errors.As(sendError, &contentError) {
+			s.log.Errorf("Handler error: %v", contentError.err)
+			sendErrorPacket(s.conn, s.log, s.remoteAddr, handlerErrorCode(contentError.err), contentError.err, s.errorMessage)
+			return sendError
+		} else if sendError != nil {
+			s.log.Errorf("Error sending block %d: %v", numbers[0], sendError)
+			if sendError == errAborted {
+				s.abort()
+			}
+			s.reader.CloseWithError(sendError)
+			return sendError
+		}
+		for _, b := range pending[:acked] {
+			s.count(len(b))
+		}
+		if eof && acked == len(pending) {
+			// The transfer only counts as completed once the client
+			// acknowledged the final block: sendWindow retransmits it until
+			// then, and a client that never does times the transfer out.
+			last := len(pending) - 1
+			if last > 0 {
+				prevNumber = numbers[last-1]
 			}
+			s.dally(pending[last], numbers[last], prevNumber, tmp)
+			return nil
+		}
+		prevNumber = numbers[acked-1]
+		if !s.seeking() {
+			free = append(free, pending[:acked]...)
+		}
+		pending = append(pending[:0], pending[acked:]...)
+		numbers = append(numbers[:0], numbers[acked:]...)
+		if !s.rate.ok(s.bytes) {
+			s.log.Errorf("Aborting transfer below minimum throughput")
+			sendErrorPacket(s.conn, s.log, s.remoteAddr, ERR_UNDEFINED, errTooSlow, s.errorMessage)
+			s.reader.CloseWithError(errTooSlow)
+			return errTooSlow
+		}
+		if !s.pace() {
+			s.abort()
+			s.reader.CloseWithError(errAborted)
+			return errAborted
+		}
+	}
+}
+
+// retransmitInterval returns how long attempt i waits for an ACK.
+func (s *sender) retransmitInterval(i int) time.Duration {
+	base := 3 * time.Second
+	if s.timeout > 0 {
+		base = s.timeout
+	}
+	return retransmitTimeout(s.backoff, i, base, s.timeout > 0)
+}
+
+// dally keeps the socket open for dallyTimeout after the final block n was
+// acknowledged, so the packets still in flight to it are absorbed instead
+// of drawing an ICMP error or reaching the next transfer given a pooled
+// socket. Duplicates of the final ACK are dropped silently. An ACK of the
+// block prev before it can only be a late duplicate once the final ACK is
+// in, but with dallyResend it makes the final block go out once more, for
+// clients that would rather see it twice than miss it. The transfer is
+// complete whatever happens meanwhile.
+func (s *sender) dally(b []byte, n, prev uint16, tmp []byte) {
+	if s.dallyTimeout <= 0 {
+		return
+	}
+	if setReadDeadline(s.conn, s.clock, s.cancel, s.dallyTimeout) != nil {
+		return
+	}
+	resent := false
+	for {
+		c, remoteAddr, readError := s.conn.ReadFromUDP(tmp)
+		if readError != nil {
 			return
 		}
-		if c == 0 {
+		var ok bool
+		if s.remoteAddr, ok = acceptPeer(s.conn, s.log, s.remoteAddr, remoteAddr, s.adoptPort, s.errorMessage); !ok {
 			continue
 		}
-		sendError := s.sendBlock(buffer, c, blockNumber, tmp)
-		if sendError != nil {
-			if s.log != nil {
-				s.log.Printf("Error sending block %d: %v", blockNumber, sendError)
+		packet, e := Parse(tmp[:c])
+		if e != nil {
+			s.log.Debugf("Ignoring malformed packet: %v", e)
+			continue
+		}
+		switch p := packet.(type) {
+		case *ACK:
+			if p.BlockNumber == prev && s.dallyResend && !resent {
+				if s.seeking() && s.readContent(b, s.contentSize-int64(len(b))) != nil {
+					return
+				}
+				dataPacket := DATA{n, b}
+				s.conn.WriteToUDP(dataPacket.Pack(), s.remoteAddr)
+				s.log.Debugf("sent DATA #%d (%d bytes) again on ACK #%d", n, len(b), prev)
+				s.retransmitted()
+				resent = true
 			}
-			s.reader.CloseWithError(sendError)
+		case *ERROR:
+			s.log.Debugf("Ignoring ERROR after the final ACK: %s", p.ErrorMessage)
 			return
+		default:
+			s.log.Debugf("Ignoring unexpected %s packet", opName(Opcode(p)))
 		}
-		blockNumber++
-		lastBlockSize = c
 	}
 }
 
-func (s *sender) sendRequest(tmp []byte) (e error) {
-	for i := 0; i < 3; i++ {
-		wrqPacket := WRQ{s.filename, s.mode}
-		s.conn.WriteToUDP(wrqPacket.Pack(), s.remoteAddr)
-		s.log.Printf("sent WRQ (filename=%s, mode=%s)", s.filename, s.mode)
-		setDeadlineError := s.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+// sendRequest sends request until the peer acknowledges it with ACK #0,
+// or, for a client request with options, an OACK. adoptPeer makes the
+// source of that reply the peer of the transfer, which is how the client
+// learns the server's transfer ID.
+func (s *sender) sendRequest(tmp []byte, request Packet, adoptPeer bool) (e error) {
+	for i := 0; s.idle.retry(i); i++ {
+		s.conn.WriteToUDP(request.Pack(), s.remoteAddr)
+		logSent(s.log, request)
+		if i > 0 {
+			s.retransmitted()
+		}
+		setDeadlineError := setReadDeadline(s.conn, s.clock, s.cancel, s.idle.wait(jittered(s.retransmitInterval(i), s.jitter)))
 		if setDeadlineError != nil {
-			return fmt.Errorf("Could not set UDP timeout: %v", setDeadlineError)
+			return setDeadlineError
 		}
 		for {
 			c, remoteAddr, readError := s.conn.ReadFromUDP(tmp)
 			if networkError, ok := readError.(net.Error); ok && networkError.Timeout() {
+				if aborted(s.cancel) {
+					return errAborted
+				}
 				break
 			} else if readError != nil {
-				return fmt.Errorf("Error reading UDP packet: %v", readError)
+				return readFailed(readError)
+			}
+			if !adoptPeer {
+				var ok bool
+				if s.remoteAddr, ok = acceptPeer(s.conn, s.log, s.remoteAddr, remoteAddr, s.adoptPort, s.errorMessage); !ok {
+					continue
+				}
 			}
-			packet, e := ParsePacket(tmp[:c])
+			packet, e := Parse(tmp[:c])
 			if e != nil {
+				s.log.Debugf("Ignoring malformed packet: %v", e)
 				continue
 			}
-			switch p := Packet(*packet).(type) {
+			switch p := packet.(type) {
 			case *ACK:
 				if p.BlockNumber == 0 {
-					s.log.Printf("got ACK #0")
-					s.remoteAddr = remoteAddr
+					s.log.Debugf("got ACK #0")
+					if adoptPeer {
+						s.remoteAddr = remoteAddr
+					}
+					s.idle.advance()
 					return nil
 				}
+			case *OACK:
+				// The server accepted options of the client's request.
+				if !adoptPeer {
+					s.log.Debugf("Ignoring unexpected OACK packet")
+					continue
+				}
+				s.log.Debugf("got OACK %v", p.Options)
+				s.remoteAddr = remoteAddr
+				options, e := acceptOACK(s.requested, p.Options)
+				if e != nil {
+					sendErrorPacket(s.conn, s.log, s.remoteAddr, ERR_OPTION_NEGOTIATION, e, s.errorMessage)
+					return e
+				}
+				s.windowSize = options.windowSize
+				if options.blockSize > 0 {
+					s.blockSize = options.blockSize
+				}
+				if options.timeout > 0 {
+					s.timeout = options.timeout
+				}
+				s.idle.advance()
+				return nil
 			case *ERROR:
-				return fmt.Errorf("Transmission error %d: %s", p.ErrorCode, p.ErrorMessage)
+				return &PeerError{p.ErrorCode, p.ErrorMessage}
+			default:
+				s.log.Debugf("Ignoring unexpected %s packet", opName(Opcode(p)))
 			}
 		}
 	}
-	return fmt.Errorf("Send timeout")
+	return errSendTimeout
 }
 
-func (s *sender) sendBlock(b []byte, c int, n uint16, tmp []byte) (e error) {
-	for i := 0; i < 3; i++ {
-		setDeadlineError := s.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+// sendWindow sends blocks, numbered as in numbers, until the peer
+// acknowledges one of them, and returns how many of them that ACK covers.
+// Blocks of content are read by seeking to them before each transmission;
+// an error doing so is returned as a *handlerError.
+// A single block makes a lockstep transfer. With a window (RFC 7440) the
+// peer acknowledges the last block, or the last it received in order when
+// it notices a gap, and the caller starts the next window after that block;
+// a timeout resends the whole window.
+func (s *sender) sendWindow(blocks [][]byte, numbers []uint16, tmp []byte) (int, error) {
+	last := numbers[len(numbers)-1]
+	start := s.offset
+	for _, b := range blocks {
+		start -= int64(len(b))
+	}
+	for i := 0; s.idle.retry(i); i++ {
+		setDeadlineError := setReadDeadline(s.conn, s.clock, s.cancel, s.idle.wait(jittered(s.retransmitInterval(i), s.jitter)))
 		if setDeadlineError != nil {
-			return fmt.Errorf("Could not set UDP timeout: %v", setDeadlineError)
+			return 0, setDeadlineError
+		}
+		offset := start
+		for j, b := range blocks {
+			if s.seeking() {
+				if e := s.readContent(b, offset); e != nil {
+					return 0, &handlerError{e}
+				}
+				offset += int64(len(b))
+			}
+			dataPacket := DATA{numbers[j], b}
+			s.conn.WriteToUDP(dataPacket.Pack(), s.remoteAddr)
+			s.log.Debugf("sent DATA #%d (%d bytes)", numbers[j], len(b))
+			if i > 0 {
+				s.retransmitted()
+			}
 		}
-		dataPacket := DATA{n, b[:c]}
-		s.conn.WriteToUDP(dataPacket.Pack(), s.remoteAddr)
-		s.log.Printf("sent DATA #%d (%d bytes)", n, c)
 		for {
-			c, _, readError := s.conn.ReadFromUDP(tmp)
+			c, remoteAddr, readError := s.conn.ReadFromUDP(tmp)
 			if networkError, ok := readError.(net.Error); ok && networkError.Timeout() {
+				if aborted(s.cancel) {
+					return 0, errAborted
+				}
 				break
 			} else if readError != nil {
-				return fmt.Errorf("Error reading UDP packet: %v", readError)
+				return 0, readFailed(readError)
+			}
+			var ok bool
+			if s.remoteAddr, ok = acceptPeer(s.conn, s.log, s.remoteAddr, remoteAddr, s.adoptPort, s.errorMessage); !ok {
+				continue
 			}
-			packet, e := ParsePacket(tmp[:c])
+			packet, e := Parse(tmp[:c])
 			if e != nil {
+				s.log.Debugf("Ignoring malformed packet: %v", e)
 				continue
 			}
-			switch p := Packet(*packet).(type) {
+			switch p := packet.(type) {
 			case *ACK:
-				s.log.Printf("got ACK #%d", p.BlockNumber)
-				if n == p.BlockNumber {
-					return nil
+				s.log.Debugf("got ACK #%d", p.BlockNumber)
+				if acked := ackedBlocks(numbers, p.BlockNumber); acked > 0 {
+					s.idle.advance()
+					return acked, nil
+				}
+				// A duplicate ACK of an earlier block is ignored without
+				// retransmitting, which avoids the Sorcerer's Apprentice
+				// syndrome; a window whose first block was lost is thus
+				// resent on timeout. An ACK of a block not sent yet means
+				// a confused or malicious peer and must not advance the
+				// transfer.
+				if isFutureBlock(p.BlockNumber, last) {
+					s.log.Debugf("Discarding ACK #%d for unsent block (expecting ACK #%d)", p.BlockNumber, last)
 				}
 			case *ERROR:
-				return fmt.Errorf("Transmission error %d: %s", p.ErrorCode, p.ErrorMessage)
+				return 0, &PeerError{p.ErrorCode, p.ErrorMessage}
+			default:
+				// A stray DATA or request from a confused peer, or an
+				// injected packet, must not derail the transfer: a missing
+				// ACK is left to the retransmission timer.
+				s.log.Debugf("Ignoring unexpected %s packet", opName(Opcode(p)))
+			}
+		}
+	}
+	return 0, errSendTimeout
+}
+
+// ackedBlocks returns how many of the blocks numbered as in numbers an ACK
+// of block n acknowledges, zero if n is none of them.
+func ackedBlocks(numbers []uint16, n uint16) int {
+	for j, number := range numbers {
+		if number == n {
+			return j + 1
+		}
+	}
+	return 0
+}
+
+// nextBlock returns block n from the source, or read from the content or
+// the pipe into buffer. The last block is returned with io.EOF.
+func (s *sender) nextBlock(buffer []byte, n uint16) ([]byte, error) {
+	if s.compressed != nil {
+		c, e := readBlock(s.compressed, buffer)
+		return buffer[:c], e
+	}
+	if s.content != nil {
+		block := buffer[:min(int64(len(buffer)), s.contentSize-s.offset)]
+		if !s.seeking() {
+			if e := s.readContent(block, s.offset); e != nil {
+				return nil, e
+			}
+		}
+		s.offset += int64(len(block))
+		if len(block) < len(buffer) {
+			return block, io.EOF
+		}
+		return block, nil
+	}
+	if s.source == nil {
+		// Handlers may write in chunks of any size, so gather a full block
+		// before sending. A short read means the handler closed the pipe:
+		// the data is sent as the final block, which is empty when the file
+		// size is a multiple of the block size or the file is empty.
+		if s.fallbackReader != nil {
+			c, e := readBlock(s.fallbackReader, buffer)
+			return buffer[:c], e
+		}
+		block, e := s.readPipe(buffer)
+		if len(block) == 0 && n == 1 && s.bytes == 0 && s.notFound(e) {
+			r, fallbackError := s.fallback()
+			if fallbackError != nil {
+				s.log.Infof("Fallback failed: %v", fallbackError)
+				return nil, e
+			}
+			s.log.Infof("Serving fallback: %v", e)
+			s.fallbackReader = r
+			c, e := readBlock(r, buffer)
+			return buffer[:c], e
+		}
+		return block, e
+	}
+	if s.sourceDone {
+		return nil, io.EOF
+	}
+	block, last, e := s.source.ReadBlock(n)
+	switch {
+	case e != nil:
+		return nil, e
+	case len(block) > s.blockSize || !last && len(block) < s.blockSize:
+		return nil, fmt.Errorf("BlockReader returned block %d of %d bytes", n, len(block))
+	case last && len(block) == s.blockSize:
+		// The peer only takes a short block for the last one.
+		s.sourceDone = true
+		return block, nil
+	case last:
+		return block, io.EOF
+	}
+	return block, nil
+}
+
+// skip drops the blocks before startBlock from the pipe, or seeks past
+// them in the content. The file must reach beyond them, though the block
+// it starts with may be the empty final one.
+func (s *sender) skip(buffer []byte) error {
+	if s.content != nil {
+		s.offset = int64(s.startBlock-1) * int64(s.blockSize)
+		if s.offset > s.contentSize {
+			return errStartBeyondEnd
+		}
+		return nil
+	}
+	for n := uint16(1); n < s.startBlock; n++ {
+		if _, e := s.readPipe(buffer); e == io.EOF {
+			return errStartBeyondEnd
+		} else if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// openContentSource opens the content, or the fallback if it reports a
+// missing file, and adds its size to the OACK if tsize was requested.
+func (s *sender) openContentSource() error {
+	content, size, e := s.openContent()
+	if s.notFound(e) {
+		r, fallbackError := s.fallback()
+		if fallbackError != nil {
+			s.log.Infof("Fallback failed: %v", fallbackError)
+			return e
+		}
+		s.log.Infof("Serving fallback: %v", e)
+		s.fallbackReader = r
+		return nil
+	} else if e != nil {
+		return e
+	}
+	s.content = content
+	if size < 0 {
+		if size, e = content.Seek(0, io.SeekEnd); e != nil {
+			return e
+		}
+	}
+	s.contentSize = size
+	if s.transferSize {
+		options := map[string]string{optionTransferSize: strconv.FormatInt(size, 10)}
+		if oack, ok := s.handshake.(*OACK); ok {
+			for name, value := range oack.Options {
+				options[name] = value
+			}
+		}
+		s.handshake = &OACK{Options: options}
+	}
+	return nil
+}
+
+// seeking reports whether blocks are read from the content as they are
+// sent. A transform may not give the same block twice, so its input is
+// read once and kept like that of the pipe, and so is a compressed stream.
+func (s *sender) seeking() bool {
+	return s.content != nil && s.transform == nil && !s.compress
+}
+
+// startCompression starts gzipping the content, or the pipe, into
+// compressed. An error reading the file ends the stream with it, like
+// the handler's.
+func (s *sender) startCompression() {
+	var w *io.PipeWriter
+	s.compressed, w = io.Pipe()
+	s.compressDone = make(chan struct{})
+	go func() {
+		defer close(s.compressDone)
+		var r io.Reader = s.reader
+		if s.content != nil {
+			if _, e := s.content.Seek(0, io.SeekStart); e != nil {
+				w.CloseWithError(e)
+				return
 			}
+			r = s.content
+		} else if s.fallbackReader != nil {
+			r = s.fallbackReader
 		}
+		z := gzip.NewWriter(w)
+		n, e := io.Copy(z, r)
+		if e == nil && s.content != nil && n != s.contentSize {
+			e = fmt.Errorf("Content of %d bytes does not match its size of %d", n, s.contentSize)
+		}
+		if e == nil {
+			e = z.Close()
+		}
+		w.CloseWithError(e)
+	}()
+}
+
+// readContent fills b with the content at offset. The content must hold
+// as much, and nothing beyond its size.
+func (s *sender) readContent(b []byte, offset int64) error {
+	if _, e := s.content.Seek(offset, io.SeekStart); e != nil {
+		return e
+	}
+	c, e := readBlock(s.content, b)
+	if c < len(b) {
+		if e == io.EOF {
+			e = fmt.Errorf("Content of %d bytes does not match its size of %d", offset+int64(c), s.contentSize)
+		}
+		return e
+	}
+	if offset+int64(c) == s.contentSize {
+		var extra [1]byte
+		if c, _ := s.content.Read(extra[:]); c > 0 {
+			return fmt.Errorf("Content exceeds its size of %d", s.contentSize)
+		}
+	}
+	return nil
+}
+
+// readPipe reads the next block from the handler's pipe, through ahead if
+// it is buffered.
+func (s *sender) readPipe(buffer []byte) ([]byte, error) {
+	if s.ahead != nil {
+		return s.ahead.next()
+	}
+	c, e := readBlock(s.reader, buffer)
+	return buffer[:c], e
+}
+
+// notFound reports whether the handler error e calls for the fallback,
+// i.e. it would be sent as ERROR code 1 and is not due to an abort.
+func (s *sender) notFound(e error) bool {
+	return s.fallback != nil && e != nil && e != io.EOF && !aborted(s.cancel) && handlerErrorCode(e) == ERR_NOT_FOUND
+}
+
+// transformBlock applies transform to block n. The peer takes the first
+// block shorter than blockSize for the last one, so the result must be a
+// full block unless it is the last.
+func (s *sender) transformBlock(block []byte, n uint16, last bool, isServerMode bool) ([]byte, error) {
+	direction := DirectionRead
+	if !isServerMode {
+		direction = DirectionWrite
+	}
+	block, e := s.transform(block, n, direction)
+	if e != nil {
+		return nil, fmt.Errorf("%w: %v", errBlockTransform, e)
+	}
+	if last && len(block) >= s.blockSize {
+		return nil, fmt.Errorf("%w: last block of %d bytes is not short", errBlockTransform, len(block))
 	}
-	return fmt.Errorf("Send timeout")
+	if !last && len(block) != s.blockSize {
+		return nil, fmt.Errorf("%w: block %d of %d bytes is not full", errBlockTransform, n, len(block))
+	}
+	return block, nil
+}
+
+// readBlock fills b from r. It returns io.EOF, with whatever part of the
+// block was read, only when the handler closed the pipe cleanly. Unlike
+// io.ReadFull it passes any other error through unchanged, so a handler
+// closing with io.ErrUnexpectedEOF is not taken for the end of the file.
+func readBlock(r io.Reader, b []byte) (n int, e error) {
+	for n < len(b) && e == nil {
+		var c int
+		c, e = r.Read(b[n:])
+		n += c
+	}
+	return n, e
+}
+
+// count records n more bytes sent.
+func (s *sender) count(n int) {
+	s.bytes += int64(n)
+	if s.total != nil {
+		s.total.Add(int64(n))
+	}
+}
+
+// retransmitted records a packet sent again.
+func (s *sender) retransmitted() {
+	if s.retransmits != nil {
+		s.retransmits.Add(1)
+	}
+}
+
+// pace waits out the delay before the next block. It reports false if the
+// transfer was aborted meanwhile.
+func (s *sender) pace() bool {
+	if s.delay <= 0 {
+		return true
+	}
+	t := s.clock.NewTimer(s.delay)
+	defer t.Stop()
+	select {
+	case <-t.C():
+		return true
+	case <-s.cancel:
+		return false
+	}
+}
+
+// abort tells the client that the server gave up on the transfer.
+func (s *sender) abort() {
+	sendErrorPacket(s.conn, s.log, s.remoteAddr, ERR_UNDEFINED, errAborted, s.errorMessage)
+}
+
+// isFutureBlock reports whether block lies ahead of the current block n,
+// taking block number wraparound into account.
+func isFutureBlock(block, n uint16) bool {
+	return int16(block-n) > 0
 }
@@ -0,0 +1,143 @@
+package tftp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// silentPeer returns a memConn onWrite recording when each DATA block was
+// sent, and never answering.
+func silentPeer(clock clock, sent *[]time.Duration) func(c *memConn, data []byte, addr *net.UDPAddr) {
+	start := clock.Now()
+	return func(c *memConn, data []byte, addr *net.UDPAddr) {
+		if p, _ := Parse(data); Opcode(p) == OP_DATA {
+			*sent = append(*sent, clock.Now().Sub(start))
+		}
+	}
+}
+
+func equalDurations(a, b []time.Duration) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSenderBackoff(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	var sent []time.Duration
+	conn.clock, conn.onWrite = clock, silentPeer(clock, &sent)
+	s := newTestSender(conn, clock, []byte("short"))
+	s.backoff = ExponentialBackoff(time.Second, 4*time.Second)
+	if e := runTransfer(t, clock, conn, func() error { return s.Run(true) }); e != errSendTimeout {
+		t.Fatalf("Error %v, want %v", e, errSendTimeout)
+	}
+	if want := []time.Duration{0, time.Second, 3 * time.Second}; !equalDurations(sent, want) {
+		t.Errorf("Sent at %v, want %v", sent, want)
+	}
+	if elapsed := clock.Now().Sub(time.Unix(0, 0)); elapsed != 7*time.Second {
+		t.Errorf("Gave up after %v", elapsed)
+	}
+}
+
+func TestSenderIdleTimeout(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	var sent []time.Duration
+	conn.clock, conn.onWrite = clock, silentPeer(clock, &sent)
+	s := newTestSender(conn, clock, []byte("short"))
+	s.idle.timeout = 10 * time.Second
+	if e := runTransfer(t, clock, conn, func() error { return s.Run(true) }); e != errSendTimeout {
+		t.Fatalf("Error %v, want %v", e, errSendTimeout)
+	}
+	// Retransmissions go on past the default three attempts, the last
+	// wait cut short by the idle timeout.
+	if want := []time.Duration{0, 3 * time.Second, 6 * time.Second, 9 * time.Second}; !equalDurations(sent, want) {
+		t.Errorf("Sent at %v, want %v", sent, want)
+	}
+	if elapsed := clock.Now().Sub(time.Unix(0, 0)); elapsed != 10*time.Second {
+		t.Errorf("Gave up after %v", elapsed)
+	}
+}
+
+func TestSenderMinThroughput(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	conn.clock, conn.onWrite = clock, ackData
+	s := newTestSender(conn, clock, bytes.Repeat([]byte("x"), 30*BLOCK_SIZE))
+	// One block a second is half the rate required.
+	s.delay = time.Second
+	s.rate = rateMonitor{min: 2 * BLOCK_SIZE, window: 10 * time.Second}
+	if e := runTransfer(t, clock, conn, func() error { return s.Run(true) }); e != errTooSlow {
+		t.Fatalf("Error %v, want %v", e, errTooSlow)
+	}
+	if elapsed := clock.Now().Sub(time.Unix(0, 0)); elapsed != 10*time.Second {
+		t.Errorf("Aborted after %v", elapsed)
+	}
+	if codes := errorsTo(conn, testPeerAddr); !equalBlocks(codes, []uint16{ERR_UNDEFINED}) {
+		t.Errorf("ERROR codes %v", codes)
+	}
+}
+
+func TestSenderMinThroughputMet(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	conn.clock, conn.onWrite = clock, ackData
+	s := newTestSender(conn, clock, bytes.Repeat([]byte("x"), 30*BLOCK_SIZE))
+	s.delay = time.Second
+	s.rate = rateMonitor{min: BLOCK_SIZE / 2, window: 10 * time.Second}
+	if e := runTransfer(t, clock, conn, func() error { return s.Run(true) }); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestSenderDiscardsFutureACK(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	conn.clock = clock
+	conn.onWrite = func(c *memConn, data []byte, addr *net.UDPAddr) {
+		if p, _ := Parse(data); Opcode(p) == OP_DATA {
+			n := p.(*DATA).BlockNumber
+			for _, bogus := range []uint16{n + 1, n + 1000, 0} {
+				c.deliver((&ACK{BlockNumber: bogus}).Pack(), addr)
+			}
+		}
+		ackData(c, data, addr)
+	}
+	s := newTestSender(conn, clock, bytes.Repeat([]byte("x"), 2*BLOCK_SIZE+1))
+	if e := runTransfer(t, clock, conn, func() error { return s.Run(true) }); e != nil {
+		t.Fatal(e)
+	}
+	if blocks := dataBlocks(conn); !equalBlocks(blocks, []uint16{1, 2, 3}) {
+		t.Errorf("Sent blocks %v", blocks)
+	}
+	if s.bytes != 2*BLOCK_SIZE+1 {
+		t.Errorf("Sent %d bytes", s.bytes)
+	}
+}
+
+func TestSenderOnlyFutureACKs(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	conn := newMemConn(testLocalAddr)
+	conn.clock = clock
+	conn.onWrite = func(c *memConn, data []byte, addr *net.UDPAddr) {
+		if p, _ := Parse(data); Opcode(p) == OP_DATA {
+			c.deliver((&ACK{BlockNumber: p.(*DATA).BlockNumber + 1}).Pack(), addr)
+		}
+	}
+	s := newTestSender(conn, clock, bytes.Repeat([]byte("x"), 2*BLOCK_SIZE))
+	if e := runTransfer(t, clock, conn, func() error { return s.Run(true) }); e != errSendTimeout {
+		t.Fatalf("Error %v, want %v", e, errSendTimeout)
+	}
+	if blocks := dataBlocks(conn); !equalBlocks(blocks, []uint16{1, 1, 1}) {
+		t.Errorf("Sent blocks %v", blocks)
+	}
+}
@@ -1,10 +1,16 @@
 package tftp
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 /*
@@ -42,103 +48,1392 @@ for read and write requests and optional logger.
 		os.Exit(1)
 	}
 	log := log.New(os.Stderr, "TFTP", log.Ldate | log.Ltime)
-	s := tftp.Server{addr, HandleWrite, HandleRead, log}
+	s := tftp.Server{
+		BindAddr:     addr,
+		ReadHandler:  HandleWrite,
+		WriteHandler: HandleRead,
+		Log:          log,
+	}
 	e = s.Serve()
 	if e != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", e)
 		os.Exit(1)
 	}
 */
+//
+// Without a read handler the server refuses uploads (WRQ) and without a
+// write handler it refuses downloads (RRQ); such requests are answered
+// with ERROR code 4, so one-directional servers are safe to construct.
+//
+// TFTP has no keepalive: after an RRQ the client waits for DATA block 1
+// and retransmits its request if it is late. A WriteHandler that is slow to
+// produce the first bytes therefore has to stay within the client's
+// timeout. The server never blocks on the handler before answering: any
+// handshake is completed first and only the data phase waits for it.
+//
+// A WriteHandler ends the file by closing its pipe: Close means the file is
+// complete, however short, and the data written so far is sent as the whole
+// file. CloseWithError with any error, io.ErrUnexpectedEOF included, means
+// the handler failed: the client gets an ERROR packet instead of a
+// truncated file.
+//
+// Every transfer is served from its own socket, whose port the client learns
+// from the source of the first reply. Behind NAT this only works if the
+// transmission ports are forwarded unchanged: restrict them with PortRange
+// and forward that range 1:1. TFTP cannot tell the client about a
+// translated address, so AdvertisedAddr only serves diagnostics, and setups
+// where replies must leave from a specific address need TransmissionConnFunc.
 type Server struct {
-	BindAddr     *net.UDPAddr
+	BindAddr *net.UDPAddr
+	// BindAddrs are further addresses served alongside BindAddr, e.g. the
+	// IPv6 wildcard next to the IPv4 one; NewDualStackServer sets up that
+	// case. With more than one address every socket is bound to the
+	// family of its address, so an IPv6 wildcard does not also claim the
+	// IPv4 port, and an address without IP is not allowed.
+	BindAddrs    []*net.UDPAddr
 	ReadHandler  func(filename string, r *io.PipeReader)
 	WriteHandler func(filename string, w *io.PipeWriter)
-	Log          *log.Logger
+	Log          Logger
+	// LogLevel is the least severe level written to Log. The zero value,
+	// LogDebug, logs every packet; LogInfo limits the log to requests and
+	// transfer summaries.
+	LogLevel LogLevel
+
+	// ContentFunc, if set, serves read requests when there is no
+	// WriteHandler or WriteRequestHandler. It returns the content of the
+	// file, which is served from its start, and its size, or -1 to have it
+	// found by seeking to the end. The size answers the tsize option (RFC
+	// 2349), and content not matching it fails the transfer. Each block is
+	// read by seeking to it as it is sent, retransmissions included, so
+	// neither a handler goroutine and pipe nor copies of the blocks in
+	// flight are needed. Errors are sent to the client as ERROR code 2 for
+	// permission errors and code 1 otherwise. If content is an io.Closer,
+	// it is closed once served.
+	ContentFunc func(filename, mode string) (content io.ReadSeeker, size int64, e error)
+
+	// UploadFunc, if set, receives write requests when there is no read
+	// handler. It returns the writer the upload is stored in, which the
+	// server writes each block to as it arrives. Before the final ACK
+	// tells the client the upload succeeded, the writer is flushed and
+	// synced if it has a Flush or Sync method, e.g. a *bufio.Writer or an
+	// *os.File, and closed if it is an io.Closer. A client seeing success
+	// thus knows the data was committed; if any of these steps fails, it
+	// gets an ERROR packet instead. Errors are reported like handler
+	// errors, and a writer of a failed upload is closed all the same.
+	UploadFunc func(filename, mode string) (io.Writer, error)
+
+	// BlockFunc, if set, serves read requests when there is neither a
+	// write handler nor ContentFunc. It opens a BlockReader for the file,
+	// which the server then asks for each block as it is sent, without a
+	// handler goroutine or pipe. Errors of BlockFunc and ReadBlock are
+	// reported like handler errors. If the BlockReader is an io.Closer,
+	// it is closed when the transfer ends.
+	BlockFunc func(filename, mode string) (BlockReader, error)
+
+	// NotFoundFallback, if set, is asked for a replacement when a read
+	// handler fails the way that is reported as ERROR code 1 before
+	// producing any data, e.g. to serve a default boot image to PXE
+	// clients probing for a file per machine. The returned reader is
+	// served instead, and closed if it is an io.Closer. If the fallback
+	// fails too, the client gets the handler's ERROR.
+	NotFoundFallback func(filename string) (io.Reader, error)
+
+	// ReadRequestHandler and WriteRequestHandler are used instead of
+	// ReadHandler and WriteHandler when set. They get the whole Request,
+	// including the client address and the raw request packet.
+	ReadRequestHandler  func(req *Request, r *io.PipeReader)
+	WriteRequestHandler func(req *Request, w *io.PipeWriter)
+
+	// ContextFunc, if set, returns the context of a transfer, derived from
+	// ctx, before its handler is called. Middleware uses it to attach
+	// request-scoped values, for example the user authenticated from the
+	// peer address, that ReadRequestHandler and WriteRequestHandler read
+	// from req.Context(). ctx is cancelled when the transfer ends.
+	ContextFunc func(ctx context.Context, req *Request) context.Context
+
+	// TransmissionConnFunc, if set, is used instead of the default to open
+	// the per-transfer socket replies to remoteAddr are sent from. It allows
+	// binding to a particular local address or interface when the default
+	// routing picks the wrong one.
+	TransmissionConnFunc func(remoteAddr *net.UDPAddr) (*net.UDPConn, error)
+
+	// PortRange, if set, restricts transmission sockets to local ports in
+	// the given range, e.g. the ports forwarded to the server through NAT.
+	PortRange *PortRange
+
+	// SocketPoolSize, if positive, keeps up to this many transmission
+	// sockets of finished transfers open for reuse, which bounds socket
+	// churn under high transfer rates. Each pooled socket keeps its port,
+	// so concurrent transfers still get distinct transfer IDs; a socket
+	// rests for a while before reuse so stray packets of its previous
+	// transfer are not taken for the next one. Transfers beyond the pool
+	// open sockets as usual.
+	SocketPoolSize int
+
+	// TransmissionPortFunc, if set, chooses the local port of the socket
+	// for a transfer with remote, e.g. derived from the client's port to
+	// correlate packet captures. If it returns 0 or the port is taken, the
+	// socket is opened as without it.
+	TransmissionPortFunc func(remote *net.UDPAddr) int
+
+	// AdvertisedAddr is the host clients reach the server at when it sits
+	// behind NAT. It is reported in the log next to each transmission port.
+	AdvertisedAddr string
+
+	// DisableWriteProbe turns off the zero-byte Write the server issues to
+	// the ReadHandler pipe before acknowledging a WRQ. The probe lets a
+	// handler that rejects the upload (by closing its reader with an error)
+	// be reported to the client before the first ACK. Without it such a
+	// rejection only surfaces once the first DATA block is delivered, but
+	// handlers that are sensitive to empty writes keep working.
+	DisableWriteProbe bool
+
+	// DSCP, if non-zero, is the Differentiated Services code point (0-63)
+	// set on the listening and transmission sockets. Zero leaves the
+	// operating system's default marking.
+	DSCP int
+
+	// DisableFragmentation sets the don't-fragment bit on the listening and
+	// transmission sockets, so a block too large for the path fails loudly
+	// instead of being fragmented. It is supported on Linux and FreeBSD;
+	// elsewhere the server fails to start.
+	DisableFragmentation bool
+
+	// RecordInterface makes the server record the interface each request
+	// arrived on in Request.InterfaceIndex, e.g. to serve different images
+	// per VLAN. It is only supported on Linux; elsewhere the server fails
+	// to start.
+	RecordInterface bool
+
+	// ConfigureConn, if set, is called with every listening and
+	// transmission socket after the server applied its own options, to set
+	// any other socket option through syscall or golang.org/x/net, e.g. a
+	// larger receive buffer. An error fails listening, or the transfer the
+	// socket was opened for.
+	ConfigureConn func(conn *net.UDPConn) error
+
+	// EnableListing makes a read of ListFilename return the newline
+	// separated names produced by ListFunc instead of calling WriteHandler.
+	// ListFilename defaults to DEFAULT_LIST_FILENAME.
+	EnableListing bool
+	ListFilename  string
+	ListFunc      func() ([]string, error)
+
+	// EnableHealthCheck makes a read of HealthCheckFilename return "OK\n"
+	// without calling any handler, so load balancers and monitoring can
+	// probe the server with a GET that touches no real content.
+	// HealthCheckFilename defaults to DEFAULT_HEALTH_CHECK_FILENAME. Like
+	// any file it is subject to AllowPatterns and DenyPatterns.
+	EnableHealthCheck   bool
+	HealthCheckFilename string
+
+	// LogTransfers makes the server log a summary line with the byte count,
+	// duration and throughput of every finished transfer.
+	LogTransfers bool
+
+	// OnRequest, if set, is called for every RRQ and WRQ received, before
+	// it is accepted or rejected, e.g. to write an access log. Retransmitted
+	// requests of a transfer in flight are not reported again. It runs on
+	// the serve loop and should return quickly.
+	OnRequest func(op uint16, filename, mode string, peer *net.UDPAddr)
+
+	// UnknownOpcodeHandler, if set, gets the datagrams arriving on the
+	// listening socket that are not valid RRQs or WRQs: unknown opcodes,
+	// malformed packets and packets only valid within a transfer. By
+	// default they are dropped without reply. It runs on the serve loop.
+	UnknownOpcodeHandler func(raw []byte, peer *net.UDPAddr)
+
+	// CaptureFunc, if set, is asked for a writer to record each transfer
+	// to in pcap format, e.g. to open in Wireshark when debugging a
+	// stubborn client. The capture holds the request and every datagram of
+	// the transfer in both directions with their timestamps, as IP packets
+	// with synthesized headers. A nil writer leaves the transfer
+	// uncaptured; one that is an io.Closer is closed when the transfer
+	// ends. CaptureDir writes every capture to its own file.
+	CaptureFunc func(info TransferInfo) io.Writer
+
+	// AccessLog, if set, gets a line for every transfer that ends, like
+	// the access log of a web server:
+	//
+	//	2006-01-02T15:04:05Z 192.0.2.7 read "pxelinux.0" octet 26828 completed
+	//
+	// The fields are the time the transfer ended in UTC, the peer's IP,
+	// the direction, the quoted filename, the mode, the number of bytes
+	// transferred and the outcome, hyphenated where it has spaces, e.g.
+	// timed-out. Writes are serialized.
+	AccessLog io.Writer
+
+	// OnTransferComplete, if set, is called when a transfer ends. A read
+	// whose client stops acknowledging is reported as TimedOut once the
+	// retransmissions are exhausted; the handler's pipe is then closed
+	// with an error so it stops producing data.
+	OnTransferComplete func(result TransferResult)
+
+	// OnReadComplete, if set, is called when a download ends. A nil e means
+	// the client acknowledged the last block, i.e. it has received the
+	// whole file, which the WriteHandler cannot tell from its pipe.
+	OnReadComplete func(filename string, e error)
+
+	// OnHandlerPanic, if set, is called with the value a handler panicked
+	// with. The panic is recovered either way: it is logged, the transfer
+	// is aborted with ERROR code 0 and the server keeps running.
+	OnHandlerPanic func(req *Request, v interface{})
+
+	// ErrorMessageFunc, if set, returns the text of the ERROR packet sent
+	// to the client for the internal error e, e.g. to keep file system
+	// paths from handler errors off the wire. The full error is still
+	// logged. By default the error string is sent as is.
+	ErrorMessageFunc func(code uint16, e error) string
+
+	// DrainTimeout is how long ServeContext lets in-flight transfers finish
+	// after its context is cancelled. Transfers still running then are
+	// aborted; with zero they are aborted right away.
+	DrainTimeout time.Duration
+
+	// Cache, if set, serves downloads from memory so that a file requested
+	// by many clients is only read from the WriteHandler once.
+	Cache *Cache
+
+	// PollInterval, if positive, makes the serve loop wake up at this
+	// interval to check whether it was asked to stop, instead of relying
+	// on the error a closed socket returns from a blocked read. Serve
+	// never stops on its own and is unaffected.
+	PollInterval time.Duration
+
+	// MinThroughput, if positive, is the slowest rate in bytes per second a
+	// transfer may run at. It is measured over consecutive periods of
+	// MinThroughputWindow, DEFAULT_MIN_THROUGHPUT_WINDOW if zero, so brief
+	// stalls are tolerated; a transfer slower than that over a whole
+	// period is aborted with ERROR code 0. This guards against clients
+	// tying up transfers by acknowledging at a crawl.
+	MinThroughput       int64
+	MinThroughputWindow time.Duration
+
+	// InterBlockDelay, if positive, is how long downloads pause after each
+	// acknowledged block before sending the next one, for embedded clients
+	// that drop DATA arriving faster than they can write it to flash. It
+	// paces packets, not bytes. The pause follows each acknowledgement, so
+	// with a window of several blocks it spaces out the windows while the
+	// blocks within one go out back to back.
+	InterBlockDelay time.Duration
+
+	// DallyTimeout, if positive, is how long a download keeps its socket
+	// after the client acknowledged the final block, like a receiver
+	// dallies after the final ACK. Duplicates of that ACK arriving
+	// meanwhile, e.g. from a client retransmitting it, are absorbed
+	// silently instead of drawing an ICMP error, or ERROR code 5 from a
+	// reused pooled socket. DallyResend makes an ACK of the block before
+	// the final one, seen during the dally, resend the final block once,
+	// for clients that take such an ACK for a sign it was lost. The
+	// transfer is only reported complete once the dally is over.
+	DallyTimeout time.Duration
+	DallyResend  bool
+
+	// MaxTransfers, if positive, is the number of transfers the server
+	// runs at once. Requests beyond it get ERROR code 0 from the listening
+	// socket, before any socket, pipe or goroutine is set up for them.
+	// Requests arriving on several listening sockets at the same time may
+	// exceed it by one per additional socket.
+	MaxTransfers int
+
+	// MaxTotalBytes, if positive, is a quota on the file data transferred
+	// by the server in both directions. Once TotalBytesTransferred reaches
+	// it, new requests get ERROR code 0; transfers in flight are completed.
+	// ResetTotalBytes starts a new quota period.
+	MaxTotalBytes int64
+
+	// HandlerWriteTimeout, if positive, is how long the ReadHandler may
+	// take to read a block of an upload from its pipe. A handler stuck
+	// longer, e.g. on a disk that never drains, has its pipe closed with
+	// an error and the client gets ERROR code 3, instead of the transfer
+	// holding its socket indefinitely. Network timeouts are unaffected.
+	HandlerWriteTimeout time.Duration
+
+	// MaxFileSize, if positive, is the largest upload accepted. A client
+	// sending more data gets ERROR code 3 and the transfer is aborted.
+	MaxFileSize int64
+
+	// AllowedClients, if not empty, restricts the server to clients within
+	// these networks. Packets from other clients are dropped without reply,
+	// so the server cannot be used to reflect traffic at a spoofed address,
+	// unless RejectClients is set to answer them with ERROR code 2.
+	AllowedClients []*net.IPNet
+	RejectClients  bool
+
+	// AllowPatterns and DenyPatterns restrict the files that can be read or
+	// written using path.Match patterns, e.g. "pxelinux.cfg/*". Deny takes
+	// precedence, and a non-empty AllowPatterns admits only matching files.
+	// Rejected requests get ERROR code 2.
+	AllowPatterns []string
+	DenyPatterns  []string
+
+	// DefaultMode is the transfer mode assumed for requests with an empty
+	// or unknown mode, DEFAULT_MODE if empty. StrictMode instead rejects
+	// unknown non-empty modes with ERROR code 4.
+	DefaultMode string
+	StrictMode  bool
+	// AllowedModes, if not empty, lists the transfer modes served, in
+	// lower case, e.g. only "octet" for a server without netascii
+	// conversion. Requests for other modes get ERROR code 4, whatever
+	// StrictMode says.
+	AllowedModes []string
+
+	// FileExists, if set, is asked whether the target of a WRQ already
+	// exists. If it does, the request is refused with ERROR code 6 before
+	// any data is accepted. FileExistsIn provides a check for handlers
+	// storing uploads in a directory.
+	FileExists func(filename string) bool
+
+	// BlockTransform, if set, is applied to the data of every block in
+	// transit, e.g. to encrypt downloads or decrypt uploads on the fly. For
+	// downloads it gets each block read from the WriteHandler before it is
+	// sent; for uploads each block received before it is written to the
+	// ReadHandler. An error aborts the transfer with ERROR code 0.
+	//
+	// The peer takes the first short block for the end of the file, so a
+	// transformed download block must stay a full block, of BLOCK_SIZE
+	// unless blksize negotiated another size, except the last, which must
+	// stay short. Upload blocks may change size freely. Byte counts and
+	// limits apply to the data on the wire.
+	BlockTransform func(block []byte, blockNum uint16, direction Direction) ([]byte, error)
+
+	// AdoptPeerPort makes transfers follow a client whose port changes
+	// mid-transfer while its IP stays the same, as some NATs rewrite ports
+	// between packets of a flow. By default packets from any address but
+	// the client's are taken for strays, as RFC 1350 requires: they are
+	// answered with ERROR code 5 and the transfer goes on undisturbed,
+	// which stalls it behind such a NAT. With ConnectPeer the kernel turns
+	// them away with ICMP port unreachable instead.
+	AdoptPeerPort bool
+
+	// ConnectPeer connects the socket of each transfer to its client, on
+	// Linux, so that the ICMP port unreachable of a client whose firewall
+	// blocks the transfer port ends the transfer as PeerUnreachable rather
+	// than TimedOut. The kernel then drops the packets of other sources
+	// before the server sees them, so strays get ICMP port unreachable in
+	// place of ERROR code 5. Pooled sockets (SocketPoolSize) and transfers
+	// with AdoptPeerPort stay unconnected; elsewhere it has no effect.
+	ConnectPeer bool
+
+	// BlockWrapTo is the block number that follows block 65535 in transfers
+	// larger than 65535 blocks, which RFC 1350 leaves open. The default,
+	// the zero value, wraps to 0 as a 16-bit block counter does on
+	// overflow. That is what curl, U-Boot, iPXE and the tftp clients of
+	// tftp-hpa and the BSDs expect, as does tftpd-hpa by default, and it
+	// keeps the behaviour of earlier versions. Set it to 1 for peers that
+	// never use block 0 again, such as clients asking tftpd-hpa for its
+	// non-standard rollover=1 option. Smaller transfers are unaffected.
+	BlockWrapTo uint16
+
+	// DisableOptions makes the server ignore the options of requests (RFC
+	// 2347) and serve every transfer as plain RFC 1350 without an OACK,
+	// for clients that mishandle the OACK. Otherwise requests with options
+	// the server accepts are answered with an OACK listing them, which the
+	// client acknowledges before the data phase. See SupportedOptions.
+	DisableOptions bool
+
+	// RequireOptions and RequireBlockSize set a floor for negotiation, the
+	// inverse of DisableOptions, e.g. to keep clients limited to 512-byte
+	// blocks off a server where they would be too slow. RequireOptions
+	// refuses requests without any option the server accepts, and a
+	// positive RequireBlockSize those that do not negotiate a blksize of
+	// at least that much; a transfer without blksize has BLOCK_SIZE
+	// blocks. Such requests get ERROR code 8 instead of a plain transfer.
+	// Downloads served by BlockFunc have BLOCK_SIZE blocks, and requests
+	// OptionsFunc opts out of negotiation are exempt.
+	RequireOptions   bool
+	RequireBlockSize int
+
+	// RejectDowngrade aborts an upload with ERROR code 8 when its first
+	// DATA block shows that the client ignored the blksize negotiated in
+	// the OACK, by being exactly BLOCK_SIZE bytes. Otherwise the upload
+	// goes on as a plain RFC 1350 transfer, with blocks of BLOCK_SIZE and
+	// no window. The mismatch is logged either way. ACKs carry no size, so
+	// downloads cannot tell.
+	RejectDowngrade bool
+
+	// AllowStartBlock accepts the vendor option x-startblock on downloads,
+	// with which a client resuming one names the first block it wants,
+	// numbered as on the wire. The blocks before it, of the negotiated
+	// blksize, are read from the handler and dropped, and the transfer
+	// starts with that block, or the first window of windowsize blocks
+	// from it. As block numbers wrap, only the first 65535 blocks can be
+	// resumed from. A file ending before the block is refused with ERROR
+	// code 0. Uploads and downloads served by BlockFunc ignore the option.
+	AllowStartBlock bool
+
+	// AllowCompression accepts the vendor option x-compress on downloads,
+	// for large text files over slow links. Its only value is "gzip": the
+	// server then sends the file as a gzip stream (RFC 1952), split into
+	// DATA blocks like any file, and the client decompresses what it
+	// receives; the number of bytes on the wire is that of the stream.
+	// Clients that do not ask for it, or servers that do not accept it,
+	// transfer the file as is, so the option is safe to turn on. tsize
+	// still reports the size uncompressed. Downloads served by BlockFunc,
+	// and those resumed with x-startblock, are not compressed, and
+	// NotFoundFallback does not apply to compressed ones from handlers.
+	AllowCompression bool
+
+	// OptionsFunc, if set, decides per request with options whether they
+	// are negotiated, for files that must be served without them, e.g. to
+	// a boot loader known to choke on its own blksize. Returning false
+	// serves the transfer as plain RFC 1350 without an OACK, as
+	// DisableOptions does for all of them. The options are those of
+	// req.Packet. It runs on the serve loop, so it must return quickly.
+	OptionsFunc func(req *Request) bool
+
+	// MaxOptions and MaxOptionBytes bound the options of a request: their
+	// number and the bytes of their names and values. Zero means
+	// DEFAULT_MAX_OPTIONS and DEFAULT_MAX_OPTION_BYTES, generous for real
+	// clients. A request beyond either is refused with ERROR code 8
+	// without being parsed any further.
+	MaxOptions     int
+	MaxOptionBytes int
+
+	// MaxWindowSize is the largest windowsize option (RFC 7440) accepted:
+	// the number of blocks sent before waiting for an ACK, which cuts
+	// transfer times on links with high latency. Zero means
+	// DEFAULT_MAX_WINDOW_SIZE, a negative value refuses the option. A
+	// client asking for more gets this many.
+	MaxWindowSize int
+
+	// MaxBlockSize is the largest blksize option (RFC 2348) accepted, at
+	// least MIN_BLOCK_SIZE: blocks larger than 512 bytes cut the number of
+	// round trips. Zero means MAX_BLOCK_SIZE, leaving the choice to the
+	// client, a negative value refuses the option. Blocks beyond the path
+	// MTU are fragmented, or dropped with DisableFragmentation, so the
+	// SafeBlockSize of the MTU is a good cap where clients ask for too
+	// much. Downloads served by BlockFunc always use BLOCK_SIZE.
+	MaxBlockSize int
+
+	// MaxTimeoutOption is the largest timeout option (RFC 2349) accepted,
+	// up to MAX_TIMEOUT: the client sets the interval, in whole seconds,
+	// after which both sides retransmit. It replaces the defaults as the
+	// base interval, from which BackoffFunc still backs off. The server
+	// cannot lower it, so larger requests are ignored. Zero means
+	// MAX_TIMEOUT, a negative value refuses the option.
+	MaxTimeoutOption time.Duration
+
+	// BackoffFunc, if set, returns how long to wait for a reply to the
+	// attempt-th transmission of a packet, counting from zero, e.g.
+	// ExponentialBackoff for high-latency links. By default every attempt
+	// waits the same interval: 3s for DATA and 5s for ACKs. A negotiated
+	// timeout option replaces either, and scales BackoffFunc so that its
+	// first attempt waits the negotiated interval. Retransmit jitter
+	// applies on top of it.
+	BackoffFunc func(attempt int) time.Duration
+
+	// IdleTimeout, if positive, is how long a transfer may go without
+	// progress, i.e. without a block being acknowledged or received,
+	// before it is given up on as timed out. Retransmissions then go on
+	// for as long as that, instead of stopping after three attempts per
+	// packet, so a transfer over a slow or lossy link survives as long as
+	// it keeps moving, however long it takes in total.
+	IdleTimeout time.Duration
+
+	// PipeBufferBlocks is the number of blocks buffered between a transfer
+	// and the pipe of its handler, so a slow handler does not hold up the
+	// network side and a fast one can run ahead of it. Zero means
+	// DEFAULT_PIPE_BUFFER_BLOCKS; a negative value couples them directly,
+	// as the pipe is unbuffered. Every transfer may hold this many blocks,
+	// plus two in use, in memory, which adds up with large block sizes
+	// and many transfers. Uploads are still acknowledged as complete only
+	// once the handler read all of it, but a handler error reaches the
+	// client up to that many blocks late.
+	PipeBufferBlocks int
+
+	// RetransmitJitter is the fraction by which retransmission timeouts are
+	// randomly varied, so transfers hit by the same network blip do not
+	// retransmit in a burst. Zero means DEFAULT_RETRANSMIT_JITTER (±10%), a
+	// negative value disables jitter.
+	RetransmitJitter float64
+
+	mu        sync.Mutex
+	transfers map[uint64]*transfer
+	// listeners are the listening sockets being served, closed by
+	// Shutdown.
+	listeners map[*net.UDPConn]struct{}
+	shutdown  atomic.Bool
+	// draining is set by Drain and cleared by Undrain.
+	draining atomic.Bool
+	// selfTests are the pseudo-files of the SelfTest calls in progress.
+	selfTests map[string]*selfTest
+	// accessLogMu serializes writes to AccessLog.
+	accessLogMu sync.Mutex
+	// dualStack makes the IPv6 address of BindAddrs optional, for hosts
+	// without IPv6.
+	dualStack bool
+	nextID    uint64
+	nextPort  int
+	active    sync.WaitGroup
+	// running counts transfers in flight, read without taking mu.
+	running int32
+	// totalBytes counts the file data transferred by all transfers.
+	totalBytes atomic.Int64
+	stats      serverStats
+	pool       connPool
+	// newID, if set, generates transfer IDs instead of the counter, e.g.
+	// to make them predictable. The IDs must be unique among the
+	// transfers in flight.
+	newID func() uint64
+	// wrapConn, if set, wraps the socket of each transfer, e.g. in a
+	// dropConn to simulate packet loss.
+	wrapConn func(conn packetConn) packetConn
+	// clock, if set, replaces the real clock in the transfer loops, e.g. a
+	// fakeClock shared with memConn sockets by wrapConn.
+	clock clock
 }
 
+// PortRange is an inclusive range of UDP ports.
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// ErrServerClosed is returned by the serve loop when it was asked to stop.
+var ErrServerClosed = errors.New("Server closed")
+
+// DEFAULT_LIST_FILENAME is the pseudo-file serving the listing when
+// Server.EnableListing is set and Server.ListFilename is empty.
+const DEFAULT_LIST_FILENAME = "__list__"
+
+// DEFAULT_HEALTH_CHECK_FILENAME is the pseudo-file serving the health check
+// when Server.EnableHealthCheck is set and Server.HealthCheckFilename is
+// empty.
+const DEFAULT_HEALTH_CHECK_FILENAME = "__health__"
+
+// Listen starts serving in the background and returns the address of the
+// first listening socket. Closing the returned io.Closer tears the server
+// down completely: the listening sockets are closed, transfers in flight
+// are aborted with ERROR code 0 and their sockets closed, and idle pooled
+// sockets are closed, all before Close returns. Shutdown instead lets the
+// transfers finish.
 func (s *Server) Listen() (io.Closer, string, error) {
-	conn, e := net.ListenUDP("udp", s.BindAddr)
+	conns, e := s.listen()
 	if e != nil {
 		return nil, "", e
 	}
-	go s.run(conn)
-	return conn, conn.LocalAddr().String(), nil
+	c := &listenerCloser{s: s, conns: conns, stopped: make(chan struct{})}
+	go func() {
+		s.serve(conns, nil)
+		close(c.stopped)
+	}()
+	return c, conns[0].LocalAddr().String(), nil
 }
 
 func (s *Server) Serve() error {
-	conn, e := net.ListenUDP("udp", s.BindAddr)
+	conns, e := s.listen()
+	if e != nil {
+		return e
+	}
+	return s.serve(conns, nil)
+}
+
+// ServeContext is like Serve but stops when ctx is cancelled. It then
+// closes the listening sockets, drains in-flight transfers as allowed by
+// DrainTimeout and returns an error wrapping ctx.Err().
+func (s *Server) ServeContext(ctx context.Context) error {
+	conns, e := s.listen()
 	if e != nil {
 		return e
 	}
-	return s.run(conn)
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- s.serve(conns, stop)
+	}()
+	select {
+	case e = <-done:
+		return e
+	case <-ctx.Done():
+	}
+	close(stop)
+	if s.PollInterval <= 0 {
+		s.closeListeners(conns)
+	}
+	<-done
+	drainCtx, cancel := context.WithTimeout(context.Background(), s.DrainTimeout)
+	s.drain(drainCtx)
+	cancel()
+	s.pool.closeAll()
+	return fmt.Errorf("Server stopped: %w", ctx.Err())
+}
+
+// Shutdown stops the server: it closes the listening sockets of all serve
+// loops, which return ErrServerClosed, and waits for the transfers in
+// flight to finish. Once ctx is done the remaining transfers are aborted
+// and ctx.Err() is returned. The server cannot be served again afterwards.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdown.Store(true)
+	s.mu.Lock()
+	conns := make([]*net.UDPConn, 0, len(s.listeners))
+	for conn := range s.listeners {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+	s.closeListeners(conns)
+	e := s.drain(ctx)
+	s.pool.closeAll()
+	return e
+}
+
+// Drain puts the server into draining mode, for maintenance such as a
+// rolling deploy: new requests get ERROR code 0 while the transfers in
+// flight run to completion. Unlike Shutdown the server keeps listening and
+// resumes accepting requests after Undrain.
+func (s *Server) Drain() {
+	s.draining.Store(true)
+}
+
+// Undrain makes a draining server accept new requests again.
+func (s *Server) Undrain() {
+	s.draining.Store(false)
+}
+
+// Draining reports whether the server is in draining mode.
+func (s *Server) Draining() bool {
+	return s.draining.Load()
+}
+
+// listen binds BindAddr and BindAddrs.
+func (s *Server) listen() ([]*net.UDPConn, error) {
+	if e := s.Validate(); e != nil {
+		return nil, fmt.Errorf("Invalid server configuration: %v", e)
+	}
+	addrs := append([]*net.UDPAddr{s.BindAddr}, s.BindAddrs...)
+	var conns []*net.UDPConn
+	for _, addr := range addrs {
+		network := "udp"
+		if len(addrs) > 1 {
+			network = transmissionNetwork(addr)
+		}
+		conn, e := s.listenOn(network, addr)
+		if e != nil && s.dualStack && network == "udp6" && ipv6Unavailable(e) {
+			s.logf(LogInfo, "Not listening on %v, IPv6 is unavailable: %v", addr, e)
+			continue
+		}
+		if e != nil {
+			closeAll(conns)
+			return nil, e
+		}
+		conns = append(conns, conn)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutdown.Load() {
+		closeAll(conns)
+		return nil, ErrServerClosed
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[*net.UDPConn]struct{})
+	}
+	for _, conn := range conns {
+		s.listeners[conn] = struct{}{}
+	}
+	return conns, nil
+}
+
+func (s *Server) listenOn(network string, addr *net.UDPAddr) (*net.UDPConn, error) {
+	conn, e := net.ListenUDP(network, addr)
+	if e != nil {
+		return nil, e
+	}
+	if e = s.configureConn(conn); e != nil {
+		conn.Close()
+		return nil, e
+	}
+	if e = s.configureListener(conn); e != nil {
+		conn.Close()
+		return nil, e
+	}
+	if e = s.configureHook(conn); e != nil {
+		conn.Close()
+		return nil, e
+	}
+	return conn, nil
+}
+
+// ipv6Unavailable reports whether e is the error binding an IPv6 socket
+// fails with on a host without IPv6.
+func ipv6Unavailable(e error) bool {
+	return errors.Is(e, syscall.EAFNOSUPPORT) || errors.Is(e, syscall.EADDRNOTAVAIL)
+}
+
+// serve runs a serve loop on every listening socket. When the first loop
+// stops, the other sockets are closed too, and its error is returned once
+// all loops have stopped.
+func (s *Server) serve(conns []*net.UDPConn, stop <-chan struct{}) error {
+	done := make(chan error, len(conns))
+	for _, conn := range conns {
+		go func(conn *net.UDPConn) {
+			done <- s.run(conn, stop)
+		}(conn)
+	}
+	e := <-done
+	s.closeListeners(conns)
+	for i := 1; i < len(conns); i++ {
+		<-done
+	}
+	return e
+}
+
+// closeListeners closes the listening sockets conns and forgets them. It
+// returns the first error of closing a socket not closed before.
+func (s *Server) closeListeners(conns []*net.UDPConn) error {
+	var first error
+	for _, conn := range conns {
+		s.mu.Lock()
+		_, open := s.listeners[conn]
+		delete(s.listeners, conn)
+		s.mu.Unlock()
+		if e := conn.Close(); e != nil && open && first == nil {
+			first = e
+		}
+	}
+	return first
+}
+
+func closeAll(conns []*net.UDPConn) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// listenerCloser is the io.Closer returned by Listen.
+type listenerCloser struct {
+	s     *Server
+	conns []*net.UDPConn
+	// stopped is closed once the serve loops have stopped.
+	stopped chan struct{}
+}
+
+func (c *listenerCloser) Close() error {
+	e := c.s.closeListeners(c.conns)
+	// No transfer can start once the serve loops have stopped, so aborting
+	// the transfers afterwards leaves none behind.
+	<-c.stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.s.drain(ctx)
+	c.s.pool.closeAll()
+	return e
+}
+
+// configureConn applies the socket options requested on the server to a
+// freshly opened listening or transmission socket.
+func (s *Server) configureConn(conn *net.UDPConn) error {
+	if s.DSCP != 0 {
+		if s.DSCP < 0 || s.DSCP > 63 {
+			return fmt.Errorf("Invalid DSCP value: %d", s.DSCP)
+		}
+		if e := setDSCP(conn, s.DSCP); e != nil {
+			return fmt.Errorf("Could not set DSCP: %v", e)
+		}
+	}
+	if s.DisableFragmentation {
+		if e := setDontFragment(conn); e != nil {
+			return fmt.Errorf("Could not disable fragmentation: %v", e)
+		}
+	}
+	return nil
+}
+
+// configureListener applies the settings only relevant to the listening
+// socket.
+func (s *Server) configureListener(conn *net.UDPConn) error {
+	if s.RecordInterface {
+		if e := enablePacketInfo(conn); e != nil {
+			return fmt.Errorf("Could not record arrival interfaces: %v", e)
+		}
+	}
+	return nil
+}
+
+// configureHook calls ConfigureConn, if set, with conn.
+func (s *Server) configureHook(conn *net.UDPConn) error {
+	if s.ConfigureConn == nil {
+		return nil
+	}
+	if e := s.ConfigureConn(conn); e != nil {
+		return fmt.Errorf("Could not configure socket: %v", e)
+	}
+	return nil
 }
 
-func (s *Server) run(conn *net.UDPConn) error {
-	buffer := make([]byte, MAX_DATAGRAM_SIZE)
+// temporary reports whether e is a transient socket error. net.Error's
+// Temporary method is deprecated because most errors it covers are not
+// actually transient, so only resource shortages are retried here.
+func temporary(e net.Error) bool {
+	return errors.Is(e, syscall.ENOBUFS) || errors.Is(e, syscall.ENOMEM) ||
+		errors.Is(e, syscall.EAGAIN) || errors.Is(e, syscall.EINTR)
+}
+
+// run serves requests arriving on conn until reading fails or stop is
+// closed. A nil stop never closes.
+func (s *Server) run(conn *net.UDPConn, stop <-chan struct{}) error {
+	// Requests carrying options can exceed MAX_DATAGRAM_SIZE; size the
+	// buffer for the largest packet so none is ever truncated.
+	buffer := make([]byte, MAX_PACKET_SIZE)
+	oob := make([]byte, 128)
+	polling := s.PollInterval > 0 && stop != nil
+	// tempDelay backs off reads failing with temporary errors, such as a
+	// momentary lack of buffer space, instead of giving up on the socket.
+	var tempDelay time.Duration
 	for {
-		n, remoteAddr, e := conn.ReadFromUDP(buffer)
+		if polling {
+			if aborted(stop) {
+				return ErrServerClosed
+			}
+			if e := conn.SetReadDeadline(time.Now().Add(s.PollInterval)); e != nil {
+				return e
+			}
+		}
+		var n, ifIndex int
+		var remoteAddr *net.UDPAddr
+		var e error
+		if s.RecordInterface {
+			var oobn int
+			n, oobn, _, remoteAddr, e = conn.ReadMsgUDP(buffer, oob)
+			ifIndex = packetInterface(oob[:oobn])
+		} else {
+			n, remoteAddr, e = conn.ReadFromUDP(buffer)
+		}
 		if e != nil {
-			if s.Log != nil {
-				s.Log.Println("Failed to read data from client:", e)
+			if networkError, ok := e.(net.Error); ok && networkError.Timeout() && polling {
+				continue
+			}
+			if aborted(stop) || s.shutdown.Load() {
+				return ErrServerClosed
 			}
+			if networkError, ok := e.(net.Error); ok && !errors.Is(e, net.ErrClosed) &&
+				(networkError.Timeout() || temporary(networkError)) {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else if tempDelay *= 2; tempDelay > time.Second {
+					tempDelay = time.Second
+				}
+				s.logf(LogError, "Failed to read data from client: %v; retrying in %v", e, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			s.logf(LogError, "Failed to read data from client: %v", e)
 			return e
 		}
+		tempDelay = 0
 
-		if e = s.processRequest(buffer[:n], remoteAddr); e != nil {
-			if s.Log != nil {
-				s.Log.Println(e)
-			}
+		if e = s.processRequest(conn, buffer[:n], remoteAddr, ifIndex); e != nil {
+			s.peerLog(remoteAddr).Errorf("%v", e)
 		}
 	}
 }
 
-func (s *Server) processRequest(buffer []byte, remoteAddr *net.UDPAddr) error {
-	p, e := ParsePacket(buffer)
+func (s *Server) processRequest(conn *net.UDPConn, buffer []byte, remoteAddr *net.UDPAddr, ifIndex int) error {
+	if !s.clientAllowed(remoteAddr) {
+		if s.RejectClients {
+			return s.sendError(conn, s.peerLog(remoteAddr), remoteAddr, ERR_ACCESS_VIOLATION, "Access violation")
+		}
+		s.peerLog(remoteAddr).Debugf("Dropping packet from outside AllowedClients")
+		return nil
+	}
+	p, e := ParseWithLimits(buffer, OptionLimits{s.MaxOptions, s.MaxOptionBytes})
+	if errors.Is(e, ErrOptionLimit) {
+		if op := Opcode(p); op == OP_RRQ || op == OP_WRQ {
+			return s.sendError(conn, s.peerLog(remoteAddr), remoteAddr, ERR_OPTION_NEGOTIATION, "Too many options")
+		}
+	}
 	if e != nil {
+		s.unknownPacket(buffer, remoteAddr)
 		return nil
 	}
-	switch p := Packet(*p).(type) {
+	var l *transferLog
+	var mode string
+	if op := Opcode(p); op == OP_RRQ || op == OP_WRQ {
+		var ok bool
+		if l, mode, ok, e = s.admitRequest(conn, remoteAddr, p); !ok {
+			return e
+		}
+	}
+	switch p := p.(type) {
 	case *WRQ:
-		s.Log.Printf("got WRQ (filename=%s, mode=%s)", p.Filename, p.Mode)
-		trasnmissionConn, e := s.transmissionConn()
+		readHandler, uploadFunc := s.readHandler(), s.UploadFunc
+		if t := s.selfTestFile(p.Filename); t != nil {
+			readHandler, uploadFunc = nil, t.upload
+		}
+		if readHandler == nil && uploadFunc == nil {
+			return s.sendError(conn, l, remoteAddr, ERR_ILLEGAL_OP, "Write requests are not supported")
+		}
+		if s.FileExists != nil && s.FileExists(p.Filename) {
+			return s.sendError(conn, l, remoteAddr, ERR_FILE_EXISTS, "File already exists")
+		}
+		req := newRequest(conn, buffer, remoteAddr, ifIndex, p, p.Filename, mode)
+		accepted, options, e := s.negotiateRequest(req, sourcePipe)
+		if e == errFileTooLarge {
+			return s.sendError(conn, l, remoteAddr, ERR_DISK_FULL, e.Error())
+		} else if e != nil {
+			return s.sendError(conn, l, remoteAddr, ERR_OPTION_NEGOTIATION, e.Error())
+		}
+		trasnmissionConn, e := s.transmissionConn(remoteAddr, l)
 		if e != nil {
-			return fmt.Errorf("Could not start transmission: %v", e)
+			return s.transmissionFailed(conn, l, remoteAddr, e)
 		}
+		done := s.transferContext(req)
 		reader, writer := io.Pipe()
-		r := &receiver{remoteAddr, trasnmissionConn, writer, p.Filename, p.Mode, s.Log}
-		go s.ReadHandler(p.Filename, reader)
-		// Writing zero bytes to the pipe just to check for any handler errors early
-		var null_buffer = make([]byte, 0)
-		_, e = writer.Write(null_buffer)
-		if e != nil {
-			errorPacket := ERROR{1, e.Error()}
-			trasnmissionConn.WriteToUDP(errorPacket.Pack(), remoteAddr)
-			s.Log.Printf("sent ERROR (code=%d): %s", 1, e.Error())
-			return e
+		if readHandler != nil {
+			go s.callReadHandler(readHandler, req, reader, l)
+		}
+		if readHandler != nil && !s.DisableWriteProbe {
+			// Writing zero bytes to the pipe just to check for any handler errors early
+			var null_buffer = make([]byte, 0)
+			_, e = writer.Write(null_buffer)
+			if e != nil {
+				sendErrorPacket(trasnmissionConn, l, remoteAddr, handlerErrorCode(e), e, s.ErrorMessageFunc)
+				s.closeTransmissionConn(trasnmissionConn, remoteAddr)
+				done()
+				return e
+			}
+		}
+		early := newEarlyConn(s.packetConn(trasnmissionConn))
+		t := s.startTransfer(p.Filename, mode, DirectionWrite, remoteAddr, trasnmissionConn, early, writer.CloseWithError)
+		t.done = done
+		r := &receiver{
+			remoteAddr:      remoteAddr,
+			conn:            s.capture(t, early, localAddr(trasnmissionConn), localAddr(conn), buffer),
+			writer:          writer,
+			filename:        p.Filename,
+			mode:            mode,
+			log:             l.with(Field{"id", t.ID}),
+			cancel:          t.cancel,
+			summary:         s.LogTransfers,
+			maxBytes:        s.MaxFileSize,
+			wrapTo:          s.BlockWrapTo,
+			jitter:          s.retransmitJitter(),
+			errorMessage:    s.ErrorMessageFunc,
+			backoff:         s.BackoffFunc,
+			total:           &s.totalBytes,
+			retransmits:     &s.stats.retransmits,
+			rate:            rateMonitor{min: s.MinThroughput, window: s.minThroughputWindow()},
+			handlerTimeout:  s.HandlerWriteTimeout,
+			buffer:          s.pipeBufferBlocks(),
+			idle:            idleClock{timeout: s.IdleTimeout},
+			clock:           s.clock,
+			adoptPort:       s.AdoptPeerPort,
+			transform:       s.BlockTransform,
+			windowSize:      options.windowSize,
+			blockSize:       options.blockSize,
+			timeout:         options.timeout,
+			rejectDowngrade: s.RejectDowngrade,
+		}
+		if accepted != nil {
+			r.handshake = &OACK{Options: accepted}
+		}
+		if readHandler == nil {
+			filename := p.Filename
+			r.openSink = func() (io.Writer, error) {
+				return uploadFunc(filename, mode)
+			}
 		}
-		go r.Run(true)
+		go func() {
+			e := r.Run(true)
+			s.finishTransfer(t, r.bytes, e)
+		}()
 	case *RRQ:
-		s.Log.Printf("got RRQ (filename=%s, mode=%s)", p.Filename, p.Mode)
-		trasnmissionConn, e := s.transmissionConn()
+		writeHandler := s.writeHandler()
+		fallback := s.NotFoundFallback
+		if s.isHealthCheck(p.Filename) {
+			writeHandler, fallback = writeHealthCheck, nil
+		} else if t := s.selfTestFile(p.Filename); t != nil {
+			writeHandler, fallback = t.download, nil
+		} else if s.isListRequest(p.Filename) {
+			writeHandler, fallback = s.writeListing, nil
+		} else if s.Cache != nil && writeHandler != nil {
+			writeHandler = s.cachedHandler(writeHandler, l)
+		}
+		if writeHandler == nil && s.ContentFunc == nil && s.BlockFunc == nil {
+			return s.sendError(conn, l, remoteAddr, ERR_ILLEGAL_OP, "Read requests are not supported")
+		}
+		req := newRequest(conn, buffer, remoteAddr, ifIndex, p, p.Filename, mode)
+		source := s.downloadSource(p.Filename)
+		accepted, options, e := s.negotiateRequest(req, source)
 		if e != nil {
-			return fmt.Errorf("Could not start transmission: %v", e)
+			return s.sendError(conn, l, remoteAddr, ERR_OPTION_NEGOTIATION, e.Error())
 		}
+		trasnmissionConn, e := s.transmissionConn(remoteAddr, l)
+		if e != nil {
+			return s.transmissionFailed(conn, l, remoteAddr, e)
+		}
+		done := s.transferContext(req)
 		reader, writer := io.Pipe()
-		r := &sender{remoteAddr, trasnmissionConn, reader, p.Filename, p.Mode, s.Log}
-		go s.WriteHandler(p.Filename, writer)
-		go r.Run(true)
+		t := s.startTransfer(p.Filename, mode, DirectionRead, remoteAddr, trasnmissionConn, nil, reader.CloseWithError)
+		t.done = done
+		r := &sender{
+			remoteAddr:   remoteAddr,
+			conn:         s.capture(t, s.packetConn(trasnmissionConn), localAddr(trasnmissionConn), localAddr(conn), buffer),
+			reader:       reader,
+			filename:     p.Filename,
+			mode:         mode,
+			log:          l.with(Field{"id", t.ID}),
+			cancel:       t.cancel,
+			summary:      s.LogTransfers,
+			wrapTo:       s.BlockWrapTo,
+			jitter:       s.retransmitJitter(),
+			errorMessage: s.ErrorMessageFunc,
+			backoff:      s.BackoffFunc,
+			total:        &s.totalBytes,
+			retransmits:  &s.stats.retransmits,
+			rate:         rateMonitor{min: s.MinThroughput, window: s.minThroughputWindow()},
+			idle:         idleClock{timeout: s.IdleTimeout},
+			clock:        s.clock,
+			adoptPort:    s.AdoptPeerPort,
+			transform:    s.BlockTransform,
+			delay:        s.InterBlockDelay,
+			buffer:       s.pipeBufferBlocks(),
+			dallyTimeout: s.DallyTimeout,
+			dallyResend:  s.DallyResend,
+			windowSize:   options.windowSize,
+			blockSize:    options.blockSize,
+			timeout:      options.timeout,
+			startBlock:   options.startBlock,
+			compress:     options.compress,
+		}
+		if accepted != nil {
+			r.handshake = &OACK{Options: accepted}
+		}
+		if writeHandler != nil {
+			go s.callWriteHandler(writeHandler, req, writer, l)
+			if fallback != nil {
+				filename := p.Filename
+				r.fallback = func() (io.Reader, error) {
+					return fallback(filename)
+				}
+			}
+		} else if source == sourceContent {
+			// The pipe stays unused, but closing it still aborts the
+			// transfer like any other.
+			filename := p.Filename
+			r.openContent = func() (io.ReadSeeker, int64, error) {
+				return s.ContentFunc(filename, mode)
+			}
+			r.transferSize = options.transferSize
+			if fallback != nil {
+				r.fallback = func() (io.Reader, error) {
+					return fallback(filename)
+				}
+			}
+		} else {
+			// As above, the pipe stays unused.
+			filename := p.Filename
+			r.openSource = func() (BlockReader, error) {
+				return s.BlockFunc(filename, mode)
+			}
+		}
+		go func() {
+			e := r.Run(true)
+			s.finishTransfer(t, r.bytes, e)
+		}()
+	case *DATA:
+		// A client sending block 1 right behind its WRQ, without waiting
+		// for the ACK, does not know the transfer ID yet.
+		if !s.earlyData(buffer, remoteAddr) {
+			s.unknownPacket(buffer, remoteAddr)
+		}
+	default:
+		// ACK and ERROR only make sense on a transfer's own socket.
+		s.unknownPacket(buffer, remoteAddr)
 	}
 	return nil
 }
 
-func (s *Server) transmissionConn() (*net.UDPConn, error) {
-	addr, e := net.ResolveUDPAddr("udp", ":0")
+// admitRequest applies the checks an RRQ or WRQ p goes through before its
+// handler is looked up, and returns the log and transfer mode of the
+// request. ok is false if p is dropped as a duplicate, or refused with e.
+func (s *Server) admitRequest(conn *net.UDPConn, remoteAddr *net.UDPAddr, p Packet) (l *transferLog, mode string, ok bool, e error) {
+	op, direction := OP_RRQ, DirectionRead
+	var filename, requestMode string
+	switch p := p.(type) {
+	case *RRQ:
+		filename, requestMode = p.Filename, p.Mode
+	case *WRQ:
+		op, direction = OP_WRQ, DirectionWrite
+		filename, requestMode = p.Filename, p.Mode
+	}
+	l = s.requestLog(remoteAddr, filename, op)
+	l.Infof("got %s (filename=%s, mode=%s)", opName(op), filename, requestMode)
+	if s.inFlight(remoteAddr, filename, direction) {
+		// The client retransmitted its request because our first
+		// packet was lost; the transfer already under way resends it.
+		l.Infof("Ignoring duplicate %s", opName(op))
+		return l, "", false, nil
+	}
+	if s.OnRequest != nil {
+		s.OnRequest(op, filename, requestMode, remoteAddr)
+	}
+	if s.draining.Load() {
+		return l, "", false, s.sendError(conn, l, remoteAddr, ERR_UNDEFINED, "Server draining")
+	}
+	if s.MaxTransfers > 0 && s.ActiveTransfers() >= s.MaxTransfers {
+		return l, "", false, s.sendError(conn, l, remoteAddr, ERR_UNDEFINED, "Server busy")
+	}
+	if filename == "" {
+		// Sent by broken clients and fuzzers; no handler should have
+		// to make sense of it.
+		return l, "", false, s.sendError(conn, l, remoteAddr, ERR_ACCESS_VIOLATION, "Access violation")
+	}
+	if mode, ok = s.requestMode(requestMode); !ok {
+		return l, "", false, s.sendError(conn, l, remoteAddr, ERR_ILLEGAL_OP, "Unknown transfer mode")
+	}
+	if s.MaxTotalBytes > 0 && s.TotalBytesTransferred() >= s.MaxTotalBytes {
+		return l, "", false, s.sendError(conn, l, remoteAddr, ERR_UNDEFINED, "Quota exceeded")
+	}
+	if !s.filenameAllowed(filename) {
+		return l, "", false, s.sendError(conn, l, remoteAddr, ERR_ACCESS_VIOLATION, "Access violation")
+	}
+	return l, mode, true, nil
+}
+
+// packetConn returns the connection the transfer loops use for conn.
+func (s *Server) packetConn(conn *net.UDPConn) packetConn {
+	if s.wrapConn != nil {
+		return s.wrapConn(conn)
+	}
+	return conn
+}
+
+// unknownPacket passes a datagram the serve loop has no use for to
+// UnknownOpcodeHandler, or drops it.
+func (s *Server) unknownPacket(buffer []byte, remoteAddr *net.UDPAddr) {
+	if s.UnknownOpcodeHandler == nil {
+		s.peerLog(remoteAddr).Debugf("Dropping unexpected packet (%d bytes)", len(buffer))
+		return
+	}
+	raw := make([]byte, len(buffer))
+	copy(raw, buffer)
+	s.UnknownOpcodeHandler(raw, remoteAddr)
+}
+
+// downloadSource tells how a read request is served, which decides the
+// options its download takes.
+type downloadSource int
+
+const (
+	// sourcePipe is a handler writing to a pipe.
+	sourcePipe downloadSource = iota
+	// sourceContent is ContentFunc, whose size answers tsize.
+	sourceContent
+	// sourceBlocks is BlockFunc, whose blocks are BLOCK_SIZE and read
+	// from the first.
+	sourceBlocks
+)
+
+// downloadSource returns how a read of filename is served.
+func (s *Server) downloadSource(filename string) downloadSource {
+	switch {
+	case s.writeHandler() != nil || s.isHealthCheck(filename) ||
+		s.selfTestFile(filename) != nil || s.isListRequest(filename):
+		return sourcePipe
+	case s.ContentFunc != nil:
+		return sourceContent
+	}
+	return sourceBlocks
+}
+
+func (s *Server) isListRequest(filename string) bool {
+	if !s.EnableListing || s.ListFunc == nil {
+		return false
+	}
+	listFilename := s.ListFilename
+	if listFilename == "" {
+		listFilename = DEFAULT_LIST_FILENAME
+	}
+	return filename == listFilename
+}
+
+func (s *Server) isHealthCheck(filename string) bool {
+	if !s.EnableHealthCheck {
+		return false
+	}
+	healthCheckFilename := s.HealthCheckFilename
+	if healthCheckFilename == "" {
+		healthCheckFilename = DEFAULT_HEALTH_CHECK_FILENAME
+	}
+	return filename == healthCheckFilename
+}
+
+// writeHealthCheck is the WriteHandler used for the health check
+// pseudo-file.
+func writeHealthCheck(req *Request, w *io.PipeWriter) {
+	if _, e := io.WriteString(w, "OK\n"); e != nil {
+		return
+	}
+	w.Close()
+}
+
+// writeListing is the WriteHandler used for the listing pseudo-file.
+func (s *Server) writeListing(req *Request, w *io.PipeWriter) {
+	names, e := s.ListFunc()
 	if e != nil {
-		return nil, e
+		w.CloseWithError(e)
+		return
+	}
+	for _, name := range names {
+		if _, e = io.WriteString(w, name+"\n"); e != nil {
+			return
+		}
 	}
-	conn, e := net.ListenUDP("udp", addr)
+	w.Close()
+}
+
+func (s *Server) minThroughputWindow() time.Duration {
+	if s.MinThroughputWindow == 0 {
+		return DEFAULT_MIN_THROUGHPUT_WINDOW
+	}
+	return s.MinThroughputWindow
+}
+
+func (s *Server) pipeBufferBlocks() int {
+	if s.PipeBufferBlocks == 0 {
+		return DEFAULT_PIPE_BUFFER_BLOCKS
+	}
+	return s.PipeBufferBlocks
+}
+
+func (s *Server) retransmitJitter() float64 {
+	if s.RetransmitJitter == 0 {
+		return DEFAULT_RETRANSMIT_JITTER
+	}
+	return s.RetransmitJitter
+}
+
+// logf writes to the server log, if there is one.
+func (s *Server) logf(level LogLevel, format string, v ...interface{}) {
+	newTransferLog(s.Log, s.LogLevel).logf(level, format, v...)
+}
+
+// peerLog returns the log for packets from remoteAddr. Every line about a
+// request or transfer carries the peer, so lines can be correlated.
+func (s *Server) peerLog(remoteAddr *net.UDPAddr) *transferLog {
+	return newTransferLog(s.Log, s.LogLevel, Field{"peer", remoteAddr})
+}
+
+// requestLog returns the log for a request, tagged with its fields. The
+// transfer ID is added once the transfer starts.
+func (s *Server) requestLog(remoteAddr *net.UDPAddr, filename string, op uint16) *transferLog {
+	return s.peerLog(remoteAddr).with(
+		Field{"filename", filename},
+		Field{"op", opName(op)})
+}
+
+// sendError replies to remoteAddr with an ERROR packet from conn and returns
+// the error for the caller to log.
+func (s *Server) sendError(conn *net.UDPConn, l *transferLog, remoteAddr *net.UDPAddr, code uint16, message string) error {
+	sendErrorPacket(conn, l, remoteAddr, code, errors.New(message), s.ErrorMessageFunc)
+	return fmt.Errorf("Rejected request: %s", message)
+}
+
+// transmissionFailed tells remoteAddr from the listening socket that its
+// request cannot be served because no transfer socket could be opened, so
+// the client fails fast instead of timing out.
+func (s *Server) transmissionFailed(conn *net.UDPConn, l *transferLog, remoteAddr *net.UDPAddr, e error) error {
+	sendErrorPacket(conn, l, remoteAddr, ERR_UNDEFINED, errResourceExhausted, s.ErrorMessageFunc)
+	return fmt.Errorf("Could not start transmission: %v", e)
+}
+
+// transmissionConn opens the socket used for a single transfer with
+// remoteAddr. The socket family follows the client's address, so replies to
+// IPv4 clients of a dual-stack listener do not leave from an IPv6 socket.
+// With ConnectPeer, where the platform allows, the socket is connected to
+// the client, which makes the ICMP errors of the client's host surface as
+// PeerUnreachable.
+func (s *Server) transmissionConn(remoteAddr *net.UDPAddr, l *transferLog) (*net.UDPConn, error) {
+	if s.pooling() {
+		if conn := s.pool.lease(transmissionNetwork(remoteAddr)); conn != nil {
+			return conn, nil
+		}
+	}
+	conn, e := s.openTransmissionConn(remoteAddr, l)
 	if e != nil {
 		return nil, e
 	}
+	if e = s.configureConn(conn); e != nil {
+		conn.Close()
+		return nil, e
+	}
+	if e = s.configureHook(conn); e != nil {
+		conn.Close()
+		return nil, e
+	}
+	if s.AdvertisedAddr != "" {
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+		l.Debugf("transmission port %d (advertised as %s)", port,
+			net.JoinHostPort(s.AdvertisedAddr, strconv.Itoa(port)))
+	}
+	// Pooled sockets serve other clients later, and AdoptPeerPort has to
+	// see packets from the client's new port, so those stay unconnected.
+	if s.ConnectPeer && !s.pooling() && !s.AdoptPeerPort {
+		if e = connectPeer(conn, remoteAddr); e != nil {
+			l.Debugf("Could not connect transmission socket: %v", e)
+		}
+	}
 	return conn, nil
 }
+
+func (s *Server) openTransmissionConn(remoteAddr *net.UDPAddr, l *transferLog) (*net.UDPConn, error) {
+	if s.TransmissionConnFunc != nil {
+		return s.TransmissionConnFunc(remoteAddr)
+	}
+	network := transmissionNetwork(remoteAddr)
+	if s.TransmissionPortFunc != nil {
+		if port := s.TransmissionPortFunc(remoteAddr); port != 0 {
+			conn, e := net.ListenUDP(network, &net.UDPAddr{Port: port})
+			if e == nil {
+				return conn, nil
+			}
+			l.Debugf("transmission port %d unavailable, falling back: %v", port, e)
+		}
+	}
+	if s.PortRange != nil {
+		return s.listenInRange(network, s.PortRange)
+	}
+	addr, e := net.ResolveUDPAddr(network, ":0")
+	if e != nil {
+		return nil, e
+	}
+	return net.ListenUDP(network, addr)
+}
+
+// listenInRange binds the first free port of r, starting after the port
+// handed out last so consecutive transfers spread over the range.
+func (s *Server) listenInRange(network string, r *PortRange) (*net.UDPConn, error) {
+	if r.Min <= 0 || r.Max > 65535 || r.Min > r.Max {
+		return nil, fmt.Errorf("Invalid port range: %d-%d", r.Min, r.Max)
+	}
+	size := r.Max - r.Min + 1
+	s.mu.Lock()
+	start := s.nextPort
+	s.nextPort = (s.nextPort + 1) % size
+	s.mu.Unlock()
+	for i := 0; i < size; i++ {
+		port := r.Min + (start+i)%size
+		conn, e := net.ListenUDP(network, &net.UDPAddr{Port: port})
+		if e == nil {
+			return conn, nil
+		}
+	}
+	return nil, fmt.Errorf("No free port in range %d-%d", r.Min, r.Max)
+}
+
+func localAddr(conn *net.UDPConn) *net.UDPAddr {
+	addr, _ := conn.LocalAddr().(*net.UDPAddr)
+	return addr
+}
+
+// transmissionNetwork returns "udp4" or "udp6" depending on the family of
+// remoteAddr. IPv4-mapped IPv6 addresses are treated as IPv4.
+func transmissionNetwork(remoteAddr *net.UDPAddr) string {
+	if remoteAddr == nil || remoteAddr.IP == nil {
+		return "udp"
+	}
+	if remoteAddr.IP.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
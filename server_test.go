@@ -0,0 +1,768 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startTestServer serves s on a loopback port until the test ends and
+// returns its address.
+func startTestServer(t testing.TB, s *Server) *net.UDPAddr {
+	t.Helper()
+	if s.BindAddr == nil {
+		s.BindAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	}
+	closer, addr, e := s.Listen()
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { closer.Close() })
+	serverAddr, e := net.ResolveUDPAddr("udp", addr)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return serverAddr
+}
+
+// rawClient speaks TFTP to a server packet by packet, for checking its
+// replies.
+type rawClient struct {
+	t      *testing.T
+	conn   *net.UDPConn
+	server *net.UDPAddr
+}
+
+func newRawClient(t *testing.T, server *net.UDPAddr) *rawClient {
+	t.Helper()
+	network := "udp4"
+	if server.IP.To4() == nil {
+		network = "udp6"
+	}
+	conn, e := net.ListenUDP(network, &net.UDPAddr{IP: server.IP})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &rawClient{t: t, conn: conn, server: server}
+}
+
+// send sends p to addr, the listening socket if nil.
+func (c *rawClient) send(p Packet, addr *net.UDPAddr) {
+	c.t.Helper()
+	if addr == nil {
+		addr = c.server
+	}
+	if _, e := c.conn.WriteToUDP(p.Pack(), addr); e != nil {
+		c.t.Fatal(e)
+	}
+}
+
+// receive returns the next packet and where it came from.
+func (c *rawClient) receive() (Packet, *net.UDPAddr) {
+	c.t.Helper()
+	buffer := make([]byte, MAX_PACKET_SIZE)
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, addr, e := c.conn.ReadFromUDP(buffer)
+	if e != nil {
+		c.t.Fatal(e)
+	}
+	p, e := Parse(buffer[:n])
+	if e != nil {
+		c.t.Fatal(e)
+	}
+	return p, addr
+}
+
+// receiveError fails the test unless the next packet is an ERROR with
+// code.
+func (c *rawClient) receiveError(code uint16) *ERROR {
+	c.t.Helper()
+	p, _ := c.receive()
+	e, ok := p.(*ERROR)
+	if !ok || e.ErrorCode != code {
+		c.t.Fatalf("Got %#v, want ERROR code %d", p, code)
+	}
+	return e
+}
+
+// receiveData fails the test unless the next packet is DATA block n.
+func (c *rawClient) receiveData(n uint16) (*DATA, *net.UDPAddr) {
+	c.t.Helper()
+	p, addr := c.receive()
+	d, ok := p.(*DATA)
+	if !ok || d.BlockNumber != n {
+		c.t.Fatalf("Got %#v, want DATA #%d", p, n)
+	}
+	return d, addr
+}
+
+// silent fails the test if a packet arrives within d.
+func (c *rawClient) silent(d time.Duration) {
+	c.t.Helper()
+	buffer := make([]byte, MAX_PACKET_SIZE)
+	c.conn.SetReadDeadline(time.Now().Add(d))
+	if n, _, e := c.conn.ReadFromUDP(buffer); e == nil {
+		p, _ := Parse(buffer[:n])
+		c.t.Fatalf("Got %#v", p)
+	}
+}
+
+// shortBackoff retransmits quickly, so lost packets do not slow tests.
+func shortBackoff(attempt int) time.Duration {
+	return 20 * time.Millisecond
+}
+
+// serveBytes returns a WriteHandler serving content for any file.
+func serveBytes(content []byte) func(filename string, w *io.PipeWriter) {
+	return func(filename string, w *io.PipeWriter) {
+		w.Write(content)
+		w.Close()
+	}
+}
+
+// download fetches filename from addr with a Client.
+func download(t testing.TB, addr *net.UDPAddr, filename string) ([]byte, error) {
+	t.Helper()
+	var data []byte
+	c := Client{RemoteAddr: addr}
+	e := c.Get(filename, "octet", func(r *io.PipeReader) {
+		data, _ = io.ReadAll(r)
+	})
+	return data, e
+}
+
+func TestServerPacketLoss(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 3*BLOCK_SIZE)
+	results := make(chan TransferResult, 1)
+	s := &Server{
+		WriteHandler: serveBytes(content),
+		BackoffFunc:  shortBackoff,
+		wrapConn: func(conn packetConn) packetConn {
+			return &dropConn{packetConn: conn, drop: dropPacket(OP_DATA, 2, 2)}
+		},
+		OnTransferComplete: func(result TransferResult) { results <- result },
+	}
+	addr := startTestServer(t, s)
+	data, e := download(t, addr, "file")
+	if e != nil || !bytes.Equal(data, content) {
+		t.Fatalf("Downloaded %d bytes, %v", len(data), e)
+	}
+	if result := <-results; result.Outcome != Completed {
+		t.Errorf("Outcome %v (%v)", result.Outcome, result.Err)
+	}
+	if n := s.Stats().Retransmits; n != 2 {
+		t.Errorf("%d retransmits", n)
+	}
+}
+
+func TestServerTransferIDs(t *testing.T) {
+	release := make(chan struct{})
+	results := make(chan TransferResult, 2)
+	next := uint64(100)
+	s := &Server{
+		WriteHandler: func(filename string, w *io.PipeWriter) {
+			if filename == "held" {
+				<-release
+			}
+			w.Write([]byte("content"))
+			w.Close()
+		},
+		newID: func() uint64 {
+			next += 100
+			return next
+		},
+		OnTransferComplete: func(result TransferResult) { results <- result },
+	}
+	addr := startTestServer(t, s)
+	if _, e := download(t, addr, "file"); e != nil {
+		t.Fatal(e)
+	}
+	if result := <-results; result.ID != 200 {
+		t.Errorf("ID %d, want 200", result.ID)
+	}
+	aborted := make(chan error, 1)
+	go func() {
+		c := Client{RemoteAddr: addr}
+		aborted <- c.Get("held", "octet", func(r *io.PipeReader) { io.ReadAll(r) })
+	}()
+	for len(s.Transfers()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if transfers := s.Transfers(); transfers[0].ID != 300 {
+		t.Errorf("ID %d, want 300", transfers[0].ID)
+	}
+	if e := s.AbortTransfer(300); e != nil {
+		t.Error(e)
+	}
+	close(release)
+	if result := <-results; result.ID != 300 || result.Outcome != Aborted {
+		t.Errorf("ID %d, outcome %v", result.ID, result.Outcome)
+	}
+	if e := <-aborted; e == nil {
+		t.Error("Aborted download succeeded")
+	}
+}
+
+func TestServerTransferClock(t *testing.T) {
+	// The clock is frozen at the start, so a pause of the transfer only
+	// ends when the test advances it.
+	clock := newFakeClock(time.Now())
+	content := bytes.Repeat([]byte("x"), BLOCK_SIZE+1)
+	s := &Server{
+		WriteHandler:    serveBytes(content),
+		InterBlockDelay: time.Hour,
+		clock:           clock,
+	}
+	addr := startTestServer(t, s)
+	done := make(chan error, 1)
+	var data []byte
+	go func() {
+		var e error
+		c := Client{RemoteAddr: addr}
+		e = c.Get("file", "octet", func(r *io.PipeReader) { data, _ = io.ReadAll(r) })
+		done <- e
+	}()
+	for clock.Timers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("Download did not pause")
+	case <-time.After(20 * time.Millisecond):
+	}
+	clock.Advance(time.Hour)
+	if e := <-done; e != nil || !bytes.Equal(data, content) {
+		t.Errorf("Downloaded %d bytes, %v", len(data), e)
+	}
+}
+
+func TestTransmissionNetwork(t *testing.T) {
+	for _, c := range []struct {
+		addr *net.UDPAddr
+		want string
+	}{
+		{nil, "udp"},
+		{&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1)}, "udp4"},
+		{&net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1")}, "udp4"},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1")}, "udp6"},
+	} {
+		if got := transmissionNetwork(c.addr); got != c.want {
+			t.Errorf("%v: got %s, want %s", c.addr, got, c.want)
+		}
+	}
+}
+
+// ipv6Loopback reports whether a socket can be bound to ::1.
+func ipv6Loopback() bool {
+	conn, e := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if e != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func TestTransmissionFamily(t *testing.T) {
+	s := &Server{
+		BindAddr:     &net.UDPAddr{},
+		WriteHandler: serveBytes([]byte("content")),
+	}
+	addr := startTestServer(t, s)
+	for _, ip := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback} {
+		if ip.To4() == nil && !ipv6Loopback() {
+			t.Log("Skipping IPv6, the loopback has no IPv6 address")
+			continue
+		}
+		// A client socket of one family only takes replies of that family.
+		c := newRawClient(t, &net.UDPAddr{IP: ip, Port: addr.Port})
+		c.send(&RRQ{Filename: "file", Mode: "octet"}, nil)
+		d, from := c.receiveData(1)
+		if string(d.Data) != "content" || (from.IP.To4() == nil) != (ip.To4() == nil) {
+			t.Errorf("%v: got %q from %v", ip, d.Data, from)
+		}
+		c.send(&ACK{BlockNumber: 1}, from)
+	}
+}
+
+func TestTransmissionConnFunc(t *testing.T) {
+	requested := make(chan *net.UDPAddr, 1)
+	s := &Server{
+		WriteHandler: serveBytes([]byte("content")),
+		TransmissionConnFunc: func(remoteAddr *net.UDPAddr) (*net.UDPConn, error) {
+			requested <- remoteAddr
+			return net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		},
+	}
+	addr := startTestServer(t, s)
+	c := newRawClient(t, addr)
+	c.send(&RRQ{Filename: "file", Mode: "octet"}, nil)
+	_, from := c.receiveData(1)
+	c.send(&ACK{BlockNumber: 1}, from)
+	if remoteAddr := <-requested; remoteAddr.Port != c.conn.LocalAddr().(*net.UDPAddr).Port {
+		t.Errorf("TransmissionConnFunc called for %v", remoteAddr)
+	}
+}
+
+func TestRequestWithoutHandler(t *testing.T) {
+	download := startTestServer(t, &Server{WriteHandler: serveBytes(nil)})
+	c := newRawClient(t, download)
+	c.send(&WRQ{Filename: "file", Mode: "octet"}, nil)
+	c.receiveError(ERR_ILLEGAL_OP)
+	upload := startTestServer(t, &Server{ReadHandler: func(filename string, r *io.PipeReader) { io.ReadAll(r) }})
+	c = newRawClient(t, upload)
+	c.send(&RRQ{Filename: "file", Mode: "octet"}, nil)
+	c.receiveError(ERR_ILLEGAL_OP)
+}
+
+func TestEmptyFile(t *testing.T) {
+	uploaded := make(chan []byte, 1)
+	s := &Server{
+		ReadHandler: func(filename string, r *io.PipeReader) {
+			data, _ := io.ReadAll(r)
+			uploaded <- data
+		},
+		WriteHandler: serveBytes(nil),
+	}
+	addr := startTestServer(t, s)
+	c := Client{RemoteAddr: addr}
+	if e := c.Put("empty", "octet", func(w *io.PipeWriter) { w.Close() }); e != nil {
+		t.Fatal(e)
+	}
+	if data := <-uploaded; len(data) != 0 {
+		t.Errorf("Uploaded %d bytes", len(data))
+	}
+	if data, e := download(t, addr, "empty"); e != nil || len(data) != 0 {
+		t.Errorf("Downloaded %d bytes, %v", len(data), e)
+	}
+	// The file is a single empty block.
+	raw := newRawClient(t, addr)
+	raw.send(&RRQ{Filename: "empty", Mode: "octet"}, nil)
+	d, from := raw.receiveData(1)
+	if len(d.Data) != 0 {
+		t.Errorf("DATA #1 of %d bytes", len(d.Data))
+	}
+	raw.send(&ACK{BlockNumber: 1}, from)
+}
+
+func TestClientVanishes(t *testing.T) {
+	results := make(chan TransferResult, 1)
+	handlerError := make(chan error, 1)
+	s := &Server{
+		WriteHandler: func(filename string, w *io.PipeWriter) {
+			block := bytes.Repeat([]byte("x"), BLOCK_SIZE)
+			for {
+				if _, e := w.Write(block); e != nil {
+					handlerError <- e
+					return
+				}
+			}
+		},
+		BackoffFunc:        shortBackoff,
+		OnTransferComplete: func(result TransferResult) { results <- result },
+	}
+	addr := startTestServer(t, s)
+	c := newRawClient(t, addr)
+	c.send(&RRQ{Filename: "endless", Mode: "octet"}, nil)
+	for n := uint16(1); n <= 3; n++ {
+		_, from := c.receiveData(n)
+		c.send(&ACK{BlockNumber: n}, from)
+	}
+	// No ACK of block 4 or later ever arrives.
+	select {
+	case result := <-results:
+		if result.Outcome != TimedOut {
+			t.Errorf("Outcome %v (%v), want %v", result.Outcome, result.Err, TimedOut)
+		}
+		if result.Bytes != 3*BLOCK_SIZE {
+			t.Errorf("%d bytes", result.Bytes)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Transfer did not time out")
+	}
+	select {
+	case e := <-handlerError:
+		if e == nil {
+			t.Error("Handler write succeeded")
+		}
+	case <-time.After(time.Second):
+		t.Error("Handler pipe not closed")
+	}
+}
+
+func TestUploadIgnoringOACK(t *testing.T) {
+	for _, blockSize := range []string{"256", "512", "1024"} {
+		uploaded := make(chan []byte, 1)
+		s := &Server{
+			ReadHandler: func(filename string, r *io.PipeReader) {
+				data, _ := io.ReadAll(r)
+				uploaded <- data
+			},
+			BackoffFunc: shortBackoff,
+		}
+		addr := startTestServer(t, s)
+		c := newRawClient(t, addr)
+		c.send(&WRQ{Filename: "file", Mode: "octet", Options: map[string]string{"blksize": blockSize}}, nil)
+		p, from := c.receive()
+		if _, ok := p.(*OACK); !ok {
+			t.Fatalf("Blksize %s: got %#v, want OACK", blockSize, p)
+		}
+		// The client goes on as if it never saw the OACK, with blocks of
+		// BLOCK_SIZE.
+		block := bytes.Repeat([]byte("x"), BLOCK_SIZE)
+		c.send(&DATA{BlockNumber: 1, Data: block}, from)
+		expectACK := func(n uint16) {
+			t.Helper()
+			for {
+				p, _ := c.receive()
+				if Equal(p, &ACK{BlockNumber: n}) {
+					return
+				}
+				if !Equal(p, &ACK{BlockNumber: n - 1}) {
+					t.Fatalf("Blksize %s: got %#v, want ACK #%d", blockSize, p, n)
+				}
+			}
+		}
+		expectACK(1)
+		// Once block 1 is in, a timeout resends its ACK, not the OACK.
+		if p, _ := c.receive(); !Equal(p, &ACK{BlockNumber: 1}) {
+			t.Fatalf("Blksize %s: got %#v, want ACK #1", blockSize, p)
+		}
+		c.send(&DATA{BlockNumber: 2, Data: block}, from)
+		expectACK(2)
+		c.send(&DATA{BlockNumber: 3, Data: []byte("end")}, from)
+		expectACK(3)
+		want := append(bytes.Repeat(block, 2), "end"...)
+		if data := <-uploaded; !bytes.Equal(data, want) {
+			t.Errorf("Blksize %s: uploaded %d bytes, want %d", blockSize, len(data), len(want))
+		}
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	panics := make(chan interface{}, 1)
+	s := &Server{
+		WriteHandler:   func(filename string, w *io.PipeWriter) { panic("boom") },
+		OnHandlerPanic: func(req *Request, v interface{}) { panics <- v },
+	}
+	addr := startTestServer(t, s)
+	c := newRawClient(t, addr)
+	c.send(&RRQ{Filename: "file", Mode: "octet"}, nil)
+	c.receiveError(ERR_UNDEFINED)
+	if v := <-panics; v != "boom" {
+		t.Errorf("OnHandlerPanic got %v", v)
+	}
+}
+
+func TestRetransmittedRRQ(t *testing.T) {
+	s := &Server{
+		WriteHandler: serveBytes([]byte("content")),
+		BackoffFunc:  func(attempt int) time.Duration { return 200 * time.Millisecond },
+		wrapConn: func(conn packetConn) packetConn {
+			return &dropConn{packetConn: conn, drop: dropPacket(OP_DATA, 1, 1)}
+		},
+	}
+	addr := startTestServer(t, s)
+	c := newRawClient(t, addr)
+	rrq := &RRQ{Filename: "file", Mode: "octet"}
+	c.send(rrq, nil)
+	// DATA #1 is lost, so the client sends its request again.
+	c.silent(50 * time.Millisecond)
+	c.send(rrq, nil)
+	d, from := c.receiveData(1)
+	if string(d.Data) != "content" {
+		t.Errorf("Got %q", d.Data)
+	}
+	c.send(&ACK{BlockNumber: 1}, from)
+	c.silent(300 * time.Millisecond)
+	if n := s.Stats().Reads; n != 1 {
+		t.Errorf("%d downloads started", n)
+	}
+}
+
+func TestUploadOversizedBlock(t *testing.T) {
+	s := &Server{ReadHandler: func(filename string, r *io.PipeReader) { io.ReadAll(r) }}
+	addr := startTestServer(t, s)
+	c := newRawClient(t, addr)
+	c.send(&WRQ{Filename: "file", Mode: "octet"}, nil)
+	p, from := c.receive()
+	if !Equal(p, &ACK{BlockNumber: 0}) {
+		t.Fatalf("Got %#v, want ACK #0", p)
+	}
+	c.send(&DATA{BlockNumber: 1, Data: make([]byte, BLOCK_SIZE+1)}, from)
+	c.receiveError(ERR_ILLEGAL_OP)
+}
+
+func TestFinalACKLost(t *testing.T) {
+	results := make(chan TransferResult, 1)
+	s := &Server{
+		WriteHandler:       serveBytes([]byte("content")),
+		BackoffFunc:        shortBackoff,
+		OnTransferComplete: func(result TransferResult) { results <- result },
+	}
+	addr := startTestServer(t, s)
+	c := newRawClient(t, addr)
+	c.send(&RRQ{Filename: "file", Mode: "octet"}, nil)
+	// The ACK of the final block is lost, so the block comes again.
+	c.receiveData(1)
+	_, from := c.receiveData(1)
+	select {
+	case result := <-results:
+		t.Fatalf("Transfer ended (%v) before its final ACK", result.Outcome)
+	default:
+	}
+	c.send(&ACK{BlockNumber: 1}, from)
+	select {
+	case result := <-results:
+		if result.Outcome != Completed || result.Bytes != int64(len("content")) {
+			t.Errorf("Outcome %v (%v), %d bytes", result.Outcome, result.Err, result.Bytes)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Transfer did not complete")
+	}
+}
+
+func TestHandlerClosesEarly(t *testing.T) {
+	block := bytes.Repeat([]byte("x"), BLOCK_SIZE)
+	s := &Server{
+		WriteHandler: func(filename string, w *io.PipeWriter) {
+			w.Write(block)
+			w.Write([]byte("partial"))
+			switch filename {
+			case "short":
+				w.Close()
+			case "failed":
+				w.CloseWithError(io.ErrUnexpectedEOF)
+			}
+		},
+	}
+	addr := startTestServer(t, s)
+	data, e := download(t, addr, "short")
+	if e != nil || !bytes.Equal(data, append(block, "partial"...)) {
+		t.Errorf("Clean close: %d bytes, %v", len(data), e)
+	}
+	if _, e := download(t, addr, "failed"); e == nil {
+		t.Error("CloseWithError delivered the file")
+	}
+	c := newRawClient(t, addr)
+	c.send(&RRQ{Filename: "failed", Mode: "octet"}, nil)
+	_, from := c.receiveData(1)
+	c.send(&ACK{BlockNumber: 1}, from)
+	if e := c.receiveError(ERR_NOT_FOUND); e.ErrorMessage != io.ErrUnexpectedEOF.Error() {
+		t.Errorf("ERROR %q", e.ErrorMessage)
+	}
+}
+
+func TestUploadWithoutWaitingForACK(t *testing.T) {
+	uploaded := make(chan []byte, 1)
+	s := &Server{
+		ReadHandler: func(filename string, r *io.PipeReader) {
+			data, _ := io.ReadAll(r)
+			uploaded <- data
+		},
+	}
+	addr := startTestServer(t, s)
+	c := newRawClient(t, addr)
+	// Block 1 goes to the listening socket right behind the request.
+	c.send(&WRQ{Filename: "file", Mode: "octet"}, nil)
+	c.send(&DATA{BlockNumber: 1, Data: []byte("content")}, nil)
+	acked := false
+	for !acked {
+		p, _ := c.receive()
+		switch {
+		case Equal(p, &ACK{BlockNumber: 1}):
+			acked = true
+		case !Equal(p, &ACK{BlockNumber: 0}):
+			t.Fatalf("Got %#v, want ACK #1", p)
+		}
+	}
+	select {
+	case data := <-uploaded:
+		if string(data) != "content" {
+			t.Errorf("Uploaded %q", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Upload did not complete")
+	}
+}
+
+func TestEmptyFilename(t *testing.T) {
+	called := make(chan string, 2)
+	s := &Server{
+		ReadHandler: func(filename string, r *io.PipeReader) {
+			called <- "ReadHandler"
+			io.ReadAll(r)
+		},
+		WriteHandler: func(filename string, w *io.PipeWriter) {
+			called <- "WriteHandler"
+			w.Close()
+		},
+	}
+	addr := startTestServer(t, s)
+	c := newRawClient(t, addr)
+	c.send(&RRQ{Filename: "", Mode: "octet"}, nil)
+	c.receiveError(ERR_ACCESS_VIOLATION)
+	c.send(&WRQ{Filename: "", Mode: "octet"}, nil)
+	c.receiveError(ERR_ACCESS_VIOLATION)
+	select {
+	case handler := <-called:
+		t.Errorf("%s called", handler)
+	default:
+	}
+}
+
+func TestTransmissionConnFails(t *testing.T) {
+	s := &Server{
+		ReadHandler:  func(filename string, r *io.PipeReader) { io.ReadAll(r) },
+		WriteHandler: serveBytes([]byte("content")),
+		TransmissionConnFunc: func(remoteAddr *net.UDPAddr) (*net.UDPConn, error) {
+			return nil, errors.New("Too many open files")
+		},
+	}
+	addr := startTestServer(t, s)
+	c := newRawClient(t, addr)
+	for _, request := range []Packet{
+		&RRQ{Filename: "file", Mode: "octet"},
+		&WRQ{Filename: "file", Mode: "octet"},
+	} {
+		c.send(request, nil)
+		p, from := c.receive()
+		e, ok := p.(*ERROR)
+		if !ok || e.ErrorCode != ERR_UNDEFINED || e.ErrorMessage != "server resource exhausted" {
+			t.Errorf("Got %#v, want ERROR 0 server resource exhausted", p)
+		}
+		if from.Port != addr.Port {
+			t.Errorf("ERROR sent from port %d, not the listening socket", from.Port)
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), BLOCK_SIZE+10)
+	results := make(chan TransferResult, 1)
+	s := &Server{
+		WriteHandler:       serveBytes(content),
+		OnTransferComplete: func(result TransferResult) { results <- result },
+	}
+	addr := startTestServer(t, s)
+	active := newRawClient(t, addr)
+	active.send(&RRQ{Filename: "file", Mode: "octet"}, nil)
+	_, from := active.receiveData(1)
+	s.Drain()
+	for _, p := range []Packet{&RRQ{Filename: "file", Mode: "octet"}, &WRQ{Filename: "file", Mode: "octet"}} {
+		c := newRawClient(t, addr)
+		c.send(p, nil)
+		if e := c.receiveError(ERR_UNDEFINED); e.ErrorMessage != "Server draining" {
+			t.Errorf("ERROR %q", e.ErrorMessage)
+		}
+	}
+	// The transfer in flight goes on.
+	active.send(&ACK{BlockNumber: 1}, from)
+	active.receiveData(2)
+	active.send(&ACK{BlockNumber: 2}, from)
+	if result := <-results; result.Outcome != Completed {
+		t.Errorf("Outcome %v (%v)", result.Outcome, result.Err)
+	}
+	s.Undrain()
+	if data, e := download(t, addr, "file"); e != nil || !bytes.Equal(data, content) {
+		t.Errorf("After Undrain: %d bytes, %v", len(data), e)
+	}
+}
+
+func TestClientRejectsOACK(t *testing.T) {
+	results := make(chan TransferResult, 1)
+	handlerError := make(chan error, 1)
+	s := &Server{
+		WriteHandler: func(filename string, w *io.PipeWriter) {
+			block := bytes.Repeat([]byte("x"), BLOCK_SIZE)
+			for {
+				if _, e := w.Write(block); e != nil {
+					handlerError <- e
+					return
+				}
+			}
+		},
+		OnTransferComplete: func(result TransferResult) { results <- result },
+	}
+	addr := startTestServer(t, s)
+	c := newRawClient(t, addr)
+	c.send(&RRQ{Filename: "file", Mode: "octet", Options: map[string]string{"blksize": "1024"}}, nil)
+	p, from := c.receive()
+	if _, ok := p.(*OACK); !ok {
+		t.Fatalf("Got %#v, want OACK", p)
+	}
+	c.send(&ERROR{ErrorCode: ERR_OPTION_NEGOTIATION, ErrorMessage: "blksize refused"}, from)
+	select {
+	case result := <-results:
+		var peerError *PeerError
+		if result.Outcome != PeerFailed || !errors.As(result.Err, &peerError) || peerError.Code != ERR_OPTION_NEGOTIATION {
+			t.Errorf("Outcome %v (%v), want %v", result.Outcome, result.Err, PeerFailed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Transfer did not end")
+	}
+	select {
+	case e := <-handlerError:
+		var peerError *PeerError
+		if !errors.As(e, &peerError) {
+			t.Errorf("Handler write failed with %v, want the PeerError", e)
+		}
+	case <-time.After(time.Second):
+		t.Error("Handler pipe not closed")
+	}
+}
+
+func TestStrayTransferID(t *testing.T) {
+	addr := startTestServer(t, &Server{WriteHandler: serveBytes(bytes.Repeat([]byte("x"), 1500))})
+	c := newRawClient(t, addr)
+	c.send(&RRQ{Filename: "file", Mode: "octet"}, nil)
+	_, from := c.receiveData(1)
+	// A packet from another port of the client's host reaches the server,
+	// which answers it with ERROR code 5 and goes on with the transfer.
+	stray := newRawClient(t, addr)
+	stray.send(&ACK{BlockNumber: 1}, from)
+	stray.receiveError(ERR_UNKNOWN_TID)
+	c.send(&ACK{BlockNumber: 1}, from)
+	c.receiveData(2)
+}
+
+func TestBusyAllocatesNothing(t *testing.T) {
+	var conns, handlers atomic.Int32
+	s := &Server{
+		MaxTransfers: 1,
+		WriteHandler: func(filename string, w *io.PipeWriter) {
+			handlers.Add(1)
+			w.Write([]byte("content"))
+			w.Close()
+		},
+		ReadHandler: func(filename string, r *io.PipeReader) {
+			handlers.Add(1)
+			io.Copy(io.Discard, r)
+		},
+		TransmissionConnFunc: func(remoteAddr *net.UDPAddr) (*net.UDPConn, error) {
+			conns.Add(1)
+			return net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		},
+	}
+	addr := startTestServer(t, s)
+	// The first transfer holds the only slot while its block 1 waits
+	// for an ACK.
+	c := newRawClient(t, addr)
+	c.send(&RRQ{Filename: "file", Mode: "octet"}, nil)
+	c.receiveData(1)
+	for _, p := range []Packet{&RRQ{Filename: "file", Mode: "octet"}, &WRQ{Filename: "file", Mode: "octet"}} {
+		busy := newRawClient(t, addr)
+		busy.send(p, nil)
+		busy.receiveError(ERR_UNDEFINED)
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("%d transfer sockets opened", n)
+	}
+	if n := handlers.Load(); n != 1 {
+		t.Errorf("%d handlers started", n)
+	}
+}
@@ -0,0 +1,56 @@
+package tftp
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// connectPeer connects conn to peer. The kernel then only delivers the
+// peer's datagrams to conn and reports the ICMP errors answering packets
+// sent to it on the next read, e.g. ECONNREFUSED for a port unreachable.
+// Unlike other platforms, Linux still takes the destination address of
+// WriteToUDP on a connected socket, so the transfer loops need no change.
+func connectPeer(conn *net.UDPConn, peer *net.UDPAddr) error {
+	raw, e := conn.SyscallConn()
+	if e != nil {
+		return e
+	}
+	var connectError error
+	e = raw.Control(func(fd uintptr) {
+		local, e := syscall.Getsockname(int(fd))
+		if e != nil {
+			connectError = e
+			return
+		}
+		var sa syscall.Sockaddr
+		switch local.(type) {
+		case *syscall.SockaddrInet4:
+			ip := peer.IP.To4()
+			if ip == nil {
+				connectError = fmt.Errorf("IPv6 peer %v on an IPv4 socket", peer)
+				return
+			}
+			sa4 := &syscall.SockaddrInet4{Port: peer.Port}
+			copy(sa4.Addr[:], ip)
+			sa = sa4
+		case *syscall.SockaddrInet6:
+			sa6 := &syscall.SockaddrInet6{Port: peer.Port}
+			copy(sa6.Addr[:], peer.IP.To16())
+			if peer.Zone != "" {
+				if ifi, e := net.InterfaceByName(peer.Zone); e == nil {
+					sa6.ZoneId = uint32(ifi.Index)
+				}
+			}
+			sa = sa6
+		default:
+			connectError = fmt.Errorf("Unexpected socket address %v", local)
+			return
+		}
+		connectError = syscall.Connect(int(fd), sa)
+	})
+	if e != nil {
+		return e
+	}
+	return connectError
+}
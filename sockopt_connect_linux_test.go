@@ -0,0 +1,68 @@
+package tftp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeerUnreachable(t *testing.T) {
+	results := make(chan TransferResult, 1)
+	s := &Server{
+		BindAddr:    &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		ConnectPeer: true,
+		WriteHandler: func(filename string, w *io.PipeWriter) {
+			w.Write(bytes.Repeat([]byte("x"), 2000))
+			w.Close()
+		},
+		BackoffFunc: func(attempt int) time.Duration { return 50 * time.Millisecond },
+		OnTransferComplete: func(result TransferResult) {
+			results <- result
+		},
+	}
+	closer, addr, e := s.Listen()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer closer.Close()
+	serverAddr, _ := net.ResolveUDPAddr("udp", addr)
+	client, e := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if e != nil {
+		t.Fatal(e)
+	}
+	rrq := RRQ{Filename: "file", Mode: "octet"}
+	client.WriteToUDP(rrq.Pack(), serverAddr)
+	buffer := make([]byte, MAX_PACKET_SIZE)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, e = client.ReadFromUDP(buffer); e != nil {
+		t.Fatal(e)
+	}
+	// The retransmission of DATA #1 draws ICMP port unreachable.
+	client.Close()
+	select {
+	case result := <-results:
+		if result.Outcome != PeerUnreachable {
+			t.Errorf("Outcome %v (%v), want %v", result.Outcome, result.Err, PeerUnreachable)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Transfer did not end")
+	}
+}
+
+func TestConnectPeerStray(t *testing.T) {
+	addr := startTestServer(t, &Server{
+		WriteHandler: serveBytes(bytes.Repeat([]byte("x"), 1500)),
+		ConnectPeer:  true,
+	})
+	c := newRawClient(t, addr)
+	c.send(&RRQ{Filename: "file", Mode: "octet"}, nil)
+	_, from := c.receiveData(1)
+	// The connected socket never sees the stray's packet.
+	stray := newRawClient(t, addr)
+	stray.send(&ACK{BlockNumber: 1}, from)
+	stray.silent(200 * time.Millisecond)
+	c.send(&ACK{BlockNumber: 1}, from)
+	c.receiveData(2)
+}
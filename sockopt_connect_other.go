@@ -0,0 +1,13 @@
+//go:build !linux
+
+package tftp
+
+import (
+	"net"
+)
+
+// connectPeer leaves conn unconnected: elsewhere WriteToUDP with an
+// address fails on a connected socket.
+func connectPeer(conn *net.UDPConn, peer *net.UDPAddr) error {
+	return nil
+}
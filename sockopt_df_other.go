@@ -0,0 +1,12 @@
+//go:build !(linux || freebsd)
+
+package tftp
+
+import (
+	"fmt"
+	"net"
+)
+
+func setDontFragment(conn *net.UDPConn) error {
+	return fmt.Errorf("Disabling fragmentation is not supported on this platform")
+}
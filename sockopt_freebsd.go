@@ -0,0 +1,29 @@
+package tftp
+
+import (
+	"net"
+	"syscall"
+)
+
+// setDontFragment sets the don't-fragment bit on packets sent from conn,
+// so datagrams larger than the path MTU fail instead of being fragmented.
+func setDontFragment(conn *net.UDPConn) error {
+	raw, e := conn.SyscallConn()
+	if e != nil {
+		return e
+	}
+	v4 := isIPv4Conn(conn)
+	var optError error
+	e = raw.Control(func(fd uintptr) {
+		if v4 {
+			optError = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_DONTFRAG, 1)
+			return
+		}
+		optError = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_DONTFRAG, 1)
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_DONTFRAG, 1)
+	})
+	if e != nil {
+		return e
+	}
+	return optError
+}
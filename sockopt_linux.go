@@ -0,0 +1,30 @@
+package tftp
+
+import (
+	"net"
+	"syscall"
+)
+
+// setDontFragment sets the don't-fragment bit on packets sent from conn.
+// With IP_PMTUDISC_DO the kernel never fragments locally either: sending a
+// datagram larger than the known path MTU fails with EMSGSIZE.
+func setDontFragment(conn *net.UDPConn) error {
+	raw, e := conn.SyscallConn()
+	if e != nil {
+		return e
+	}
+	v4 := isIPv4Conn(conn)
+	var optError error
+	e = raw.Control(func(fd uintptr) {
+		if v4 {
+			optError = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+			return
+		}
+		optError = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO)
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+	})
+	if e != nil {
+		return e
+	}
+	return optError
+}
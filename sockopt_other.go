@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package tftp
+
+import (
+	"fmt"
+	"net"
+)
+
+func setDSCP(conn *net.UDPConn, dscp int) error {
+	return fmt.Errorf("DSCP marking is not supported on this platform")
+}
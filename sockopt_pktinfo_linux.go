@@ -0,0 +1,50 @@
+package tftp
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// enablePacketInfo makes the kernel attach the arrival interface to each
+// datagram read from conn. Dual-stack sockets get it for both families.
+func enablePacketInfo(conn *net.UDPConn) error {
+	raw, e := conn.SyscallConn()
+	if e != nil {
+		return e
+	}
+	v4 := isIPv4Conn(conn)
+	var optError error
+	e = raw.Control(func(fd uintptr) {
+		if v4 {
+			optError = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+			return
+		}
+		optError = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVPKTINFO, 1)
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+	})
+	if e != nil {
+		return e
+	}
+	return optError
+}
+
+// packetInterface returns the arrival interface index recorded in the
+// control messages oob, or 0 if there is none.
+func packetInterface(oob []byte) int {
+	messages, e := syscall.ParseSocketControlMessage(oob)
+	if e != nil {
+		return 0
+	}
+	for _, m := range messages {
+		switch {
+		case m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_PKTINFO &&
+			len(m.Data) >= syscall.SizeofInet4Pktinfo:
+			return int((*syscall.Inet4Pktinfo)(unsafe.Pointer(&m.Data[0])).Ifindex)
+		case m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_PKTINFO &&
+			len(m.Data) >= syscall.SizeofInet6Pktinfo:
+			return int((*syscall.Inet6Pktinfo)(unsafe.Pointer(&m.Data[0])).Ifindex)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package tftp
+
+import (
+	"fmt"
+	"net"
+)
+
+func enablePacketInfo(conn *net.UDPConn) error {
+	return fmt.Errorf("Recording the arrival interface is not supported on this platform")
+}
+
+func packetInterface(oob []byte) int {
+	return 0
+}
@@ -0,0 +1,33 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package tftp
+
+import (
+	"net"
+	"syscall"
+)
+
+// setDSCP marks outgoing packets of conn with the given DSCP value. IPv6
+// sockets get the traffic class set; since a dual-stack socket also carries
+// IPv4 traffic, IP_TOS is attempted on it as well and failures are ignored.
+func setDSCP(conn *net.UDPConn, dscp int) error {
+	raw, e := conn.SyscallConn()
+	if e != nil {
+		return e
+	}
+	tos := dscp << 2
+	v4 := isIPv4Conn(conn)
+	var optError error
+	e = raw.Control(func(fd uintptr) {
+		if v4 {
+			optError = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+			return
+		}
+		optError = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+	})
+	if e != nil {
+		return e
+	}
+	return optError
+}
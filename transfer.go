@@ -0,0 +1,613 @@
+package tftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	errAborted        = errors.New("Transfer aborted")
+	errFileTooLarge   = errors.New("File too large")
+	errBlockTooLarge  = errors.New("Block larger than block size")
+	errTooSlow        = errors.New("Transfer too slow")
+	errHandlerTimeout = errors.New("Handler write timeout")
+	errBlockTransform = errors.New("Block transform failed")
+	errUnknownTID     = errors.New("Unknown transfer ID")
+	errSendTimeout    = errors.New("Send timeout")
+	errReceiveTimeout = errors.New("Receive timeout")
+	errStartBeyondEnd = errors.New("Start block beyond the end of the file")
+	errUnreachable    = errors.New("Peer unreachable")
+	errDowngrade      = errors.New("Peer ignored the negotiated block size")
+
+	errResourceExhausted = errors.New("server resource exhausted")
+)
+
+// PeerError is an ERROR packet received from the other end of a transfer.
+type PeerError struct {
+	Code    uint16
+	Message string
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("Transmission error %d: %s", e.Code, e.Message)
+}
+
+// handlerError is an error the handler closed its pipe with.
+type handlerError struct {
+	err error
+}
+
+func (e *handlerError) Error() string {
+	return fmt.Sprintf("Handler error: %v", e.err)
+}
+
+func (e *handlerError) Unwrap() error {
+	return e.err
+}
+
+// handlerErrorCode returns the ERROR code reported to the client when the
+// handler closed its pipe with e. Permission errors of the file system
+// are access violations; any other error is reported as file not found.
+func handlerErrorCode(e error) uint16 {
+	var panicError *handlerPanic
+	switch {
+	case errors.As(e, &panicError):
+		return ERR_UNDEFINED
+	case errors.Is(e, fs.ErrPermission):
+		return ERR_ACCESS_VIOLATION
+	}
+	return ERR_NOT_FOUND
+}
+
+// Outcome classifies how a transfer ended.
+//
+// PeerUnreachable tells a client whose host answers with ICMP port
+// unreachable, e.g. because a firewall blocks the transfer port, from one
+// that went silent and TimedOut. The kernel only reports those errors to a
+// connected socket, which the server's transfer sockets are on Linux with
+// Server.ConnectPeer. Otherwise, and for pooled sockets (SocketPoolSize)
+// and transfers following the client's port (AdoptPeerPort), which stay
+// unconnected, such a transfer times out instead.
+type Outcome int
+
+const (
+	Completed       Outcome = iota // All data was delivered and acknowledged
+	TimedOut                       // The peer stopped responding
+	PeerFailed                     // The peer sent an ERROR packet
+	HandlerFailed                  // The handler closed its pipe with an error
+	Aborted                        // The server gave up on the transfer
+	PeerUnreachable                // The peer's host refused the packets
+	Failed                         // Any other error, e.g. a socket error
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case Completed:
+		return "completed"
+	case TimedOut:
+		return "timed out"
+	case PeerFailed:
+		return "peer error"
+	case HandlerFailed:
+		return "handler error"
+	case Aborted:
+		return "aborted"
+	case PeerUnreachable:
+		return "peer unreachable"
+	}
+	return "failed"
+}
+
+// outcomeOf classifies the error a transfer loop returned.
+func outcomeOf(e error) Outcome {
+	var peerError *PeerError
+	var handlerError *handlerError
+	switch {
+	case e == nil:
+		return Completed
+	case errors.Is(e, errSendTimeout) || errors.Is(e, errReceiveTimeout):
+		return TimedOut
+	case errors.Is(e, errUnreachable):
+		return PeerUnreachable
+	case errors.As(e, &peerError):
+		return PeerFailed
+	case errors.As(e, &handlerError):
+		return HandlerFailed
+	case errors.Is(e, errAborted) || errors.Is(e, errFileTooLarge) || errors.Is(e, errBlockTooLarge) ||
+		errors.Is(e, errTooSlow) || errors.Is(e, errHandlerTimeout) || errors.Is(e, errBlockTransform) ||
+		errors.Is(e, errDowngrade):
+		return Aborted
+	}
+	return Failed
+}
+
+// TransferResult is reported to Server.OnTransferComplete when a transfer
+// ends, whether it succeeded or not.
+type TransferResult struct {
+	TransferInfo
+	Outcome  Outcome
+	Bytes    int64
+	Duration time.Duration
+	Err      error
+}
+
+// Direction tells which way the file data of a transfer flows.
+type Direction int
+
+const (
+	DirectionRead  Direction = iota // RRQ, the client downloads a file
+	DirectionWrite                  // WRQ, the client uploads a file
+)
+
+func (d Direction) String() string {
+	if d == DirectionWrite {
+		return "write"
+	}
+	return "read"
+}
+
+// TransferInfo describes a transfer handled by the server.
+type TransferInfo struct {
+	ID         uint64
+	Filename   string
+	Mode       string
+	Direction  Direction
+	RemoteAddr *net.UDPAddr
+	Started    time.Time
+}
+
+// transfer is the server's bookkeeping for an in-flight transfer.
+type transfer struct {
+	TransferInfo
+	conn *net.UDPConn
+	// early, for uploads, takes the packets of the client that arrive at
+	// the listening socket.
+	early     *earlyConn
+	closePipe func(error) error
+	// capture, if set, is closed when the transfer ends.
+	capture io.Closer
+	// done cancels the context of the transfer's Request.
+	done   context.CancelFunc
+	cancel chan struct{}
+	once   sync.Once
+}
+
+// abort signals the transfer loop to give up. The read deadline is moved to
+// the past and the handler pipe is closed so a loop blocked either in
+// ReadFromUDP or on the handler notices immediately.
+func (t *transfer) abort() {
+	t.once.Do(func() {
+		close(t.cancel)
+		t.conn.SetReadDeadline(time.Now())
+		t.closePipe(errAborted)
+	})
+}
+
+func (s *Server) startTransfer(filename, mode string, direction Direction, remoteAddr *net.UDPAddr, conn *net.UDPConn, early *earlyConn, closePipe func(error) error) *transfer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.transfers == nil {
+		s.transfers = make(map[uint64]*transfer)
+	}
+	t := &transfer{
+		TransferInfo: TransferInfo{s.transferID(), filename, mode, direction, remoteAddr, time.Now()},
+		conn:         conn,
+		early:        early,
+		closePipe:    closePipe,
+		cancel:       make(chan struct{}),
+	}
+	s.transfers[t.ID] = t
+	s.active.Add(1)
+	atomic.AddInt32(&s.running, 1)
+	s.stats.started[direction].Add(1)
+	return t
+}
+
+// transferID returns the ID of a new transfer. It is called with s.mu held.
+func (s *Server) transferID() uint64 {
+	if s.newID != nil {
+		return s.newID()
+	}
+	s.nextID++
+	return s.nextID
+}
+
+func (s *Server) finishTransfer(t *transfer, bytes int64, e error) {
+	s.mu.Lock()
+	delete(s.transfers, t.ID)
+	s.mu.Unlock()
+	atomic.AddInt32(&s.running, -1)
+	s.stats.finished[outcomeOf(e)].Add(1)
+	s.stats.bytes.Add(bytes)
+	s.closeTransmissionConn(t.conn, t.RemoteAddr)
+	if t.capture != nil {
+		t.capture.Close()
+	}
+	if t.done != nil {
+		t.done()
+	}
+	result := TransferResult{
+		TransferInfo: t.TransferInfo,
+		Outcome:      outcomeOf(e),
+		Bytes:        bytes,
+		Duration:     time.Since(t.Started),
+		Err:          e,
+	}
+	if s.AccessLog != nil {
+		s.writeAccessLog(result)
+	}
+	if s.OnTransferComplete != nil {
+		s.OnTransferComplete(result)
+	}
+	if s.OnReadComplete != nil && t.Direction == DirectionRead {
+		s.OnReadComplete(t.Filename, e)
+	}
+	s.active.Done()
+}
+
+// drain waits for in-flight transfers to finish until ctx is done, then
+// aborts the remaining ones, waits for them to tear down and returns
+// ctx.Err().
+func (s *Server) drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	for _, t := range s.transfers {
+		t.abort()
+	}
+	s.mu.Unlock()
+	<-done
+	return ctx.Err()
+}
+
+// inFlight reports whether a transfer of filename in the given direction is
+// already running for remoteAddr.
+func (s *Server) inFlight(remoteAddr *net.UDPAddr, filename string, direction Direction) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.transfers {
+		if t.Filename == filename && t.Direction == direction &&
+			t.RemoteAddr.Port == remoteAddr.Port && t.RemoteAddr.IP.Equal(remoteAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// earlyData passes DATA that arrived at the listening socket from
+// remoteAddr to its upload, if there is one, and reports whether it did.
+func (s *Server) earlyData(buffer []byte, remoteAddr *net.UDPAddr) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.transfers {
+		if t.early != nil && t.RemoteAddr.Port == remoteAddr.Port && t.RemoteAddr.IP.Equal(remoteAddr.IP) {
+			t.early.deliver(buffer, remoteAddr)
+			return true
+		}
+	}
+	return false
+}
+
+// ActiveTransfers returns the number of transfers in flight. It is cheap
+// enough to call from health checks.
+func (s *Server) ActiveTransfers() int {
+	return int(atomic.LoadInt32(&s.running))
+}
+
+// TotalBytesTransferred returns the file data transferred by all transfers
+// in both directions, as counted against Server.MaxTotalBytes.
+func (s *Server) TotalBytesTransferred() int64 {
+	return s.totalBytes.Load()
+}
+
+// ResetTotalBytes sets the count of bytes transferred back to zero and
+// returns the count it had.
+func (s *Server) ResetTotalBytes() int64 {
+	return s.totalBytes.Swap(0)
+}
+
+// ServerStats is a snapshot of the server's counters returned by Stats. All
+// counters but Active only ever grow while the server exists, so they can
+// be exported as counters to any metrics system.
+type ServerStats struct {
+	// Reads and Writes count the transfers started in each direction.
+	Reads  int64
+	Writes int64
+	// Active is the number of transfers in flight.
+	Active int
+	// Completed counts the transfers that ended successfully, Failed the
+	// others by their outcome.
+	Completed int64
+	Failed    map[Outcome]int64
+	// Bytes counts the file data of finished transfers in both
+	// directions. Unlike TotalBytesTransferred it is never reset.
+	Bytes int64
+	// Retransmits counts the packets sent again after a timeout.
+	Retransmits int64
+}
+
+// serverStats holds the counters behind ServerStats.
+type serverStats struct {
+	started     [DirectionWrite + 1]atomic.Int64
+	finished    [Failed + 1]atomic.Int64
+	bytes       atomic.Int64
+	retransmits atomic.Int64
+}
+
+// Stats returns the server's aggregate counters. It takes no locks and is
+// cheap enough to call on every metrics scrape.
+func (s *Server) Stats() ServerStats {
+	stats := ServerStats{
+		Reads:       s.stats.started[DirectionRead].Load(),
+		Writes:      s.stats.started[DirectionWrite].Load(),
+		Active:      s.ActiveTransfers(),
+		Completed:   s.stats.finished[Completed].Load(),
+		Failed:      make(map[Outcome]int64),
+		Bytes:       s.stats.bytes.Load(),
+		Retransmits: s.stats.retransmits.Load(),
+	}
+	for outcome := TimedOut; outcome <= Failed; outcome++ {
+		stats.Failed[outcome] = s.stats.finished[outcome].Load()
+	}
+	return stats
+}
+
+// Transfers returns a snapshot of the transfers currently in flight.
+func (s *Server) Transfers() []TransferInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	infos := make([]TransferInfo, 0, len(s.transfers))
+	for _, t := range s.transfers {
+		infos = append(infos, t.TransferInfo)
+	}
+	return infos
+}
+
+// AbortTransfer stops the in-flight transfer with the given ID. The client
+// is sent ERROR code 0 and the handler's pipe is closed with an error.
+func (s *Server) AbortTransfer(id uint64) error {
+	s.mu.Lock()
+	t, ok := s.transfers[id]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("No such transfer: %d", id)
+	}
+	t.abort()
+	return nil
+}
+
+// logSummary writes the one-line summary of a finished transfer.
+func logSummary(log *transferLog, filename string, direction Direction, bytes int64, started time.Time, e error) {
+	duration := time.Since(started)
+	rate := 0.0
+	if duration > 0 {
+		rate = float64(bytes) / duration.Seconds() / (1024 * 1024)
+	}
+	status, level := "completed", LogInfo
+	if e != nil {
+		status, level = fmt.Sprintf("failed: %v", e), LogError
+	}
+	log.logf(level, "transfer %s (filename=%s, direction=%s, bytes=%d, duration=%s, rate=%.2f MB/s)",
+		status, filename, direction, bytes, duration, rate)
+}
+
+// DEFAULT_RETRANSMIT_JITTER is the retransmission jitter used when
+// Server.RetransmitJitter is zero.
+const DEFAULT_RETRANSMIT_JITTER = 0.1
+
+// jittered varies d randomly by up to ±fraction of it, so that transfers
+// timing out together do not retransmit together.
+func jittered(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	return d + time.Duration((rand.Float64()*2-1)*fraction*float64(d))
+}
+
+// retransmitTimeout returns how long to wait for a reply to the attempt-th
+// transmission of a packet, counting from zero: the value of backoff if
+// set, base otherwise. With negotiated set, base is the interval the peer
+// asked for with the timeout option, and backoff is scaled so its first
+// attempt waits that long while later ones still back off as usual.
+func retransmitTimeout(backoff func(attempt int) time.Duration, attempt int, base time.Duration, negotiated bool) time.Duration {
+	if backoff == nil {
+		return base
+	}
+	d := backoff(attempt)
+	if !negotiated {
+		return d
+	}
+	if first := backoff(0); first > 0 {
+		return time.Duration(float64(d) * float64(base) / float64(first))
+	}
+	return base
+}
+
+// ExponentialBackoff returns a Server.BackoffFunc starting at base and
+// doubling with every retransmission, up to max.
+func ExponentialBackoff(base, max time.Duration) func(attempt int) time.Duration {
+	return func(attempt int) time.Duration {
+		d := base
+		for i := 0; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			return max
+		}
+		return d
+	}
+}
+
+// idleClock decides how long the packets of a transfer are retransmitted.
+// Without a timeout each packet is given up on after three attempts; with
+// one, retransmissions go on until the transfer has made no progress for
+// that long, however long it has been running.
+type idleClock struct {
+	timeout  time.Duration
+	progress time.Time
+	clock    clock
+}
+
+// advance records progress, i.e. a block delivered.
+func (c *idleClock) advance() {
+	c.progress = c.clock.Now()
+}
+
+// retry reports whether the attempt-th transmission of a packet, counting
+// from zero, is to be made.
+func (c *idleClock) retry(attempt int) bool {
+	if c.timeout <= 0 {
+		return attempt < 3
+	}
+	return attempt == 0 || c.clock.Now().Sub(c.progress) < c.timeout
+}
+
+// wait caps the time to wait for a reply, d, at what is left of the idle
+// timeout.
+func (c *idleClock) wait(d time.Duration) time.Duration {
+	if c.timeout <= 0 {
+		return d
+	}
+	if left := c.timeout - c.clock.Now().Sub(c.progress); left < d {
+		return left
+	}
+	return d
+}
+
+// DEFAULT_MIN_THROUGHPUT_WINDOW is the period over which the throughput of
+// a transfer is measured when Server.MinThroughputWindow is zero.
+const DEFAULT_MIN_THROUGHPUT_WINDOW = 10 * time.Second
+
+// rateMonitor measures the throughput of a transfer over consecutive
+// windows of the given length, so that a stall shorter than a window does
+// not condemn a transfer that is otherwise fast enough.
+type rateMonitor struct {
+	// min is the required throughput in bytes per second; zero disables
+	// the monitor.
+	min        int64
+	window     time.Duration
+	start      time.Time
+	startBytes int64
+	clock      clock
+}
+
+// ok reports whether a transfer having moved total bytes so far is still
+// fast enough. The rate is only judged once a full window has passed.
+func (m *rateMonitor) ok(total int64) bool {
+	if m.min <= 0 {
+		return true
+	}
+	now := m.clock.Now()
+	if m.start.IsZero() {
+		m.start, m.startBytes = now, total
+		return true
+	}
+	elapsed := now.Sub(m.start)
+	if elapsed < m.window {
+		return true
+	}
+	rate := float64(total-m.startBytes) / elapsed.Seconds()
+	m.start, m.startBytes = now, total
+	return rate >= float64(m.min)
+}
+
+// nextBlock returns the block number following n, which is wrapTo after
+// block 65535.
+func nextBlock(n, wrapTo uint16) uint16 {
+	if n == 65535 {
+		return wrapTo
+	}
+	return n + 1
+}
+
+// sendErrorPacket sends the ERROR packet reporting e to addr and logs it.
+// messageFunc, if set, chooses the text sent instead of the error string.
+func sendErrorPacket(conn packetConn, log *transferLog, addr *net.UDPAddr, code uint16, e error, messageFunc func(code uint16, e error) string) {
+	message := e.Error()
+	if messageFunc != nil {
+		message = messageFunc(code, e)
+	}
+	errorPacket := ERROR{code, message}
+	conn.WriteToUDP(errorPacket.Pack(), addr)
+	if message != e.Error() {
+		log.Debugf("sent ERROR (code=%d): %s (%v)", code, message, e)
+		return
+	}
+	log.Debugf("sent ERROR (code=%d): %s", code, message)
+}
+
+// acceptPeer checks that a packet from addr belongs to the transfer with
+// peer. A packet from any other address is answered with ERROR code 5 and
+// must be ignored, without disturbing the transfer. With adoptPort a
+// change of the peer's port alone, as made by some NATs mid-flow, is
+// followed instead. It returns the peer of the transfer from then on.
+func acceptPeer(conn packetConn, log *transferLog, peer, addr *net.UDPAddr, adoptPort bool, messageFunc func(code uint16, e error) string) (*net.UDPAddr, bool) {
+	if addr.Port == peer.Port && addr.IP.Equal(peer.IP) {
+		return peer, true
+	}
+	if adoptPort && addr.IP.Equal(peer.IP) {
+		log.Infof("Peer port changed from %d to %d", peer.Port, addr.Port)
+		return addr, true
+	}
+	log.Debugf("Rejecting packet from %v with unknown transfer ID", addr)
+	sendErrorPacket(conn, log, addr, ERR_UNKNOWN_TID, errUnknownTID, messageFunc)
+	return peer, false
+}
+
+// aborted reports whether cancel has been closed. A nil channel, as used by
+// the client, is never aborted.
+func aborted(cancel <-chan struct{}) bool {
+	select {
+	case <-cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// readFailed returns the error ending a transfer whose socket failed to
+// read with e. A refused connection is the ICMP error the peer's host
+// answered a packet with.
+func readFailed(e error) error {
+	if errors.Is(e, syscall.ECONNREFUSED) {
+		return fmt.Errorf("%w: %v", errUnreachable, e)
+	}
+	return fmt.Errorf("Error reading UDP packet: %v", e)
+}
+
+// setReadDeadline arms the read deadline of conn unless the transfer has
+// already been aborted. Checking after the deadline is set closes the race
+// with transfer.abort resetting it.
+func setReadDeadline(conn packetConn, clock clock, cancel <-chan struct{}, d time.Duration) error {
+	if e := conn.SetReadDeadline(clock.Now().Add(d)); e != nil {
+		return fmt.Errorf("Could not set UDP timeout: %v", e)
+	}
+	if aborted(cancel) {
+		return errAborted
+	}
+	return nil
+}
+
+// isIPv4Conn reports whether conn is bound to an IPv4 address. Wildcard
+// sockets opened with the "udp" network are IPv6 dual-stack sockets.
+func isIPv4Conn(conn *net.UDPConn) bool {
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	return ok && addr.IP.To4() != nil
+}
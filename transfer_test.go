@@ -0,0 +1,71 @@
+package tftp
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetransmitTimeout(t *testing.T) {
+	backoff := ExponentialBackoff(time.Second, 8*time.Second)
+	for _, c := range []struct {
+		name       string
+		backoff    func(int) time.Duration
+		attempt    int
+		base       time.Duration
+		negotiated bool
+		want       time.Duration
+	}{
+		{"default", nil, 2, 3 * time.Second, false, 3 * time.Second},
+		{"negotiated", nil, 2, 7 * time.Second, true, 7 * time.Second},
+		{"backoff", backoff, 2, 3 * time.Second, false, 4 * time.Second},
+		{"backoff from negotiated", backoff, 0, 2 * time.Second, true, 2 * time.Second},
+		{"backoff scaled", backoff, 2, 2 * time.Second, true, 8 * time.Second},
+		{"backoff capped and scaled", backoff, 5, 2 * time.Second, true, 16 * time.Second},
+	} {
+		if got := retransmitTimeout(c.backoff, c.attempt, c.base, c.negotiated); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestRetransmitIntervalNegotiated(t *testing.T) {
+	s := &sender{backoff: ExponentialBackoff(time.Second, 4*time.Second), timeout: 3 * time.Second}
+	for i, want := range []time.Duration{3 * time.Second, 6 * time.Second, 12 * time.Second, 12 * time.Second} {
+		if got := s.retransmitInterval(i); got != want {
+			t.Errorf("sender attempt %d: got %v, want %v", i, got, want)
+		}
+	}
+	r := &receiver{timeout: 2 * time.Second}
+	if got := r.retransmitInterval(4); got != 2*time.Second {
+		t.Errorf("receiver: got %v, want 2s", got)
+	}
+	if got := (&receiver{}).retransmitInterval(0); got != 5*time.Second {
+		t.Errorf("receiver default: got %v, want 5s", got)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var buffer bytes.Buffer
+	s := &Server{AccessLog: &buffer}
+	s.writeAccessLog(TransferResult{
+		TransferInfo: TransferInfo{
+			Filename:   "pxe linux.0",
+			Mode:       "octet",
+			Direction:  DirectionRead,
+			RemoteAddr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 1024},
+		},
+		Outcome: TimedOut,
+		Bytes:   512,
+	})
+	line := strings.TrimSuffix(buffer.String(), "\n")
+	stamp, rest, _ := strings.Cut(line, " ")
+	if want := `192.0.2.7 read "pxe linux.0" octet 512 timed-out`; rest != want {
+		t.Errorf("Logged %q, want %q", rest, want)
+	}
+	if ended, e := time.Parse(time.RFC3339, stamp); e != nil || !strings.HasSuffix(stamp, "Z") || time.Since(ended) > time.Minute {
+		t.Errorf("Logged time %q, want the current time in UTC", stamp)
+	}
+}
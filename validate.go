@@ -0,0 +1,117 @@
+package tftp
+
+import (
+	"fmt"
+	"path"
+)
+
+// Validate checks the server configuration for mistakes that would
+// otherwise only show up once requests arrive. Listen, Serve and
+// ServeContext call it before binding.
+func (s *Server) Validate() error {
+	if s.BindAddr == nil {
+		return fmt.Errorf("No bind address")
+	}
+	for _, addr := range s.BindAddrs {
+		if addr == nil || addr.IP == nil {
+			return fmt.Errorf("BindAddrs needs addresses with an IP: %v", addr)
+		}
+	}
+	if len(s.BindAddrs) > 0 && s.BindAddr.IP == nil {
+		return fmt.Errorf("BindAddr needs an IP with BindAddrs: %v", s.BindAddr)
+	}
+	if s.readHandler() == nil && s.UploadFunc == nil &&
+		s.writeHandler() == nil && s.ContentFunc == nil && s.BlockFunc == nil && !s.EnableListing {
+		return fmt.Errorf("No read or write handler")
+	}
+	if s.EnableListing && s.ListFunc == nil {
+		return fmt.Errorf("Listing enabled without ListFunc")
+	}
+	if r := s.PortRange; r != nil && (r.Min <= 0 || r.Max > 65535 || r.Min > r.Max) {
+		return fmt.Errorf("Invalid port range: %d-%d", r.Min, r.Max)
+	}
+	if s.SocketPoolSize < 0 {
+		return fmt.Errorf("Negative SocketPoolSize: %d", s.SocketPoolSize)
+	}
+	if s.DSCP < 0 || s.DSCP > 63 {
+		return fmt.Errorf("Invalid DSCP value: %d", s.DSCP)
+	}
+	if s.DrainTimeout < 0 {
+		return fmt.Errorf("Negative DrainTimeout: %v", s.DrainTimeout)
+	}
+	if s.PollInterval < 0 {
+		return fmt.Errorf("Negative PollInterval: %v", s.PollInterval)
+	}
+	if s.IdleTimeout < 0 {
+		return fmt.Errorf("Negative IdleTimeout: %v", s.IdleTimeout)
+	}
+	if s.InterBlockDelay < 0 {
+		return fmt.Errorf("Negative InterBlockDelay: %v", s.InterBlockDelay)
+	}
+	if s.DallyTimeout < 0 {
+		return fmt.Errorf("Negative DallyTimeout: %v", s.DallyTimeout)
+	}
+	if s.HandlerWriteTimeout < 0 {
+		return fmt.Errorf("Negative HandlerWriteTimeout: %v", s.HandlerWriteTimeout)
+	}
+	if s.MaxFileSize < 0 {
+		return fmt.Errorf("Negative MaxFileSize: %d", s.MaxFileSize)
+	}
+	if s.MinThroughput < 0 || s.MinThroughputWindow < 0 {
+		return fmt.Errorf("Negative MinThroughput or MinThroughputWindow")
+	}
+	if s.MaxTransfers < 0 {
+		return fmt.Errorf("Negative MaxTransfers: %d", s.MaxTransfers)
+	}
+	if s.MaxTotalBytes < 0 {
+		return fmt.Errorf("Negative MaxTotalBytes: %d", s.MaxTotalBytes)
+	}
+	if s.MaxOptions < 0 || s.MaxOptionBytes < 0 {
+		return fmt.Errorf("Negative MaxOptions or MaxOptionBytes")
+	}
+	if s.MaxWindowSize > MAX_WINDOW_SIZE {
+		return fmt.Errorf("MaxWindowSize beyond %d: %d", MAX_WINDOW_SIZE, s.MaxWindowSize)
+	}
+	if s.MaxBlockSize > MAX_BLOCK_SIZE || s.MaxBlockSize > 0 && s.MaxBlockSize < MIN_BLOCK_SIZE {
+		return fmt.Errorf("Invalid MaxBlockSize: %d", s.MaxBlockSize)
+	}
+	if (s.RequireOptions || s.RequireBlockSize > 0) && s.DisableOptions {
+		return fmt.Errorf("Options required with DisableOptions")
+	}
+	if max := s.optionConfig().maxBlockSize; s.RequireBlockSize < 0 || s.RequireBlockSize > BLOCK_SIZE && s.RequireBlockSize > max {
+		return fmt.Errorf("Invalid RequireBlockSize: %d", s.RequireBlockSize)
+	}
+	if s.MaxTimeoutOption > MAX_TIMEOUT {
+		return fmt.Errorf("MaxTimeoutOption beyond %v: %v", MAX_TIMEOUT, s.MaxTimeoutOption)
+	}
+	if s.RetransmitJitter >= 1 {
+		return fmt.Errorf("RetransmitJitter must be less than 1: %v", s.RetransmitJitter)
+	}
+	if s.DefaultMode != "" && !knownMode(s.DefaultMode) {
+		return fmt.Errorf("Unknown DefaultMode: %q", s.DefaultMode)
+	}
+	for _, mode := range s.AllowedModes {
+		if !knownMode(mode) {
+			return fmt.Errorf("Unknown mode in AllowedModes: %q", mode)
+		}
+	}
+	if s.DefaultMode != "" && !s.modeAllowed(s.DefaultMode) {
+		return fmt.Errorf("DefaultMode %q not in AllowedModes", s.DefaultMode)
+	}
+	if s.Cache != nil && s.Cache.MaxBytes <= 0 {
+		return fmt.Errorf("Cache without MaxBytes")
+	}
+	for _, network := range s.AllowedClients {
+		if network == nil {
+			return fmt.Errorf("Nil network in AllowedClients")
+		}
+	}
+	for _, patterns := range [][]string{s.AllowPatterns, s.DenyPatterns} {
+		for _, pattern := range patterns {
+			if _, e := path.Match(pattern, ""); e != nil {
+				return fmt.Errorf("Invalid file pattern %q: %v", pattern, e)
+			}
+		}
+	}
+	return nil
+}